@@ -1,7 +1,6 @@
 package flagger
 
 import (
-	"github.com/airdeploy/flagger-go/v3/core"
 	"github.com/airdeploy/flagger-go/v3/log"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -22,6 +21,18 @@ const (
 	FlaggerSSEUrl          = "FLAGGER_SSE_URL"
 	FlaggerIngestionURL    = "FLAGGER_INGESTION_URL"
 	FlaggerLogLevel        = "FLAGGER_LOG_LEVEL"
+	FlaggerAuthMode        = "FLAGGER_AUTH_MODE"
+)
+
+// AuthMode defines how the API key is sent to Airship
+type AuthMode string
+
+const (
+	// AuthModePath appends the API key to every URL path, it is the default mode
+	AuthModePath AuthMode = "path"
+
+	// AuthModeHeader sends the API key in the "Authorization: Bearer" header, URLs stay without the key
+	AuthModeHeader AuthMode = "header"
 )
 
 func getVarOrEnv(variable, key string) string {
@@ -44,38 +55,52 @@ func validateURL(URL, defaultValue string) (string, error) {
 	return parsedURL.String(), nil
 }
 
-func populateURL(urlName, envKey, argsURL, defaultValue, apiKey string) string {
+func populateURL(urlName, envKey, argsURL, defaultValue, apiKey string, logger log.Logger) string {
 	providedURL := getVarOrEnv(argsURL, envKey)
 	if validURL, err := validateURL(providedURL, defaultValue); err != nil {
-		log.Errorf("Malformed "+urlName+": %s", providedURL)
+		logger.Error("Malformed "+urlName, "url", providedURL)
 		panic(ErrBadInitArgs)
 	} else {
-		log.Debugf(urlName+": %s", validURL)
+		logger.Debug(urlName, "url", validURL)
 		return validURL + apiKey
 	}
 }
 
 // prepareInitArgs does not mutate provided args *InitArgs returning a copy
-func prepareInitArgs(args *InitArgs, info *core.SDKInfo) (_ *InitArgs, err error) {
+func prepareInitArgs(args *InitArgs, opts *options) (_ *InitArgs, err error) {
 	if args == nil {
 		args = &InitArgs{}
 	}
 	args = args.copy()
-	info = info.Copy()
+	info := opts.sdkInfo
+	logger := opts.logger
 
 	args.APIKey = getVarOrEnv(args.APIKey, FlaggerAPIKey)
 	if args.APIKey == "" {
-		log.Errorf("empty APIKey")
+		logger.Error("empty APIKey")
 		err = ErrBadInitArgs
 	}
 
 	if info.Name == "" {
-		log.Errorf("empty SDKInfo.Name")
+		logger.Error("empty SDKInfo.Name")
 		err = ErrBadInitArgs
 	}
 
 	if info.Version == "" {
-		log.Errorf("empty SDKInfo.Version")
+		logger.Error("empty SDKInfo.Version")
+		err = ErrBadInitArgs
+	}
+
+	args.AuthMode = AuthMode(getVarOrEnv(string(args.AuthMode), FlaggerAuthMode))
+
+	// the key becomes part of the URL only in the path mode
+	var pathAPIKey string
+	switch args.AuthMode {
+	case "", AuthModePath:
+		pathAPIKey = args.APIKey
+	case AuthModeHeader:
+	default:
+		logger.Error("Unknown AuthMode", "authMode", args.AuthMode)
 		err = ErrBadInitArgs
 	}
 
@@ -84,10 +109,10 @@ func prepareInitArgs(args *InitArgs, info *core.SDKInfo) (_ *InitArgs, err error
 			err = ErrBadInitArgs
 		}
 	}()
-	args.SourceURL = populateURL("SourceURL", FlaggerSourceURL, args.SourceURL, defaultSourceURL, args.APIKey)
-	args.BackupSourceURL = populateURL("BackupSourceURL", FlaggerBackupSourceURL, args.BackupSourceURL, defaultBackupSourceURL, args.APIKey)
-	args.SSEURL = populateURL("SSEURL", FlaggerSSEUrl, args.SSEURL, defaultSSEURL, args.APIKey)
-	args.IngestionURL = populateURL("IngestionURL", FlaggerIngestionURL, args.IngestionURL, defaultIngestionURL, args.APIKey)
+	args.SourceURL = populateURL("SourceURL", FlaggerSourceURL, args.SourceURL, opts.sourceURL, pathAPIKey, logger)
+	args.BackupSourceURL = populateURL("BackupSourceURL", FlaggerBackupSourceURL, args.BackupSourceURL, opts.backupSourceURL, pathAPIKey, logger)
+	args.SSEURL = populateURL("SSEURL", FlaggerSSEUrl, args.SSEURL, opts.sseURL, pathAPIKey, logger)
+	args.IngestionURL = populateURL("IngestionURL", FlaggerIngestionURL, args.IngestionURL, opts.ingestionURL, pathAPIKey, logger)
 
 	args.LogLevel = getVarOrEnv(args.LogLevel, FlaggerLogLevel)
 	if args.LogLevel == "" {
@@ -96,11 +121,11 @@ func prepareInitArgs(args *InitArgs, info *core.SDKInfo) (_ *InitArgs, err error
 
 	level, parseError := logrus.ParseLevel(args.LogLevel)
 	if parseError != nil {
-		log.SetLevel(logrus.ErrorLevel)
-		log.Errorf("Cannot parse provided logLevel %s, Error level is set", args.LogLevel)
+		opts.logrus.SetLevel(logrus.ErrorLevel)
+		logger.Error("Cannot parse provided logLevel, Error level is set", "logLevel", args.LogLevel)
 		err = ErrBadInitArgs
 	} else {
-		log.SetLevel(level)
+		opts.logrus.SetLevel(level)
 	}
 
 	return args, err
@@ -114,5 +139,6 @@ func (args *InitArgs) copy() *InitArgs {
 		SSEURL:          args.SSEURL,
 		IngestionURL:    args.IngestionURL,
 		LogLevel:        args.LogLevel,
+		AuthMode:        args.AuthMode,
 	}
 }
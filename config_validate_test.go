@@ -6,6 +6,7 @@ import (
 	"testing"
 
 	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -23,7 +24,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		args2, err := prepareInitArgs(args1, SDKInfo)
+		args2, err := prepareInitArgs(args1, newOptions())
 
 		assert.False(t, args1 == args2)
 		assert.NoError(t, err)
@@ -31,7 +32,7 @@ func Test_prepareInitArgs(t *testing.T) {
 
 	t.Run("positive2", func(t *testing.T) {
 		args1 := &InitArgs{APIKey: utils.APIKey}
-		args2, err := prepareInitArgs(args1, SDKInfo)
+		args2, err := prepareInitArgs(args1, newOptions())
 		assert.False(t, args1 == args2)
 		assert.EqualValues(t,
 			&InitArgs{
@@ -46,6 +47,27 @@ func Test_prepareInitArgs(t *testing.T) {
 		assert.NoError(t, err)
 	})
 
+	t.Run("header AuthMode", func(t *testing.T) {
+		args, err := prepareInitArgs(&InitArgs{APIKey: utils.APIKey, AuthMode: AuthModeHeader}, newOptions())
+		assert.EqualValues(t,
+			&InitArgs{
+				APIKey:          utils.APIKey,
+				SourceURL:       defaultSourceURL,
+				BackupSourceURL: defaultBackupSourceURL,
+				IngestionURL:    defaultIngestionURL,
+				SSEURL:          defaultSSEURL,
+				LogLevel:        "error",
+				AuthMode:        AuthModeHeader,
+			},
+			args)
+		assert.NoError(t, err)
+	})
+
+	t.Run("unknown AuthMode", func(t *testing.T) {
+		_, err := prepareInitArgs(&InitArgs{APIKey: utils.APIKey, AuthMode: "cookie"}, newOptions())
+		assert.Equal(t, ErrBadInitArgs, err)
+	})
+
 	t.Run("empty APIKey", func(t *testing.T) {
 		args := &InitArgs{
 			APIKey:          "",
@@ -54,7 +76,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		_, err := prepareInitArgs(args, SDKInfo)
+		_, err := prepareInitArgs(args, newOptions())
 		assert.Equal(t, ErrBadInitArgs, err)
 	})
 
@@ -66,7 +88,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		_, err := prepareInitArgs(args1, &core.SDKInfo{Name: "", Version: "3.0.0"})
+		_, err := prepareInitArgs(args1, newOptions(WithSDKInfo(&core.SDKInfo{Name: "", Version: "3.0.0"})))
 		assert.Equal(t, ErrBadInitArgs, err)
 	})
 
@@ -78,7 +100,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		_, err := prepareInitArgs(args, &core.SDKInfo{Name: "golang", Version: ""})
+		_, err := prepareInitArgs(args, newOptions(WithSDKInfo(&core.SDKInfo{Name: "golang", Version: ""})))
 		assert.Equal(t, ErrBadInitArgs, err)
 	})
 
@@ -90,7 +112,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		args2, err := prepareInitArgs(args1, SDKInfo)
+		args2, err := prepareInitArgs(args1, newOptions())
 		assert.False(t, args1 == args2)
 		assert.NoError(t, err)
 		assert.Equal(t, defaultSourceURL+utils.APIKey, args2.SourceURL)
@@ -104,7 +126,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		args2, err := prepareInitArgs(args1, SDKInfo)
+		args2, err := prepareInitArgs(args1, newOptions())
 		assert.False(t, args1 == args2)
 		assert.NoError(t, err)
 		assert.Equal(t, defaultBackupSourceURL+utils.APIKey, args2.BackupSourceURL)
@@ -118,7 +140,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		args2, err := prepareInitArgs(args1, SDKInfo)
+		args2, err := prepareInitArgs(args1, newOptions())
 		assert.False(t, args1 == args2)
 		assert.NoError(t, err)
 		assert.Equal(t, defaultIngestionURL+utils.APIKey, args2.IngestionURL)
@@ -132,7 +154,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "",
 		}
-		args2, err := prepareInitArgs(args1, SDKInfo)
+		args2, err := prepareInitArgs(args1, newOptions())
 		assert.False(t, args1 == args2)
 		assert.NoError(t, err)
 		assert.Equal(t, defaultSSEURL+utils.APIKey, args2.SSEURL)
@@ -146,7 +168,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		_, err := prepareInitArgs(args, SDKInfo)
+		_, err := prepareInitArgs(args, newOptions())
 		assert.Equal(t, ErrBadInitArgs, err)
 	})
 
@@ -158,7 +180,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		_, err := prepareInitArgs(args, SDKInfo)
+		_, err := prepareInitArgs(args, newOptions())
 		assert.Equal(t, ErrBadInitArgs, err)
 	})
 
@@ -170,7 +192,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "bad url",
 			SSEURL:          "https://sse.airdeploy.io",
 		}
-		_, err := prepareInitArgs(args, SDKInfo)
+		_, err := prepareInitArgs(args, newOptions())
 		assert.Equal(t, ErrBadInitArgs, err)
 	})
 
@@ -182,7 +204,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "https://ingestion.airdeploy.io",
 			SSEURL:          "bad url",
 		}
-		_, err := prepareInitArgs(args, SDKInfo)
+		_, err := prepareInitArgs(args, newOptions())
 		assert.Equal(t, ErrBadInitArgs, err)
 	})
 
@@ -195,10 +217,21 @@ func Test_prepareInitArgs(t *testing.T) {
 			SSEURL:          "https://sse.airdeploy.io",
 			LogLevel:        "notValid",
 		}
-		_, err := prepareInitArgs(args, SDKInfo)
+		_, err := prepareInitArgs(args, newOptions())
 		assert.Equal(t, ErrBadInitArgs, err)
 	})
 
+	t.Run("LogLevel is set per instance", func(t *testing.T) {
+		debug, errorOnly := newOptions(), newOptions()
+		_, err := prepareInitArgs(&InitArgs{APIKey: utils.APIKey, LogLevel: "debug"}, debug)
+		assert.NoError(t, err)
+		_, err = prepareInitArgs(&InitArgs{APIKey: utils.APIKey, LogLevel: "error"}, errorOnly)
+		assert.NoError(t, err)
+
+		assert.Equal(t, logrus.DebugLevel, debug.logrus.GetLevel())
+		assert.Equal(t, logrus.ErrorLevel, errorOnly.logrus.GetLevel())
+	})
+
 	t.Run("Custom URLs", func(t *testing.T) {
 		args := &InitArgs{
 			APIKey:          utils.APIKey,
@@ -207,7 +240,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    ingestionURL,
 			SSEURL:          sseURL,
 		}
-		args, _ = prepareInitArgs(args, SDKInfo)
+		args, _ = prepareInitArgs(args, newOptions())
 		assert.Equal(t, args.SourceURL, sourceURL+utils.APIKey)
 		assert.Equal(t, args.BackupSourceURL, backupSourceURL+utils.APIKey)
 		assert.Equal(t, args.IngestionURL, ingestionURL+utils.APIKey)
@@ -228,7 +261,7 @@ func Test_prepareInitArgs(t *testing.T) {
 			IngestionURL:    "",
 			SSEURL:          "",
 		}
-		args, _ = prepareInitArgs(args, SDKInfo)
+		args, _ = prepareInitArgs(args, newOptions())
 
 		assert.Equal(t, args.SourceURL, sourceURL+utils.APIKey)
 		assert.Equal(t, args.BackupSourceURL, backupSourceURL+utils.APIKey)
@@ -247,7 +280,7 @@ func Test_prepareInitArgs(t *testing.T) {
 		args := &InitArgs{
 			APIKey: utils.APIKey,
 		}
-		args, err := prepareInitArgs(args, SDKInfo)
+		args, err := prepareInitArgs(args, newOptions())
 		assert.Equal(t, ErrBadInitArgs, err)
 		_ = os.Unsetenv(FlaggerSourceURL)
 	})
@@ -0,0 +1,223 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/airdeploy/flagger-go/v3/json"
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/pkg/errors"
+)
+
+var errAssignmentStoreClosed = errors.New("assignment store is closed")
+
+// AssignmentKey identifies the variation assigned to the entity for the flag.
+// EntityID is the hashed ID: the value of bucketBy attribute if it's used or the group ID for group subpopulations
+type AssignmentKey struct {
+	Codename   string `json:"codename"`
+	EntityID   string `json:"entityId"`
+	EntityType string `json:"entityType"`
+}
+
+// AssignmentStore keeps the variations assigned to the sampled entities, so the entities keep their variations
+// when the probabilities of the variations are changed. Must be safe for concurrent use
+type AssignmentStore interface {
+	// Get returns the stored variation, ok is false if there is no assignment
+	Get(key AssignmentKey) (variation string, ok bool, err error)
+	// Put stores the variation
+	Put(key AssignmentKey, variation string) error
+}
+
+// MemoryAssignmentStore keeps the assignments in memory
+type MemoryAssignmentStore struct {
+	mux         sync.RWMutex
+	assignments map[AssignmentKey]string
+}
+
+// NewMemoryAssignmentStore returns the empty in-memory store
+func NewMemoryAssignmentStore() *MemoryAssignmentStore {
+	return &MemoryAssignmentStore{assignments: make(map[AssignmentKey]string)}
+}
+
+// Get returns the stored variation
+func (s *MemoryAssignmentStore) Get(key AssignmentKey) (string, bool, error) {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	variation, ok := s.assignments[key]
+	return variation, ok, nil
+}
+
+// Put stores the variation
+func (s *MemoryAssignmentStore) Put(key AssignmentKey, variation string) error {
+	s.mux.Lock()
+	s.assignments[key] = variation
+	s.mux.Unlock()
+	return nil
+}
+
+// FileAssignmentStore keeps the assignments in memory and appends every new assignment
+// to the file as JSON line, so the assignments survive restarts.
+// The lines are written by the background goroutine, Put never waits for the disk. Close writes the pending lines
+type FileAssignmentStore struct {
+	memory MemoryAssignmentStore
+	log    log.Logger
+	file   *os.File
+
+	mux     sync.Mutex // guards pending and closed
+	pending []byte     // JSON lines waiting to be written
+	closed  bool
+	wake    chan struct{} // closed by Close
+	done    chan struct{} // closed when the pending lines are written after Close
+}
+
+type assignmentRecord struct {
+	AssignmentKey
+	Variation string `json:"variation"`
+}
+
+// NewFileAssignmentStore loads the assignments from the file, the file is created if it doesn't exist.
+// Corrupted lines are skipped, the file is compacted to the last assignment of every entity.
+// logger nil means log.Default()
+func NewFileAssignmentStore(path string, logger log.Logger) (*FileAssignmentStore, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	s := &FileAssignmentStore{
+		memory: MemoryAssignmentStore{assignments: make(map[AssignmentKey]string)},
+		log:    logger,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if err := s.load(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot open assignment file")
+	}
+	s.file = f
+	go s.writeLoop()
+	return s, nil
+}
+
+// load reads the assignments and compacts the file if it has corrupted lines or overwritten assignments
+func (s *FileAssignmentStore) load(path string) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "cannot open assignment file")
+	}
+
+	lines := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines++
+		var record assignmentRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			s.log.Warn("Assignment file line is corrupted, skipping it", "path", path, "line", lines, "error", err)
+			continue
+		}
+		// the last assignment wins
+		s.memory.assignments[record.AssignmentKey] = record.Variation
+	}
+	err = scanner.Err()
+	_ = f.Close()
+	if err != nil {
+		return errors.Wrap(err, "cannot read assignment file")
+	}
+	if lines == len(s.memory.assignments) {
+		return nil
+	}
+	return s.compact(path)
+}
+
+// compact replaces the file with one line per assignment
+func (s *FileAssignmentStore) compact(path string) error {
+	var buf bytes.Buffer
+	for key, variation := range s.memory.assignments {
+		line, err := json.Marshal(&assignmentRecord{AssignmentKey: key, Variation: variation})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return errors.Wrap(err, "cannot compact assignment file")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "cannot compact assignment file")
+}
+
+// Get returns the stored variation
+func (s *FileAssignmentStore) Get(key AssignmentKey) (string, bool, error) {
+	return s.memory.Get(key)
+}
+
+// Put stores the variation, it's appended to the file in the background
+func (s *FileAssignmentStore) Put(key AssignmentKey, variation string) error {
+	if stored, ok, _ := s.memory.Get(key); ok && stored == variation {
+		return nil
+	}
+	line, err := json.Marshal(&assignmentRecord{AssignmentKey: key, Variation: variation})
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return errAssignmentStoreClosed
+	}
+	s.pending = append(append(s.pending, line...), '\n')
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	s.mux.Unlock()
+	return s.memory.Put(key, variation)
+}
+
+// Close writes the pending assignments and closes the file, Put fails after Close
+func (s *FileAssignmentStore) Close() error {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.wake)
+	s.mux.Unlock()
+
+	<-s.done
+	return s.file.Close()
+}
+
+func (s *FileAssignmentStore) writeLoop() {
+	defer close(s.done)
+	for range s.wake {
+		s.writePending()
+	}
+	// the lines put before Close
+	s.writePending()
+}
+
+// writePending writes all the pending lines at once, the failed lines are kept in memory only
+func (s *FileAssignmentStore) writePending() {
+	s.mux.Lock()
+	buf := s.pending
+	s.pending = nil
+	s.mux.Unlock()
+	if len(buf) == 0 {
+		return
+	}
+	if _, err := s.file.Write(buf); err != nil {
+		s.log.Warn("Cannot write assignment file, the assignments are kept in memory only",
+			"assignments", bytes.Count(buf, []byte{'\n'}), "error", err)
+	}
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAssignmentStore(t *testing.T) {
+	store := NewMemoryAssignmentStore()
+	key := AssignmentKey{Codename: "flag", EntityID: "1", EntityType: "User"}
+
+	_, ok, err := store.Get(key)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, store.Put(key, "a"))
+	assert.NoError(t, store.Put(key, "b"))
+	variation, ok, err := store.Get(key)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "b", variation)
+}
+
+func TestFileAssignmentStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flagger-assignments")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "assignments.jsonl")
+
+	first := AssignmentKey{Codename: "flag", EntityID: "1", EntityType: "User"}
+	second := AssignmentKey{Codename: "flag", EntityID: "2", EntityType: "User"}
+
+	store, err := NewFileAssignmentStore(path, log.Default())
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put(first, "a"))
+	assert.NoError(t, store.Put(second, "a"))
+	assert.NoError(t, store.Put(second, "b"))
+	assert.NoError(t, store.Close())
+	assert.Error(t, store.Put(first, "b"))
+
+	// the assignments survive restarts
+	store, err = NewFileAssignmentStore(path, log.Default())
+	assert.NoError(t, err)
+	defer store.Close()
+	variation, ok, err := store.Get(first)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "a", variation)
+	variation, _, _ = store.Get(second)
+	assert.Equal(t, "b", variation)
+
+	// the overwritten assignment is compacted on load
+	buf, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Len(t, strings.Split(strings.TrimSpace(string(buf)), "\n"), 2)
+
+	t.Run("corrupted lines are skipped", func(t *testing.T) {
+		var logBuf bytes.Buffer
+		l := logrus.New()
+		l.SetOutput(&logBuf)
+		l.SetFormatter(&logrus.JSONFormatter{})
+
+		path := filepath.Join(dir, "broken.jsonl")
+		assert.NoError(t, ioutil.WriteFile(path, []byte(`{"codename":"flag","entityId":"1","entityType":"User","variation":"a"}
+{broken
+{"codename":"flag","entityId":"2","entityType":"User","variation":"b"}
+`), 0600))
+		store, err := NewFileAssignmentStore(path, log.NewLogrusLogger(l))
+		assert.NoError(t, err)
+		defer store.Close()
+
+		variation, ok, _ := store.Get(first)
+		assert.True(t, ok)
+		assert.Equal(t, "a", variation)
+		variation, ok, _ = store.Get(second)
+		assert.True(t, ok)
+		assert.Equal(t, "b", variation)
+		assert.Contains(t, logBuf.String(), "Assignment file line is corrupted")
+
+		buf, err := ioutil.ReadFile(path)
+		assert.NoError(t, err)
+		assert.NotContains(t, string(buf), "broken")
+	})
+
+	t.Run("the file cannot be created", func(t *testing.T) {
+		_, err := NewFileAssignmentStore(filepath.Join(dir, "missing", "assignments.jsonl"), nil)
+		assert.Error(t, err)
+	})
+}
+
+func BenchmarkFileAssignmentStore_Put(b *testing.B) {
+	dir, err := ioutil.TempDir("", "flagger-assignments")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileAssignmentStore(filepath.Join(dir, "assignments.jsonl"), nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer store.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_ = store.Put(AssignmentKey{Codename: "flag", EntityID: strconv.Itoa(i), EntityType: "User"}, "on")
+	}
+}
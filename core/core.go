@@ -3,6 +3,7 @@ package core
 import (
 	"github.com/airdeploy/flagger-go/v3/log"
 	"sync"
+	"time"
 )
 
 // check implementation on compile time
@@ -14,20 +15,72 @@ var _ interface {
 
 // NewCore return the new instance Core
 func NewCore() *Core {
-	return &Core{}
+	return &Core{log: log.Default()}
 }
 
 // Core represent things for encapsulate business logic for flags calculation
 type Core struct {
 	configuration *Configuration
 	entity        *Entity
+	log           log.Logger
+	store         AssignmentStore
+	now           func() time.Time // nil means time.Now
+	location      *time.Location   // timezone of the virtual attributes, nil means UTC
+	sdkVersion    string
+	dropped       droppedNames // the dropped attributes and event properties already reported
 	mux           sync.Mutex
 }
 
+// SetLogger sets the logger used by Core
+func (core *Core) SetLogger(logger log.Logger) {
+	core.mux.Lock()
+	core.log = logger
+	core.mux.Unlock()
+}
+
+// SetAssignmentStore enables sticky assignments: the sampled entities keep the variation
+// stored in the store while it exists in the flag. nil disables them
+func (core *Core) SetAssignmentStore(store AssignmentStore) {
+	core.mux.Lock()
+	core.store = store
+	core.mux.Unlock()
+}
+
+// SetClock sets the time source used by the flag schedules and the virtual attributes,
+// see FlagConfig.ActiveFrom and VirtualNow. nil means time.Now
+func (core *Core) SetClock(now func() time.Time) {
+	core.mux.Lock()
+	core.now = now
+	core.mux.Unlock()
+}
+
+// SetTimezone sets the timezone of VirtualWeekday and VirtualHour attributes, nil means UTC
+func (core *Core) SetTimezone(location *time.Location) {
+	core.mux.Lock()
+	core.location = location
+	core.mux.Unlock()
+}
+
+// SetSDKVersion sets the value of VirtualSDKVersion attribute
+func (core *Core) SetSDKVersion(version string) {
+	core.mux.Lock()
+	core.sdkVersion = version
+	core.mux.Unlock()
+}
+
+func (core *Core) logger() log.Logger {
+	core.mux.Lock()
+	defer core.mux.Unlock()
+	if core.log == nil {
+		return log.Default()
+	}
+	return core.log
+}
+
 // SetConfig represent callback function for insert incoming configuration
 func (core *Core) SetConfig(v *Configuration) {
 	if v != nil {
-		v.Escape()
+		v.escape(core.logger())
 	}
 	core.mux.Lock()
 	core.configuration = v
@@ -48,14 +101,33 @@ func (core *Core) GetEntity() *Entity {
 	return core.entity
 }
 
+// EscapeEntity works like EscapeEntity, the dropped attributes are reported to the logger once per name
+func (core *Core) EscapeEntity(e *Entity) *Entity {
+	return escapeEntity(e, core.dropped.warner(core.logger()))
+}
+
+// EscapeEvent works like EscapeEvent, the dropped properties are reported to the logger once per name
+func (core *Core) EscapeEvent(event *Event) *Event {
+	return escapeEvent(event, core.dropped.warner(core.logger()))
+}
+
 // EvaluateFlag represent method for calculation Flag for Entity by codename
 func (core *Core) EvaluateFlag(codename string, entity *Entity) *FlagResult {
+	logger := core.logger()
 	core.mux.Lock()
 	configuration := core.configuration
+	ev := &evaluator{
+		log:        logger,
+		dropped:    core.dropped.warner(logger),
+		store:      core.store,
+		now:        core.now,
+		location:   core.location,
+		sdkVersion: core.sdkVersion,
+	}
 	core.mux.Unlock()
 
 	if codename == "" {
-		log.Warnf("Codename is empty, returning \"off\" variation for entity:  %+v", entity)
+		logger.Warn("Codename is empty, returning \"off\" variation", "entity", entity)
 		return &FlagResult{
 			Hashkey:   "",
 			Entity:    entity,
@@ -69,7 +141,7 @@ func (core *Core) EvaluateFlag(codename string, entity *Entity) *FlagResult {
 	}
 
 	if configuration == nil {
-		log.Warnf("Flagger is not initialized")
+		logger.Warn("Flagger is not initialized", "codename", codename)
 		return &FlagResult{
 			Hashkey:   "",
 			Entity:    entity,
@@ -114,7 +186,7 @@ func (core *Core) EvaluateFlag(codename string, entity *Entity) *FlagResult {
 	}
 
 	if entity.ID == "" {
-		log.Warnf("id is empty, returning \"off\" variation for codename \"%+v\" and entity %+v", codename, entity)
+		logger.Warn("Id is empty, returning \"off\" variation", "codename", codename, "entity", entity)
 		return &FlagResult{
 			Hashkey:   "",
 			Entity:    entity,
@@ -129,7 +201,26 @@ func (core *Core) EvaluateFlag(codename string, entity *Entity) *FlagResult {
 
 	for _, flagConfig := range configuration.Flags {
 		if flagConfig.Codename == codename {
-			return evaluateFlag(core.configuration.HashKey, flagConfig, entity) // success
+			holdout := configuration.Holdout != nil && configuration.Holdout.contains(entity)
+			if holdout && flagConfig.Experiment {
+				return &FlagResult{
+					Hashkey:   flagConfig.HashKey,
+					Entity:    entity,
+					Enabled:   false,
+					Sampled:   false,
+					Variation: DefaultVariation(),
+					Payload:   defaultPayload(),
+					IsNew:     false,
+					Reason:    InHoldout,
+					Holdout:   true,
+				}
+			}
+
+			ev.layers = configuration.Layers
+			ev.segments = configuration.segments
+			result := ev.evaluateFlag(configuration.HashKey, flagConfig, entity) // success
+			result.Holdout = holdout
+			return result
 		}
 	}
 
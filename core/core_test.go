@@ -6,6 +6,7 @@ import (
 	"log"
 	"strconv"
 	"testing"
+	"time"
 )
 
 func TestCore_EvaluateFlag(t *testing.T) {
@@ -257,6 +258,90 @@ func TestCore_EvaluateFlag(t *testing.T) {
 	})
 }
 
+func TestCore_SetClock(t *testing.T) {
+	core := NewCore()
+	core.SetConfig(&Configuration{
+		Flags: []*FlagConfig{{
+			Codename:           "launch",
+			HashKey:            "hashkey",
+			Variations:         []*FlagVariation{{Codename: "on", Probability: 1}},
+			FlagSubPopulations: []*FlagSubpopulation{{EntityType: "User", SamplingPercentage: 1}},
+			ActiveFrom:         "2021-03-01T00:00:00+09:00",
+		}},
+	})
+	entity := &Entity{ID: "1", Type: "User"}
+
+	now := time.Date(2021, 2, 28, 14, 0, 0, 0, time.UTC)
+	core.SetClock(func() time.Time { return now })
+	assert.Equal(t, FlagNotYetActive, core.EvaluateFlag("launch", entity).Reason)
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, IsSampled, core.EvaluateFlag("launch", entity).Reason)
+
+	// the real time is after the launch
+	core.SetClock(nil)
+	assert.Equal(t, IsSampled, core.EvaluateFlag("launch", entity).Reason)
+}
+
+func TestCore_EvaluateFlag_holdout(t *testing.T) {
+	core := NewCore()
+	core.SetConfig(&Configuration{
+		Holdout: &Holdout{HashKey: "holdout", Percentage: 0.2, EntityType: "User"},
+		Flags: []*FlagConfig{
+			{
+				Codename:           "experiment",
+				HashKey:            "hashkey1",
+				Experiment:         true,
+				Variations:         []*FlagVariation{{Codename: "on", Probability: 1}},
+				FlagSubPopulations: []*FlagSubpopulation{{EntityType: "User", SamplingPercentage: 1}},
+			},
+			{
+				Codename:           "rollout",
+				HashKey:            "hashkey2",
+				Variations:         []*FlagVariation{{Codename: "on", Probability: 1}},
+				FlagSubPopulations: []*FlagSubpopulation{{EntityType: "User", SamplingPercentage: 1}},
+			},
+		},
+	})
+
+	t.Run("the entities in the holdout get the default variation of the experiments", func(t *testing.T) {
+		heldOut := 0
+		for i := 0; i < 1000; i++ {
+			entity := &Entity{ID: strconv.Itoa(i), Type: "User"}
+			experiment := core.EvaluateFlag("experiment", entity)
+			rollout := core.EvaluateFlag("rollout", entity)
+
+			// the membership is reported for every flag
+			assert.Equal(t, experiment.Holdout, rollout.Holdout)
+			assert.True(t, rollout.Enabled)
+			if experiment.Holdout {
+				heldOut++
+				assert.Equal(t, InHoldout, experiment.Reason)
+				assert.False(t, experiment.Enabled)
+				assert.Equal(t, "off", experiment.Variation.Codename)
+			} else {
+				assert.True(t, experiment.Enabled)
+			}
+		}
+		assert.InDelta(t, 200, heldOut, 40)
+	})
+
+	t.Run("the group of holdout entity type is checked", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			id := strconv.Itoa(i)
+			user := core.EvaluateFlag("experiment", &Entity{ID: id, Type: "User"})
+			member := core.EvaluateFlag("experiment", &Entity{ID: "member", Type: "Member", Group: &Group{ID: id, Type: "User"}})
+			assert.Equal(t, user.Holdout, member.Holdout)
+		}
+	})
+
+	t.Run("other entity types are not in the holdout", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			assert.False(t, core.EvaluateFlag("experiment", &Entity{ID: strconv.Itoa(i), Type: "Company"}).Holdout)
+		}
+	})
+}
+
 func BenchmarkCore_EvaluateFlag(b *testing.B) {
 	core := Core{}
 	stringConfig := `
@@ -1,5 +1,12 @@
 package core
 
+import (
+	"strconv"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/log"
+)
+
 // FlagResult represent calculated flag result
 type FlagResult struct {
 	Hashkey   string
@@ -10,6 +17,7 @@ type FlagResult struct {
 	Payload   Payload
 	IsNew     bool
 	Reason    Reason
+	Holdout   bool // the entity is in Configuration.Holdout
 }
 
 // Reason represent type of flag reason
@@ -31,9 +39,21 @@ const (
 	// IDIsEmpty - entity id is empty
 	IDIsEmpty Reason = "Id is empty"
 
+	// ConfigIsStale - the configuration is older than the allowed max age, the default variation is used
+	ConfigIsStale Reason = "Configuration is stale"
+
 	// FlagNotInConfig flag is missing in configuration
 	FlagNotInConfig Reason = "Flag is not in the current config"
 
+	// InHoldout - Entity is in the holdout, the default variation of the experiment is used
+	InHoldout Reason = "Entity is in the holdout"
+
+	// FlagNotYetActive - the current time is before FlagConfig.ActiveFrom
+	FlagNotYetActive Reason = "Flag is not active yet"
+
+	// FlagExpired - the current time is after FlagConfig.ActiveUntil
+	FlagExpired Reason = "Flag is no longer active"
+
 	// KillSwitchEngaged - kill switch engaged
 	KillSwitchEngaged Reason = "Kill switch engaged"
 
@@ -52,9 +72,21 @@ const (
 	// IsSampled - Entity is sampled in the individual subpopulation
 	IsSampled Reason = "Entity is sampled in the individual subpopulation"
 
+	// IsSampledByIDFallback - Entity is sampled in the individual subpopulation by ID because it has no bucketBy attribute
+	IsSampledByIDFallback Reason = "Entity is sampled in the individual subpopulation by ID, bucketBy attribute is missing"
+
+	// StickyAssignment - Entity is sampled and keeps the variation stored in AssignmentStore
+	StickyAssignment Reason = "Entity keeps the previously assigned variation"
+
+	// NotInLayer - Entity and its group are out of the layer slots of the flag
+	NotInLayer Reason = "Entity is out of the layer slots of the flag"
+
 	// IsSampledByGroup - Entity is sampled in the group subpopulation
 	IsSampledByGroup Reason = "Entity is sampled in the group subpopulation"
 
+	// NoVariationChosen - Entity is sampled but the variation weights don't cover its bucket, e.g. all of them are zero
+	NoVariationChosen Reason = "Entity is sampled but no variation is chosen"
+
 	// Default - Default (off) treatment reached
 	Default Reason = "Default (off) treatment reached"
 )
@@ -72,7 +104,30 @@ func DefaultVariation() *FlagVariation {
 	}
 }
 
-func evaluateFlag(confHashKey string, flagConfig *FlagConfig, entity *Entity) *FlagResult {
+// evaluator holds dependencies of the flag evaluation
+type evaluator struct {
+	log     log.Logger
+	dropped dropFunc         // reports the dropped attributes, optional
+	store   AssignmentStore  // optional
+	layers  []*Layer         // layers of the configuration
+	now     func() time.Time // nil means time.Now
+
+	// used by virtual attributes
+	location   *time.Location // nil means UTC
+	sdkVersion string
+
+	segments       map[string]*Segment // segments of the configuration by name
+	segmentMatches map[segmentKey]bool // memoized segment membership
+}
+
+func (ev *evaluator) clock() time.Time {
+	if ev.now == nil {
+		return time.Now()
+	}
+	return ev.now()
+}
+
+func (ev *evaluator) evaluateFlag(confHashKey string, flagConfig *FlagConfig, entity *Entity) *FlagResult {
 
 	// kill switch
 	if flagConfig.KillSwitchEngaged {
@@ -88,9 +143,54 @@ func evaluateFlag(confHashKey string, flagConfig *FlagConfig, entity *Entity) *F
 		}
 	}
 
+	// schedule
+	if reason := ev.checkSchedule(flagConfig); reason != "" {
+		return &FlagResult{
+			Hashkey:   flagConfig.HashKey,
+			Entity:    entity,
+			Enabled:   false,
+			Sampled:   false,
+			Variation: DefaultVariation(),
+			Payload:   defaultPayload(),
+			IsNew:     false,
+			Reason:    reason,
+		}
+	}
+
 	// individual blacklist
-	for _, v := range flagConfig.Blacklist {
-		if v.equals(entity) {
+	if flagConfig.blacklisted(entity.ID, entity.Type) != nil {
+		return &FlagResult{
+			Hashkey:   flagConfig.HashKey,
+			Entity:    entity,
+			Enabled:   false,
+			Sampled:   false,
+			Variation: DefaultVariation(),
+			Payload:   defaultPayload(),
+			IsNew:     false,
+			Reason:    IndividualBlacklist,
+		}
+	}
+
+	// individual whitelist
+	if v := flagConfig.whitelisted(entity.ID, entity.Type); v != nil {
+		variation := extractVariation(flagConfig, v.Variation)
+		return &FlagResult{
+			Hashkey:   flagConfig.HashKey,
+			Entity:    entity,
+			Enabled:   true,
+			Sampled:   false,
+			Variation: variation,
+			Payload:   variation.Payload,
+			IsNew:     false,
+			Reason:    IndividualWhitelist,
+		}
+	}
+
+	// if entity belong to a group
+	if group := entity.Group; group != nil {
+
+		// group blacklist
+		if flagConfig.blacklisted(group.ID, group.Type) != nil {
 			return &FlagResult{
 				Hashkey:   flagConfig.HashKey,
 				Entity:    entity,
@@ -99,14 +199,12 @@ func evaluateFlag(confHashKey string, flagConfig *FlagConfig, entity *Entity) *F
 				Variation: DefaultVariation(),
 				Payload:   defaultPayload(),
 				IsNew:     false,
-				Reason:    IndividualBlacklist,
+				Reason:    GroupBlacklist,
 			}
 		}
-	}
 
-	// individual whitelist
-	for _, v := range flagConfig.Whitelist {
-		if v.equals(entity) {
+		// group whitelist
+		if v := flagConfig.whitelisted(group.ID, group.Type); v != nil {
 			variation := extractVariation(flagConfig, v.Variation)
 			return &FlagResult{
 				Hashkey:   flagConfig.HashKey,
@@ -116,54 +214,43 @@ func evaluateFlag(confHashKey string, flagConfig *FlagConfig, entity *Entity) *F
 				Variation: variation,
 				Payload:   variation.Payload,
 				IsNew:     false,
-				Reason:    IndividualWhitelist,
+				Reason:    GroupWhitelist,
 			}
 		}
 	}
 
-	// if entity belong to a group
-	if group := entity.Group; group != nil {
+	// layer membership is checked before the sampling, the entity out of the flag slots is never sampled
+	inLayer := ev.inLayer(confHashKey, flagConfig, entity)
+	groupInLayer := entity.Group != nil && ev.inLayer(confHashKey, flagConfig, entity.Group.entity())
 
-		// group blacklist
-		for _, v := range flagConfig.Blacklist {
-			if v.equalsGroup(group) {
-				return &FlagResult{
-					Hashkey:   flagConfig.HashKey,
-					Entity:    entity,
-					Enabled:   false,
-					Sampled:   false,
-					Variation: DefaultVariation(),
-					Payload:   defaultPayload(),
-					IsNew:     false,
-					Reason:    GroupBlacklist,
-				}
+	// individual sampling
+	var sp *FlagSubpopulation
+	var bucketID string
+	var fallback bool
+	if inLayer {
+		sp, bucketID, fallback = ev.sampleEntity(confHashKey, flagConfig, entity)
+	}
+	if sp != nil {
+		variation, sticky := ev.assignVariation(flagConfig, bucketID, entity.Type)
+		if variation == nil {
+			return &FlagResult{
+				Hashkey:   flagConfig.HashKey,
+				Entity:    entity,
+				Enabled:   true,
+				Sampled:   true,
+				Variation: DefaultVariation(),
+				Payload:   defaultPayload(),
+				IsNew:     false,
+				Reason:    NoVariationChosen,
 			}
 		}
-
-		// group whitelist
-		for _, v := range flagConfig.Whitelist {
-			if v.equalsGroup(group) {
-				variation := extractVariation(flagConfig, v.Variation)
-				return &FlagResult{
-					Hashkey:   flagConfig.HashKey,
-					Entity:    entity,
-					Enabled:   true,
-					Sampled:   false,
-					Variation: variation,
-					Payload:   variation.Payload,
-					IsNew:     false,
-					Reason:    GroupWhitelist,
-				}
-			}
+		reason := IsSampled
+		switch {
+		case sticky:
+			reason = StickyAssignment
+		case fallback:
+			reason = IsSampledByIDFallback
 		}
-	}
-
-	// individual sampling
-	hash := samplingHash(confHashKey, flagConfig.HashKey, entity.ID, entity.Type)
-	sp := sampleSubpopulation(hash, flagConfig.FlagSubPopulations, entity.Type, entity.Attributes)
-	if sp != nil {
-		hash := variationHash(flagConfig.Codename, entity.ID, entity.Type)
-		variation := chooseVariation(hash, flagConfig.Variations)
 		return &FlagResult{
 			Hashkey:   flagConfig.HashKey,
 			Entity:    entity,
@@ -172,17 +259,32 @@ func evaluateFlag(confHashKey string, flagConfig *FlagConfig, entity *Entity) *F
 			Variation: variation,
 			Payload:   variation.Payload,
 			IsNew:     false,
-			Reason:    IsSampled,
+			Reason:    reason,
 		}
 	}
 
 	// group sampling
-	if group := entity.Group; group != nil {
+	if group := entity.Group; group != nil && groupInLayer {
 		hash := samplingHash(confHashKey, flagConfig.HashKey, group.ID, group.Type)
-		sp := sampleSubpopulation(hash, flagConfig.FlagSubPopulations, group.Type, group.Attributes)
+		sp := ev.sampleSubpopulation(hash, flagConfig.FlagSubPopulations, group.entity())
 		if sp != nil {
-			hash := variationHash(flagConfig.Codename, group.ID, group.Type)
-			variation := chooseVariation(hash, flagConfig.Variations)
+			variation, sticky := ev.assignVariation(flagConfig, group.ID, group.Type)
+			if variation == nil {
+				return &FlagResult{
+					Hashkey:   flagConfig.HashKey,
+					Entity:    entity,
+					Enabled:   true,
+					Sampled:   true,
+					Variation: DefaultVariation(),
+					Payload:   defaultPayload(),
+					IsNew:     false,
+					Reason:    NoVariationChosen,
+				}
+			}
+			reason := IsSampledByGroup
+			if sticky {
+				reason = StickyAssignment
+			}
 			return &FlagResult{
 				Hashkey:   flagConfig.HashKey,
 				Entity:    entity,
@@ -191,12 +293,16 @@ func evaluateFlag(confHashKey string, flagConfig *FlagConfig, entity *Entity) *F
 				Variation: variation,
 				Payload:   variation.Payload,
 				IsNew:     false,
-				Reason:    IsSampledByGroup,
+				Reason:    reason,
 			}
 		}
 	}
 
 	// default
+	reason := Default
+	if !inLayer && !groupInLayer {
+		reason = NotInLayer
+	}
 	return &FlagResult{
 		Hashkey:   flagConfig.HashKey,
 		Entity:    entity,
@@ -205,10 +311,89 @@ func evaluateFlag(confHashKey string, flagConfig *FlagConfig, entity *Entity) *F
 		Variation: DefaultVariation(),
 		Payload:   defaultPayload(),
 		IsNew:     false,
-		Reason:    Default,
+		Reason:    reason,
 	}
 }
 
+// checkSchedule returns FlagNotYetActive or FlagExpired if the current time is out of the flag window, empty otherwise
+func (ev *evaluator) checkSchedule(flagConfig *FlagConfig) Reason {
+	if flagConfig.activeFrom.IsZero() && flagConfig.activeUntil.IsZero() {
+		return ""
+	}
+	now := ev.clock()
+	switch {
+	case !flagConfig.activeFrom.IsZero() && now.Before(flagConfig.activeFrom):
+		return FlagNotYetActive
+	case !flagConfig.activeUntil.IsZero() && !now.Before(flagConfig.activeUntil):
+		return FlagExpired
+	}
+	return ""
+}
+
+// inLayer reports whether the entity slot in the flag layer is within the flag slots, always true for the flag without layer.
+// The flag is never sampled if its layer is missing
+func (ev *evaluator) inLayer(confHashKey string, flagConfig *FlagConfig, entity *Entity) bool {
+	slots := flagConfig.Layer
+	if slots == nil {
+		return true
+	}
+	for _, layer := range ev.layers {
+		if layer.Name == slots.Layer {
+			slot := layerSlot(confHashKey, layer, entity)
+			return slot >= slots.From && slot < slots.To
+		}
+	}
+	return false
+}
+
+// layerSlot returns the slot of the entity in the layer, in range [0, layer.Slots)
+func layerSlot(envKey string, layer *Layer, entity *Entity) int {
+	if layer.Slots <= 0 {
+		return -1
+	}
+	id, _ := bucketingID(layer.BucketBy, entity)
+	// never change this key!!!
+	key := envKey + layer.Name + id + entity.Type
+	slot := int(HashMD5(key) * float64(layer.Slots))
+	if slot == layer.Slots {
+		// the hash is 1
+		slot--
+	}
+	return slot
+}
+
+// assignVariation returns the variation stored in AssignmentStore if it still exists in the flag,
+// otherwise chooses the variation by the hash and stores it. sticky is true if the stored variation is returned,
+// the variation is nil if no variation is chosen
+func (ev *evaluator) assignVariation(flagConfig *FlagConfig, id, Type string) (variation *FlagVariation, sticky bool) {
+	if ev.store == nil {
+		return flagConfig.variationFor(variationHash(flagConfig.Codename, id, Type)), false
+	}
+
+	key := AssignmentKey{Codename: flagConfig.Codename, EntityID: id, EntityType: Type}
+	codename, ok, err := ev.store.Get(key)
+	if err != nil {
+		ev.log.Warn("Cannot get the assignment from the store", "codename", flagConfig.Codename, "error", err)
+	}
+	if ok {
+		for _, v := range flagConfig.Variations {
+			if v.Codename == codename {
+				return v, true
+			}
+		}
+	}
+
+	// no assignment or the stored variation is removed from the flag
+	variation = flagConfig.variationFor(variationHash(flagConfig.Codename, id, Type))
+	if variation == nil {
+		return nil, false
+	}
+	if err := ev.store.Put(key, variation.Codename); err != nil {
+		ev.log.Warn("Cannot put the assignment to the store", "codename", flagConfig.Codename, "error", err)
+	}
+	return variation, false
+}
+
 func extractVariation(flagConfig *FlagConfig, codename string) *FlagVariation {
 	for _, v := range flagConfig.Variations {
 		if v.Codename == codename {
@@ -218,15 +403,73 @@ func extractVariation(flagConfig *FlagConfig, codename string) *FlagVariation {
 	return DefaultVariation()
 }
 
+// sampleEntity returns the first subpopulation the entity is sampled in, the hashed ID and
+// whether the ID is used because the entity has no bucketBy attribute of the subpopulation
+func (ev *evaluator) sampleEntity(confHashKey string, flagConfig *FlagConfig, entity *Entity) (*FlagSubpopulation, string, bool) {
+	for _, sp := range flagConfig.FlagSubPopulations {
+		bucketBy := sp.BucketBy
+		if bucketBy == "" {
+			bucketBy = flagConfig.BucketBy
+		}
+		bucketID, fallback := bucketingID(bucketBy, entity)
+		hash := samplingHash(confHashKey, flagConfig.HashKey, bucketID, entity.Type)
+		if ev.sampleSubpopulation(hash, []*FlagSubpopulation{sp}, entity) != nil {
+			return sp, bucketID, fallback
+		}
+	}
+	return nil, "", false
+}
+
+// bucketingID returns the value of bucketBy attribute of the entity, the entity ID if bucketBy is empty.
+// Only string and number attributes are used, fallback is true if the entity has no such attribute
+func bucketingID(bucketBy string, entity *Entity) (id string, fallback bool) {
+	if bucketBy == "" {
+		return entity.ID, false
+	}
+	switch v := entity.Attributes[bucketBy].(type) {
+	case string:
+		if v != "" {
+			return v, false
+		}
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), false
+	}
+	return entity.ID, true
+}
+
 func variationHash(codename, id, Type string) float64 {
 	// never change this key!!!
 	key := codename + id + Type
 	return HashMD5(key)
 }
 
-func chooseVariation(hash float64, variations []*FlagVariation) *FlagVariation {
+// variationFor returns the variation by the weight buckets, nil if the hash is in the unassigned buckets,
+// or by the probability bounds which cover all the hashes.
+// The flag which is not escaped has neither, its variation is chosen by the probabilities
+// and the default variation is returned if the hash is out of them
+func (fc *FlagConfig) variationFor(hash float64) *FlagVariation {
+	switch {
+	case fc.buckets != nil:
+		bucket := int(hash * basisPoints)
+		if bucket >= basisPoints {
+			bucket = basisPoints - 1
+		}
+		for i, upper := range fc.buckets {
+			if bucket < upper {
+				return fc.Variations[i]
+			}
+		}
+		return nil
+	case fc.bounds != nil:
+		for i, upper := range fc.bounds {
+			if fc.Variations[i].Probability > 0 && hash <= upper {
+				return fc.Variations[i]
+			}
+		}
+		return nil
+	}
 	cumulativeSum := 0.0
-	for _, v := range variations {
+	for _, v := range fc.Variations {
 		cumulativeSum += v.Probability
 		if hash <= cumulativeSum {
 			return v
@@ -241,9 +484,9 @@ func samplingHash(envKey, hashKey, id, Type string) float64 {
 	return HashMD5(key)
 }
 
-func sampleSubpopulation(hash float64, subpopulations []*FlagSubpopulation, Type string, attr Attributes) *FlagSubpopulation {
+func (ev *evaluator) sampleSubpopulation(hash float64, subpopulations []*FlagSubpopulation, entity *Entity) *FlagSubpopulation {
 	for _, v := range subpopulations {
-		if v.EntityType == Type && hash < v.SamplingPercentage && matchByFilters(v.Filters, attr) {
+		if v.EntityType == entity.Type && hash < v.SamplingPercentage && ev.matchEntity(v.Filters, entity) {
 			return v
 		}
 	}
@@ -1,10 +1,22 @@
 package core
 
 import (
+	"bytes"
+	"errors"
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"reflect"
+	"strconv"
 	"testing"
+	"testing/quick"
+	"time"
 )
 
+var testEvaluator = &evaluator{log: log.Default()}
+
 func Test_evaluateFlag(t *testing.T) {
 	t.Run("kill switch", func(t *testing.T) {
 		assert.Equal(t,
@@ -17,7 +29,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   defaultPayload(),
 				Reason:    KillSwitchEngaged,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"",
 				&FlagConfig{
 					HashKey:           "hashkey",
@@ -37,7 +49,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   defaultPayload(),
 				Reason:    IndividualBlacklist,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"",
 				&FlagConfig{
 					HashKey:           "hashkey",
@@ -60,7 +72,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   Payload{"payload": 1},
 				Reason:    IndividualWhitelist,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"",
 				&FlagConfig{
 					HashKey:           "hashkey",
@@ -94,7 +106,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   defaultPayload(),
 				Reason:    GroupBlacklist,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"",
 				&FlagConfig{
 					HashKey:           "hashkey",
@@ -122,7 +134,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   Payload{"payload": 2},
 				Reason:    GroupWhitelist,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"",
 				&FlagConfig{
 					HashKey:           "hashkey",
@@ -163,7 +175,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   defaultPayload(),
 				Reason:    IndividualWhitelist,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"",
 				&FlagConfig{
 					HashKey:           "hashkey",
@@ -188,7 +200,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   defaultPayload(),
 				Reason:    IndividualBlacklist,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"",
 				&FlagConfig{
 					HashKey:           "hashkey",
@@ -221,7 +233,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   Payload{"payload": 1},
 				Reason:    IsSampled,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"envKey",
 				&FlagConfig{
 					Codename:          "color",
@@ -278,7 +290,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   defaultPayload(),
 				Reason:    IsSampledByGroup,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"envKey3",
 				&FlagConfig{
 					Codename:          "btc",
@@ -320,7 +332,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload: defaultPayload(),
 				Reason:  IsSampledByGroup,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"1",
 				&FlagConfig{
 					Codename:          "org-chart",
@@ -368,7 +380,7 @@ func Test_evaluateFlag(t *testing.T) {
 				Payload:   defaultPayload(),
 				Reason:    Default,
 			},
-			evaluateFlag(
+			testEvaluator.evaluateFlag(
 				"envKey5",
 				&FlagConfig{
 					Codename:          "ETH",
@@ -407,6 +419,334 @@ func Test_evaluateFlag(t *testing.T) {
 	})
 }
 
+func Test_evaluateFlag_bucketBy(t *testing.T) {
+	flagConfig := &FlagConfig{
+		Codename: "checkout",
+		HashKey:  "hashkey",
+		BucketBy: "deviceid",
+		Variations: []*FlagVariation{
+			{Codename: "a", Probability: 0.5, Payload: Payload{}},
+			{Codename: "b", Probability: 0.5, Payload: Payload{}},
+		},
+		FlagSubPopulations: []*FlagSubpopulation{
+			{EntityType: "User", SamplingPercentage: 0.5},
+		},
+	}
+
+	t.Run("the attribute is hashed instead of ID", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			device := strconv.Itoa(i)
+			anonymous := testEvaluator.evaluateFlag("env", flagConfig,
+				&Entity{ID: "cookie-" + device, Type: "User", Attributes: Attributes{"deviceid": device}})
+			loggedIn := testEvaluator.evaluateFlag("env", flagConfig,
+				&Entity{ID: "user-" + device, Type: "User", Attributes: Attributes{"deviceid": device}})
+			assert.Equal(t, anonymous.Sampled, loggedIn.Sampled)
+			assert.Equal(t, anonymous.Variation.Codename, loggedIn.Variation.Codename)
+			if loggedIn.Sampled {
+				assert.Equal(t, IsSampled, loggedIn.Reason)
+			}
+		}
+	})
+
+	t.Run("the attribute of the subpopulation overrides the flag one", func(t *testing.T) {
+		flagConfig := *flagConfig
+		flagConfig.FlagSubPopulations = []*FlagSubpopulation{
+			{EntityType: "User", SamplingPercentage: 0.5, BucketBy: "accountid"},
+		}
+		for i := 0; i < 100; i++ {
+			account := strconv.Itoa(i)
+			first := testEvaluator.evaluateFlag("env", &flagConfig, &Entity{ID: "user-1", Type: "User",
+				Attributes: Attributes{"accountid": account, "deviceid": "first"}})
+			second := testEvaluator.evaluateFlag("env", &flagConfig, &Entity{ID: "user-2", Type: "User",
+				Attributes: Attributes{"accountid": account, "deviceid": "second"}})
+			assert.Equal(t, first.Sampled, second.Sampled)
+			assert.Equal(t, first.Variation.Codename, second.Variation.Codename)
+		}
+	})
+
+	t.Run("ID is used if the entity has no attribute", func(t *testing.T) {
+		flagConfig := *flagConfig
+		flagConfig.FlagSubPopulations = []*FlagSubpopulation{{EntityType: "User", SamplingPercentage: 1}}
+		withoutBucketBy := flagConfig
+		withoutBucketBy.BucketBy = ""
+
+		for i := 0; i < 100; i++ {
+			entity := &Entity{ID: strconv.Itoa(i), Type: "User"}
+			expected := testEvaluator.evaluateFlag("env", &withoutBucketBy, entity)
+			assert.Equal(t, IsSampled, expected.Reason)
+
+			actual := testEvaluator.evaluateFlag("env", &flagConfig, entity)
+			assert.Equal(t, IsSampledByIDFallback, actual.Reason)
+			assert.Equal(t, expected.Variation, actual.Variation)
+		}
+	})
+}
+
+func Test_evaluateFlag_assignmentStore(t *testing.T) {
+	flagConfig := func(probabilityOfA float64) *FlagConfig {
+		return &FlagConfig{
+			Codename: "checkout",
+			HashKey:  "hashkey",
+			Variations: []*FlagVariation{
+				{Codename: "a", Probability: probabilityOfA, Payload: Payload{}},
+				{Codename: "b", Probability: 1 - probabilityOfA, Payload: Payload{}},
+			},
+			FlagSubPopulations: []*FlagSubpopulation{
+				{EntityType: "User", SamplingPercentage: 1},
+				{EntityType: "Company", SamplingPercentage: 1},
+			},
+		}
+	}
+
+	t.Run("the entities keep the variations when the probabilities are changed", func(t *testing.T) {
+		ev := &evaluator{log: log.Default(), store: NewMemoryAssignmentStore()}
+		assigned := make(map[string]string)
+		for i := 0; i < 100; i++ {
+			entity := &Entity{ID: strconv.Itoa(i), Type: "User"}
+			result := ev.evaluateFlag("env", flagConfig(0.5), entity)
+			assert.Equal(t, IsSampled, result.Reason)
+			assigned[entity.ID] = result.Variation.Codename
+		}
+
+		for i := 0; i < 100; i++ {
+			entity := &Entity{ID: strconv.Itoa(i), Type: "User"}
+			result := ev.evaluateFlag("env", flagConfig(0.1), entity)
+			assert.Equal(t, StickyAssignment, result.Reason)
+			assert.Equal(t, assigned[entity.ID], result.Variation.Codename)
+		}
+
+		// without the store the entities are reshuffled
+		moved := 0
+		for i := 0; i < 100; i++ {
+			result := testEvaluator.evaluateFlag("env", flagConfig(0.1), &Entity{ID: strconv.Itoa(i), Type: "User"})
+			if result.Variation.Codename != assigned[strconv.Itoa(i)] {
+				moved++
+			}
+		}
+		assert.NotZero(t, moved)
+	})
+
+	t.Run("the variation is reassigned if the stored one is removed", func(t *testing.T) {
+		store := NewMemoryAssignmentStore()
+		ev := &evaluator{log: log.Default(), store: store}
+		key := AssignmentKey{Codename: "checkout", EntityID: "1", EntityType: "User"}
+		assert.NoError(t, store.Put(key, "removed"))
+
+		result := ev.evaluateFlag("env", flagConfig(1), &Entity{ID: "1", Type: "User"})
+		assert.Equal(t, IsSampled, result.Reason)
+		assert.Equal(t, "a", result.Variation.Codename)
+		variation, _, _ := store.Get(key)
+		assert.Equal(t, "a", variation)
+	})
+
+	t.Run("group assignments are keyed by the group", func(t *testing.T) {
+		store := NewMemoryAssignmentStore()
+		ev := &evaluator{log: log.Default(), store: store}
+		entity := &Entity{ID: "1", Type: "Visitor", Group: &Group{ID: "42", Type: "Company"}}
+
+		assert.Equal(t, IsSampledByGroup, ev.evaluateFlag("env", flagConfig(1), entity).Reason)
+		_, ok, _ := store.Get(AssignmentKey{Codename: "checkout", EntityID: "42", EntityType: "Company"})
+		assert.True(t, ok)
+
+		result := ev.evaluateFlag("env", flagConfig(0), entity)
+		assert.Equal(t, StickyAssignment, result.Reason)
+		assert.Equal(t, "a", result.Variation.Codename)
+	})
+
+	t.Run("store errors fall back to the hash", func(t *testing.T) {
+		ev := &evaluator{log: log.Default(), store: failingStore{}}
+		result := ev.evaluateFlag("env", flagConfig(1), &Entity{ID: "1", Type: "User"})
+		assert.Equal(t, IsSampled, result.Reason)
+		assert.Equal(t, "a", result.Variation.Codename)
+	})
+}
+
+type failingStore struct{}
+
+func (failingStore) Get(key AssignmentKey) (string, bool, error) {
+	return "", false, errors.New("store is down")
+}
+
+func (failingStore) Put(key AssignmentKey, variation string) error {
+	return errors.New("store is down")
+}
+
+func Test_evaluateFlag_layers(t *testing.T) {
+	layerFlag := func(codename string, from, to int) *FlagConfig {
+		return &FlagConfig{
+			Codename:   codename,
+			HashKey:    codename,
+			Variations: []*FlagVariation{{Codename: "on", Probability: 1, Payload: Payload{}}},
+			FlagSubPopulations: []*FlagSubpopulation{
+				{EntityType: "User", SamplingPercentage: 1},
+				{EntityType: "Company", SamplingPercentage: 1},
+			},
+			Layer: &LayerSlots{Layer: "checkout", From: from, To: to},
+		}
+	}
+	flags := []*FlagConfig{layerFlag("first", 0, 30), layerFlag("second", 30, 60), layerFlag("third", 60, 100)}
+	ev := &evaluator{log: log.Default(), layers: []*Layer{{Name: "checkout", Slots: 100}}}
+
+	t.Run("the entity is sampled in exactly one flag of the layer", func(t *testing.T) {
+		counts := make(map[string]int)
+		for i := 0; i < 1000; i++ {
+			entity := &Entity{ID: strconv.Itoa(i), Type: "User"}
+			var sampled []string
+			for _, flag := range flags {
+				result := ev.evaluateFlag("env", flag, entity)
+				if result.Sampled {
+					sampled = append(sampled, flag.Codename)
+				} else {
+					assert.Equal(t, NotInLayer, result.Reason)
+				}
+			}
+			if assert.Len(t, sampled, 1, entity.ID) {
+				counts[sampled[0]]++
+			}
+		}
+		// the slots are split roughly proportionally
+		assert.InDelta(t, 300, counts["first"], 60)
+		assert.InDelta(t, 300, counts["second"], 60)
+		assert.InDelta(t, 400, counts["third"], 60)
+	})
+
+	t.Run("groups are checked by the group slot", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			entity := &Entity{ID: "visitor", Type: "Visitor", Group: &Group{ID: strconv.Itoa(i), Type: "Company"}}
+			sampled := 0
+			for _, flag := range flags {
+				if ev.evaluateFlag("env", flag, entity).Sampled {
+					sampled++
+				}
+			}
+			assert.Equal(t, 1, sampled)
+		}
+	})
+
+	t.Run("the layer bucketBy attribute is hashed", func(t *testing.T) {
+		ev := &evaluator{log: log.Default(), layers: []*Layer{{Name: "checkout", Slots: 100, BucketBy: "deviceid"}}}
+		for i := 0; i < 100; i++ {
+			device := strconv.Itoa(i)
+			for _, flag := range flags {
+				anonymous := ev.evaluateFlag("env", flag, &Entity{ID: "cookie", Type: "User", Attributes: Attributes{"deviceid": device}})
+				loggedIn := ev.evaluateFlag("env", flag, &Entity{ID: "user", Type: "User", Attributes: Attributes{"deviceid": device}})
+				assert.Equal(t, anonymous.Sampled, loggedIn.Sampled)
+			}
+		}
+	})
+
+	t.Run("the flag is never sampled if the layer is missing", func(t *testing.T) {
+		ev := &evaluator{log: log.Default()}
+		for i := 0; i < 100; i++ {
+			result := ev.evaluateFlag("env", flags[0], &Entity{ID: strconv.Itoa(i), Type: "User"})
+			assert.False(t, result.Sampled)
+			assert.Equal(t, NotInLayer, result.Reason)
+		}
+	})
+
+	t.Run("whitelist takes precedence over the layer", func(t *testing.T) {
+		flag := layerFlag("whitelisted", 0, 0)
+		flag.Whitelist = []*Entity{{ID: "1", Type: "User", Variation: "on"}}
+		assert.Equal(t, IndividualWhitelist, ev.evaluateFlag("env", flag, &Entity{ID: "1", Type: "User"}).Reason)
+	})
+}
+
+func Test_evaluateFlag_schedule(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	newYork := time.FixedZone("EST", -5*60*60)
+	newFlag := func(activeFrom, activeUntil string) *FlagConfig {
+		flagConfig := &FlagConfig{
+			Codename:           "launch",
+			HashKey:            "hashkey",
+			Variations:         []*FlagVariation{{Codename: "on", Probability: 1, Payload: Payload{}}},
+			FlagSubPopulations: []*FlagSubpopulation{{EntityType: "User", SamplingPercentage: 1}},
+			ActiveFrom:         activeFrom,
+			ActiveUntil:        activeUntil,
+		}
+		flagConfig.escape(log.Default())
+		return flagConfig
+	}
+	evaluate := func(flagConfig *FlagConfig, now time.Time) *FlagResult {
+		ev := &evaluator{log: log.Default(), now: func() time.Time { return now }}
+		return ev.evaluateFlag("env", flagConfig, &Entity{ID: "1", Type: "User"})
+	}
+
+	// midnight in Tokyo is 15:00 UTC of the previous day and 10:00 in New York
+	flagConfig := newFlag("2021-03-01T00:00:00+09:00", "2021-03-02T00:00:00+09:00")
+	midnight := time.Date(2021, 3, 1, 0, 0, 0, 0, tokyo)
+
+	for _, test := range []struct {
+		name   string
+		now    time.Time
+		reason Reason
+	}{
+		{"a second before in Tokyo", midnight.Add(-time.Second), FlagNotYetActive},
+		{"a second before in UTC", time.Date(2021, 2, 28, 14, 59, 59, 0, time.UTC), FlagNotYetActive},
+		{"midnight in Tokyo", midnight, IsSampled},
+		{"the same instant in UTC", time.Date(2021, 2, 28, 15, 0, 0, 0, time.UTC), IsSampled},
+		{"the same instant in New York", time.Date(2021, 2, 28, 10, 0, 0, 0, newYork), IsSampled},
+		{"midnight in UTC is within the window", time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC), IsSampled},
+		{"a nanosecond before the end", midnight.Add(24*time.Hour - 1), IsSampled},
+		{"the end is exclusive", midnight.Add(24 * time.Hour), FlagExpired},
+		{"the end in New York", time.Date(2021, 3, 1, 10, 0, 0, 0, newYork), FlagExpired},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			result := evaluate(flagConfig, test.now)
+			assert.Equal(t, test.reason, result.Reason)
+			assert.Equal(t, test.reason == IsSampled, result.Enabled)
+		})
+	}
+
+	t.Run("open windows", func(t *testing.T) {
+		assert.Equal(t, IsSampled, evaluate(newFlag("2021-03-01T00:00:00Z", ""), time.Date(3000, 1, 1, 0, 0, 0, 0, time.UTC)).Reason)
+		assert.Equal(t, IsSampled, evaluate(newFlag("", "2021-03-01T00:00:00Z"), time.Date(1000, 1, 1, 0, 0, 0, 0, time.UTC)).Reason)
+		assert.Equal(t, IsSampled, evaluate(newFlag("", ""), midnight).Reason)
+	})
+
+	t.Run("kill switch takes precedence", func(t *testing.T) {
+		flagConfig := newFlag("2021-03-01T00:00:00Z", "")
+		flagConfig.KillSwitchEngaged = true
+		assert.Equal(t, KillSwitchEngaged, evaluate(flagConfig, midnight.Add(-time.Hour)).Reason)
+	})
+
+	t.Run("invalid schedule disables the flag", func(t *testing.T) {
+		assert.Equal(t, FlagNotYetActive, evaluate(newFlag("2021-03-01 00:00", ""), midnight).Reason)
+		assert.Equal(t, FlagExpired, evaluate(newFlag("", "tomorrow"), midnight).Reason)
+	})
+}
+
+func Test_layerSlot(t *testing.T) {
+	layer := &Layer{Name: "checkout", Slots: 10}
+	for i := 0; i < 1000; i++ {
+		slot := layerSlot("env", layer, &Entity{ID: strconv.Itoa(i), Type: "User"})
+		assert.True(t, slot >= 0 && slot < 10, slot)
+	}
+	// deterministic
+	assert.Equal(t, layerSlot("env", layer, &Entity{ID: "1", Type: "User"}), layerSlot("env", layer, &Entity{ID: "1", Type: "User"}))
+	assert.Equal(t, -1, layerSlot("env", &Layer{Name: "empty"}, &Entity{ID: "1", Type: "User"}))
+}
+
+func Test_bucketingID(t *testing.T) {
+	for _, test := range []struct {
+		bucketBy   string
+		attributes Attributes
+		id         string
+		fallback   bool
+	}{
+		{"", Attributes{"deviceid": "d"}, "1", false},
+		{"deviceid", Attributes{"deviceid": "d"}, "d", false},
+		{"deviceid", Attributes{"deviceid": 42.0}, "42", false},
+		{"deviceid", Attributes{"deviceid": 0.5}, "0.5", false},
+		{"deviceid", nil, "1", true},
+		{"deviceid", Attributes{"deviceid": ""}, "1", true},
+		{"deviceid", Attributes{"deviceid": true}, "1", true},
+	} {
+		id, fallback := bucketingID(test.bucketBy, &Entity{ID: "1", Attributes: test.attributes})
+		assert.Equal(t, test.id, id, test)
+		assert.Equal(t, test.fallback, fallback, test)
+	}
+}
+
 func Test_extractVariation(t *testing.T) {
 	// positive
 	assert.Equal(t,
@@ -439,58 +779,6 @@ func Test_extractVariation(t *testing.T) {
 			"codename7"))
 }
 
-func Test_chooseVariation(t *testing.T) {
-	// empty variations
-	assert.Equal(t,
-		DefaultVariation(),
-		chooseVariation(
-			0.3,
-			[]*FlagVariation{}))
-
-	// 0.0 hash
-	assert.Equal(t,
-		&FlagVariation{Codename: "F1", Probability: 0.3},
-		chooseVariation(
-			0.0,
-			[]*FlagVariation{
-				{Codename: "F1", Probability: 0.3},
-				{Codename: "F2", Probability: 0.7},
-			}))
-
-	// simple
-	assert.Equal(t,
-		&FlagVariation{Codename: "F1", Probability: 0.3},
-		chooseVariation(
-			0.2,
-			[]*FlagVariation{
-				{Codename: "F1", Probability: 0.3},
-				{Codename: "F2", Probability: 0.7},
-			}))
-
-	// 1.0 hash
-	assert.Equal(t,
-		&FlagVariation{Codename: "F2", Probability: 0.7},
-		chooseVariation(
-			1.0,
-			[]*FlagVariation{
-				{Codename: "F1", Probability: 0.3},
-				{Codename: "F2", Probability: 0.7},
-			}))
-
-	// real life case
-	assert.Equal(t,
-		&FlagVariation{Codename: "F4", Probability: 0.3},
-		chooseVariation(
-			0.7,
-			[]*FlagVariation{
-				{Codename: "F1", Probability: 0.2},
-				{Codename: "F2", Probability: 0.1},
-				{Codename: "F3", Probability: 0.2},
-				{Codename: "F4", Probability: 0.3},
-				{Codename: "F5", Probability: 0.2},
-			}))
-}
-
 func Test_sampleSubpopulation(t *testing.T) {
 	// without filters
 	assert.Equal(t,
@@ -499,7 +787,7 @@ func Test_sampleSubpopulation(t *testing.T) {
 			SamplingPercentage: 0.4,
 			Filters:            nil,
 		},
-		sampleSubpopulation(
+		testEvaluator.sampleSubpopulation(
 			0.3,
 			[]*FlagSubpopulation{
 				{
@@ -518,8 +806,7 @@ func Test_sampleSubpopulation(t *testing.T) {
 					Filters:            nil,
 				},
 			},
-			"User",
-			Attributes{}))
+			&Entity{Type: "User", Attributes: Attributes{}}))
 
 	// with filters
 	assert.Equal(t,
@@ -535,7 +822,7 @@ func Test_sampleSubpopulation(t *testing.T) {
 				},
 			},
 		},
-		sampleSubpopulation(
+		testEvaluator.sampleSubpopulation(
 			0.3,
 			[]*FlagSubpopulation{
 				{
@@ -573,9 +860,11 @@ func Test_sampleSubpopulation(t *testing.T) {
 					Filters:            nil,
 				},
 			},
-			"User",
-			Attributes{
-				"country": "JP",
+			&Entity{
+				Type: "User",
+				Attributes: Attributes{
+					"country": "JP",
+				},
 			}))
 }
 
@@ -640,3 +929,210 @@ func TestEntity_equalsGroup(t *testing.T) {
 		assert.Equal(t, tt.equal, tt.entity.equalsGroup(tt.group))
 	}
 }
+
+func TestFlagConfig_entityLists(t *testing.T) {
+	flag := &FlagConfig{
+		Blacklist: []*Entity{{ID: "1", Type: "User"}},
+		Whitelist: []*Entity{{ID: "2", Type: "user", Variation: "on"}, {ID: "2", Type: "User", Variation: "off"}},
+	}
+	check := func(t *testing.T) {
+		assert.NotNil(t, flag.blacklisted("1", "USER"))
+		assert.Nil(t, flag.blacklisted("1", "Company"))
+		if assert.NotNil(t, flag.whitelisted("2", "User")) {
+			assert.Equal(t, "on", flag.whitelisted("2", "User").Variation)
+		}
+		assert.Nil(t, flag.whitelisted("1", "User"))
+	}
+
+	t.Run("lists are scanned before the escape", check)
+
+	flag.escape(log.Default())
+	assert.Len(t, flag.whitelist, 1)
+	t.Run("lists are looked up in the sets", check)
+}
+
+func TestFlagConfig_normalizeVariations(t *testing.T) {
+	tests := []struct {
+		variations []*FlagVariation
+		buckets    []int
+	}{
+		// the buckets out of the weights are unassigned
+		{[]*FlagVariation{{Weight: 3300}, {Weight: 3300}, {Weight: 3300}}, []int{3300, 6600, 9900}},
+		// the weights over 100% are cut
+		{[]*FlagVariation{{Weight: 9000}, {Weight: 4000}}, []int{9000, 10000}},
+		// the weights win over the probabilities
+		{[]*FlagVariation{{Probability: 0.9, Weight: 2500}, {Probability: 0.1, Weight: 7500}}, []int{2500, 10000}},
+		{[]*FlagVariation{{Weight: 1}, {Weight: -5}, {Weight: 3}}, []int{1, 1, 4}},
+		{[]*FlagVariation{{Probability: 0.5}, {Probability: 0.5}}, nil},
+	}
+	for _, test := range tests {
+		flag := &FlagConfig{Variations: test.variations}
+		flag.escape(log.Default())
+		assert.Equal(t, test.buckets, flag.buckets, test)
+	}
+
+	probabilities := []struct {
+		variations []*FlagVariation
+		bounds     []float64
+	}{
+		{[]*FlagVariation{{Probability: 0.5}, {Probability: 0.5}}, []float64{0.5, 1}},
+		// the last bound covers the rest of the float sum
+		{[]*FlagVariation{{Probability: 1.0 / 3}, {Probability: 1.0 / 3}, {Probability: 1.0 / 3}}, []float64{1.0 / 3, 2.0 / 3, 1}},
+		// the probabilities which don't sum to 1 are rescaled
+		{[]*FlagVariation{{Probability: 0.33}, {Probability: 0.33}, {Probability: 0.33}}, []float64{1.0 / 3, 2.0 / 3, 1}},
+		{[]*FlagVariation{{Probability: 0.9}, {Probability: 0.6}}, []float64{0.6, 1}},
+		// the variations after the last non-zero one are never chosen
+		{[]*FlagVariation{{Probability: 0.2}, {Probability: -1}, {Probability: 0.8}, {Probability: 0}}, []float64{0.2, 0.2, 1, 1}},
+		{[]*FlagVariation{{Weight: 0}, {Probability: 0}}, []float64{0, 0}},
+		{[]*FlagVariation{}, []float64{}},
+	}
+	for _, test := range probabilities {
+		flag := &FlagConfig{Variations: test.variations}
+		flag.escape(log.Default())
+		assert.Nil(t, flag.buckets, test)
+		if assert.Len(t, flag.bounds, len(test.bounds), test) {
+			assert.InDeltaSlice(t, test.bounds, flag.bounds, 1e-9, test)
+		}
+	}
+
+	t.Run("only the weights over 100% are reported", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := logrus.New()
+		l.SetOutput(&buf)
+
+		split := &FlagConfig{Codename: "split", Variations: []*FlagVariation{{Weight: 3333}, {Weight: 3333}, {Weight: 3333}}}
+		split.escape(log.NewLogrusLogger(l))
+		assert.Empty(t, buf.String())
+
+		over := &FlagConfig{Codename: "over", Variations: []*FlagVariation{{Weight: 6000}, {Weight: 6000}}}
+		over.escape(log.NewLogrusLogger(l))
+		assert.Contains(t, buf.String(), "Flag variation weights exceed 100%")
+	})
+
+	t.Run("only the probabilities off 1 are reported", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := logrus.New()
+		l.SetOutput(&buf)
+
+		split := &FlagConfig{Codename: "split", Variations: []*FlagVariation{{Probability: 1.0 / 3}, {Probability: 1.0 / 3}, {Probability: 1.0 / 3}}}
+		split.escape(log.NewLogrusLogger(l))
+		assert.Empty(t, buf.String())
+
+		short := &FlagConfig{Codename: "short", Variations: []*FlagVariation{{Probability: 0.33}, {Probability: 0.33}, {Probability: 0.33}}}
+		short.escape(log.NewLogrusLogger(l))
+		assert.Contains(t, buf.String(), "Flag variation probabilities don't sum to 1")
+	})
+}
+
+func TestFlagConfig_variationFor(t *testing.T) {
+	flag := &FlagConfig{Variations: []*FlagVariation{{Codename: "a", Weight: 1}, {Codename: "b", Weight: 9999}}}
+	flag.escape(log.Default())
+	assert.Equal(t, "a", flag.variationFor(0).Codename)
+	assert.Equal(t, "b", flag.variationFor(0.0001).Codename)
+	assert.Equal(t, "b", flag.variationFor(1).Codename)
+
+	t.Run("no variation is chosen with zero weights", func(t *testing.T) {
+		flag := &FlagConfig{
+			Codename:           "zero",
+			Variations:         []*FlagVariation{{Codename: "a", Weight: 0}},
+			FlagSubPopulations: []*FlagSubpopulation{{EntityType: "User", SamplingPercentage: 1}},
+		}
+		flag.escape(log.Default())
+		assert.Nil(t, flag.variationFor(0.5))
+
+		result := testEvaluator.evaluateFlag("env", flag, &Entity{ID: "1", Type: "User"})
+		assert.Equal(t, NoVariationChosen, result.Reason)
+		assert.Equal(t, DefaultVariation(), result.Variation)
+
+		ev := &evaluator{log: log.Default(), store: NewMemoryAssignmentStore()}
+		assert.Equal(t, NoVariationChosen, ev.evaluateFlag("env", flag, &Entity{ID: "1", Type: "User"}).Reason)
+		_, ok, _ := ev.store.Get(AssignmentKey{Codename: "zero", EntityID: "1", EntityType: "User"})
+		assert.False(t, ok)
+	})
+}
+
+func TestFlagConfig_variationFor_probabilities(t *testing.T) {
+	const entities = 200000
+
+	t.Run("a 1/3 split assigns every entity", func(t *testing.T) {
+		for _, probability := range []float64{1.0 / 3, 0.33} {
+			flag := &FlagConfig{Codename: "split", Variations: []*FlagVariation{
+				{Codename: "a", Probability: probability},
+				{Codename: "b", Probability: probability},
+				{Codename: "c", Probability: probability},
+			}}
+			flag.escape(log.Default())
+
+			counts := make(map[string]int)
+			for i := 0; i < entities; i++ {
+				if variation := flag.variationFor(variationHash(flag.Codename, strconv.Itoa(i), "User")); assert.NotNil(t, variation) {
+					counts[variation.Codename]++
+				}
+			}
+			assert.Equal(t, entities, counts["a"]+counts["b"]+counts["c"], probability)
+		}
+	})
+
+	t.Run("probabilities finer than a basis point keep the entities", func(t *testing.T) {
+		variations := []*FlagVariation{{Codename: "a", Probability: 0.00005}, {Codename: "b", Probability: 0.99995}}
+		raw := &FlagConfig{Codename: "fine", Variations: variations}
+		flag := &FlagConfig{Codename: "fine", Variations: variations}
+		flag.escape(log.Default())
+
+		for _, hash := range []float64{0, 0.00004, 0.00005, 0.00006, 0.5, 1} {
+			assert.Equal(t, raw.variationFor(hash), flag.variationFor(hash), hash)
+		}
+		assert.Equal(t, "a", flag.variationFor(0.00005).Codename)
+		assert.Equal(t, "b", flag.variationFor(0.00006).Codename)
+	})
+}
+
+// weights are the random basis point weights of 2 to 5 variations, they sum to basisPoints at most
+type weights []int
+
+func (weights) Generate(r *rand.Rand, _ int) reflect.Value {
+	w := make(weights, 2+r.Intn(4))
+	for i := range w {
+		w[i] = 1 + r.Intn(basisPoints/len(w))
+	}
+	return reflect.ValueOf(w)
+}
+
+func TestFlagConfig_variationFor_distribution(t *testing.T) {
+	const entities = 20000
+
+	// the share of every variation is close to its weight, the rest of the entities get no variation
+	property := func(w weights) bool {
+		flag := &FlagConfig{Codename: "distribution"}
+		unassigned := basisPoints
+		for i, weight := range w {
+			flag.Variations = append(flag.Variations, &FlagVariation{Codename: strconv.Itoa(i), Weight: weight})
+			unassigned -= weight
+		}
+		flag.escape(log.Default())
+
+		counts := make(map[string]int)
+		for i := 0; i < entities; i++ {
+			codename := "none"
+			if variation := flag.variationFor(variationHash(flag.Codename, strconv.Itoa(i), "User")); variation != nil {
+				codename = variation.Codename
+			}
+			counts[codename]++
+		}
+		shares := map[string]int{"none": unassigned}
+		for i, weight := range w {
+			shares[strconv.Itoa(i)] = weight
+		}
+		for codename, weight := range shares {
+			expected := float64(weight) / basisPoints
+			actual := float64(counts[codename]) / entities
+			// 5 standard deviations of the binomial share
+			if math.Abs(actual-expected) > 5*math.Sqrt(expected*(1-expected)/entities) {
+				t.Log("weights", w, "variation", codename, "expected", expected, "actual", actual)
+				return false
+			}
+		}
+		return true
+	}
+	assert.NoError(t, quick.Check(property, &quick.Config{MaxCount: 20}))
+}
@@ -0,0 +1,85 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// PropertyType is the type of the event property value in EventSchema
+type PropertyType string
+
+// Property types of EventSchema
+const (
+	PropertyTypeAny     PropertyType = ""
+	PropertyTypeString  PropertyType = "string"
+	PropertyTypeNumber  PropertyType = "number"
+	PropertyTypeBoolean PropertyType = "boolean"
+	PropertyTypeObject  PropertyType = "object"
+	PropertyTypeArray   PropertyType = "array"
+)
+
+// EventSchema describes the properties of the events with the name.
+// The events are tracked anyway, the schema is used to warn about unexpected data
+type EventSchema struct {
+	Name string
+	// Properties are the known properties and their types, the names are case insensitive
+	Properties map[string]PropertyType
+	// Required properties must be present
+	Required []string
+	// Value means the event must have a non zero Value
+	Value bool
+}
+
+// Validate checks the escaped event against the schema, returns the warnings in a stable order:
+// unknown properties, properties of unexpected type and missing required ones
+func (s *EventSchema) Validate(event *Event) []string {
+	properties := make(map[string]PropertyType, len(s.Properties))
+	for name, propertyType := range s.Properties {
+		properties[strings.ToLower(name)] = propertyType
+	}
+
+	var warnings []string
+	for name, value := range event.EventProperties {
+		propertyType, ok := properties[name]
+		switch {
+		case !ok:
+			warnings = append(warnings, fmt.Sprintf("unknown property %q", name))
+		case !propertyType.matches(value):
+			warnings = append(warnings, fmt.Sprintf("property %q must be %s", name, propertyType))
+		}
+	}
+	for _, name := range s.Required {
+		if _, ok := event.EventProperties[strings.ToLower(name)]; !ok {
+			warnings = append(warnings, fmt.Sprintf("required property %q is missing", strings.ToLower(name)))
+		}
+	}
+	sort.Strings(warnings)
+
+	if s.Value && event.Value == 0 {
+		warnings = append(warnings, "value is missing")
+	}
+	return warnings
+}
+
+// matches expects the value of the escaped event, see EscapeEvent
+func (t PropertyType) matches(value interface{}) bool {
+	switch t {
+	case PropertyTypeString:
+		_, ok := value.(string)
+		return ok
+	case PropertyTypeNumber:
+		_, ok := value.(float64)
+		return ok
+	case PropertyTypeBoolean:
+		_, ok := value.(bool)
+		return ok
+	case PropertyTypeObject:
+		_, ok := value.(map[string]interface{})
+		return ok
+	case PropertyTypeArray:
+		_, ok := value.([]interface{})
+		return ok
+	}
+	return true
+}
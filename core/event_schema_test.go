@@ -0,0 +1,57 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventSchema_Validate(t *testing.T) {
+	schema := &EventSchema{
+		Name: "purchase",
+		Properties: map[string]PropertyType{
+			"Plan":     PropertyTypeString,
+			"quantity": PropertyTypeNumber,
+			"gift":     PropertyTypeBoolean,
+			"cart":     PropertyTypeObject,
+			"coupons":  PropertyTypeArray,
+			"note":     PropertyTypeAny,
+		},
+		Required: []string{"plan", "Quantity"},
+		Value:    true,
+	}
+
+	t.Run("valid event", func(t *testing.T) {
+		event := EscapeEvent(&Event{
+			Name: "purchase",
+			EventProperties: Attributes{
+				"plan":     "Bronze",
+				"quantity": 2,
+				"gift":     false,
+				"cart":     map[string]interface{}{"total": 10},
+				"coupons":  []string{"SALE"},
+				"note":     42,
+			},
+			Value: 9.99,
+		})
+		assert.Empty(t, schema.Validate(event))
+	})
+
+	t.Run("invalid event", func(t *testing.T) {
+		event := EscapeEvent(&Event{
+			Name: "purchase",
+			EventProperties: Attributes{
+				"quantity": "two",
+				"cart":     []string{"a"},
+				"referrer": "www.google.com",
+			},
+		})
+		assert.Equal(t, []string{
+			`property "cart" must be object`,
+			`property "quantity" must be number`,
+			`required property "plan" is missing`,
+			`unknown property "referrer"`,
+			"value is missing",
+		}, schema.Validate(event))
+	})
+}
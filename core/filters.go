@@ -1,9 +1,9 @@
 package core
 
 import (
+	"fmt"
+	"strings"
 	"time"
-
-	"github.com/airdeploy/flagger-go/v3/log"
 )
 
 const (
@@ -15,7 +15,7 @@ const (
 
 // This function matches filters with entity
 // It returns true if none of the filters returns false
-func matchByFilters(filters []*FlagFilter, attributes Attributes) bool {
+func (ev *evaluator) matchByFilters(filters []*FlagFilter, attributes Attributes) bool {
 	if len(filters) == 0 {
 		return true
 	}
@@ -25,15 +25,13 @@ func matchByFilters(filters []*FlagFilter, attributes Attributes) bool {
 	}
 
 	// make lower case all attributes keys
-	attributes = escapeAttributes(attributes)
+	attributes = escapeAttributes(attributes, ev.dropped)
 
-	// preparing the filters for matching
-	for _, filter := range filters {
-		filter.escape()
-	}
+	// virtual attributes override the entity ones
+	attributes = ev.withVirtualAttributes(filters, attributes)
 
 	for _, filter := range filters {
-		attr, ok := attributes[filter.AttributeName]
+		attr, ok := lookupAttribute(attributes, filter.AttributeName)
 
 		if !ok {
 			if filter.Operator == isNot {
@@ -42,140 +40,279 @@ func matchByFilters(filters []*FlagFilter, attributes Attributes) bool {
 			if filter.Operator == notIn {
 				return true // attribute is not present so return true
 			}
+			if filter.Operator == noneOf {
+				continue // attribute is not present so none of the values is, match the rest of the filters
+			}
 			return false // attribute is expected so false
 		}
 
-		// return by false from assert function or mismatch by types
-		switch filterValue := filter.Value.(type) {
-		case string:
-			attrStr, ok := attr.(string)
+		if /* NOT */ !ev.matchAttribute(filter, attr) {
+			return false
+		}
+	}
+
+	// we have filters and all was matched
+	return true
+}
+
+// lookupAttribute returns the attribute by its name, a dotted name like "address.city"
+// is looked up in the nested attributes unless there is a flat attribute with such name
+func lookupAttribute(attributes Attributes, name string) (interface{}, bool) {
+	if attr, ok := attributes[name]; ok {
+		return attr, true
+	}
+	path := strings.Split(name, ".")
+	if len(path) == 1 {
+		return nil, false
+	}
+	for _, key := range path[:len(path)-1] {
+		nested, ok := attributes[key].(Attributes)
+		if !ok {
+			return nil, false
+		}
+		attributes = nested
+	}
+	attr, ok := attributes[path[len(path)-1]]
+	return attr, ok
+}
+
+// matchAttribute matches the filter with the value of the attribute. The array attribute matches IN
+// if any element is in the filter values and NOT_IN if none is, the other scalar operators don't match arrays
+func (ev *evaluator) matchAttribute(filter *FlagFilter, attr interface{}) bool {
+	elements, isArray := attr.([]interface{})
+	if !isArray {
+		elements = []interface{}{attr}
+	}
+
+	switch filter.Operator {
+	case anyOf:
+		return ev.matchAnyElement(in, filter, elements)
+	case noneOf:
+		return !ev.matchAnyElement(in, filter, elements)
+	case allOf:
+		return ev.matchAllFilterValues(filter, elements)
+	}
+
+	if !isArray {
+		return ev.matchValue(filter.Operator, filter, attr)
+	}
+	switch filter.Operator {
+	case in:
+		return ev.matchAnyElement(in, filter, elements)
+	case notIn:
+		return !ev.matchAnyElement(in, filter, elements)
+	default:
+		return ev.matchValue(filter.Operator, filter, attr)
+	}
+}
+
+func (ev *evaluator) matchAnyElement(op Operator, filter *FlagFilter, elements []interface{}) bool {
+	for _, element := range elements {
+		if ev.matchValue(op, filter, element) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchAllFilterValues returns true if every filter value is equal to some element
+func (ev *evaluator) matchAllFilterValues(filter *FlagFilter, elements []interface{}) bool {
+	// the string lists and the referenced ID lists are compiled into sets
+	if filter.values != nil {
+		attrs := make(stringSet, len(elements))
+		for _, element := range elements {
+			attrStr, ok := element.(string)
 			if !ok {
-				log.Warnf("Type mismatch for attribute \"%+v\", expected string, but got: %T", filter.AttributeName, attr)
-				return false
+				ev.log.Warn("Type mismatch for attribute", "attribute", filter.AttributeName, "expected", "string", "actual", fmt.Sprintf("%T", element))
+				continue
 			}
-			if /* NOT */ !assertForString(filter.Operator, filterValue, attrStr, filter.AttributeName) {
+			attrs[attrStr] = struct{}{}
+		}
+		for value := range filter.values {
+			if /* NOT */ !attrs.contains(value) {
 				return false
 			}
+		}
+		return true
+	}
 
-		case time.Time:
-			attrStr, ok := attr.(string)
-			if !ok {
-				log.Warnf("Type mismatch for attribute \"%+v\", expected Date.string(), but got: %T", filter.AttributeName, attr)
-				return false
-			}
+	var filterValues []interface{}
+	switch values := filter.Value.(type) {
+	case []string:
+		for _, v := range values {
+			filterValues = append(filterValues, v)
+		}
+	case []float64:
+		for _, v := range values {
+			filterValues = append(filterValues, v)
+		}
+	case []bool:
+		for _, v := range values {
+			filterValues = append(filterValues, v)
+		}
+	case []time.Time:
+		for _, v := range values {
+			filterValues = append(filterValues, v)
+		}
+	default:
+		ev.log.Warn("Filter value type mismatch, expected array", "attribute", filter.AttributeName, "operator", filter.Operator, "actual", fmt.Sprintf("%T", filter.Value))
+		return false
+	}
 
-			attrDate, err := time.Parse(time.RFC3339, attrStr)
-			if err != nil {
-				log.Warnf("Cannot parse value \"%+v\" for attribute \"%+v\" as RFC3339(\"%+v\")", attrStr, filter.AttributeName, time.RFC3339)
-				return false
-			}
+	for _, filterValue := range filterValues {
+		single := &FlagFilter{AttributeName: filter.AttributeName, Operator: is, Value: filterValue, FilterType: filter.FilterType}
+		if /* NOT */ !ev.matchAnyElement(is, single, elements) {
+			return false
+		}
+	}
+	return true
+}
 
-			if /* NOT */ !assertForDate(filter.Operator, filterValue, attrDate, filter.AttributeName) {
-				return false
-			}
+// matchValue matches the scalar attribute value with the filter value using the operator,
+// the array filter values are used by the list operators
+func (ev *evaluator) matchValue(op Operator, filter *FlagFilter, attr interface{}) bool {
+	// the string lists and the referenced ID lists are compiled into sets
+	if filter.values != nil {
+		attrStr, ok := attr.(string)
+		if !ok {
+			ev.log.Warn("Type mismatch for attribute", "attribute", filter.AttributeName, "expected", "string", "actual", fmt.Sprintf("%T", attr))
+			return false
+		}
+		return ev.assertForStringSet(op, filter.values, attrStr, filter.AttributeName)
+	}
 
-		// filterValue type will never be int, because json number is parsed as float64
-		case int:
+	// return by false from assert function or mismatch by types
+	switch filterValue := filter.Value.(type) {
+	case string:
+		attrStr, ok := attr.(string)
+		if !ok {
+			ev.log.Warn("Type mismatch for attribute", "attribute", filter.AttributeName, "expected", "string", "actual", fmt.Sprintf("%T", attr))
+			return false
+		}
+		if /* NOT */ !ev.assertForString(op, filterValue, attrStr, filter.AttributeName) {
 			return false
+		}
 
-		// encoding.json lib parse any number as float64
-		case float64:
-			switch v := attr.(type) {
-			// escapeAttributes converts int to float64
-			case float64:
-				if /* NOT */ !assertForFloat(filter.Operator, filterValue, v, filter.AttributeName) {
-					return false
-				}
-			default:
-				log.Warnf("Type mismatch for attribute \"%+v\", expected float64, but got: %T", filter.AttributeName, attr)
-				return false
-			}
+	case time.Time:
+		attrDate, ok := ev.attributeDate(filter.AttributeName, attr)
+		if !ok {
+			return false
+		}
 
-		case bool:
-			attrBool, ok := attr.(bool)
-			if !ok {
-				log.Warnf("Type mismatch for attribute \"%+v\", expected bool, but got: %T", filter.AttributeName, attr)
-				return false
-			}
-			if /* NOT */ !assertForBool(filter.Operator, filterValue, attrBool, filter.AttributeName) {
-				return false
-			}
+		if /* NOT */ !ev.assertForDate(op, filterValue, attrDate, filter.AttributeName) {
+			return false
+		}
 
-		case []string:
-			attrStr, ok := attr.(string)
-			if !ok {
-				log.Warnf("Type mismatch for attribute \"%+v\", expected string, but got: %T", filter.AttributeName, attr)
-				return false
-			}
-			if /* NOT */ !assertForStringArr(filter.Operator, filterValue, attrStr, filter.AttributeName) {
+	// filterValue type will never be int, because json number is parsed as float64
+	case int:
+		return false
+
+	// encoding.json lib parse any number as float64
+	case float64:
+		switch v := attr.(type) {
+		// escapeAttributes converts int to float64
+		case float64:
+			if /* NOT */ !ev.assertForFloat(op, filterValue, v, filter.AttributeName) {
 				return false
 			}
+		default:
+			ev.log.Warn("Type mismatch for attribute", "attribute", filter.AttributeName, "expected", "float64", "actual", fmt.Sprintf("%T", attr))
+			return false
+		}
 
-		// filterValue type will never be int, because json number is parsed as float64
-		case []int:
+	case bool:
+		attrBool, ok := attr.(bool)
+		if !ok {
+			ev.log.Warn("Type mismatch for attribute", "attribute", filter.AttributeName, "expected", "bool", "actual", fmt.Sprintf("%T", attr))
+			return false
+		}
+		if /* NOT */ !ev.assertForBool(op, filterValue, attrBool, filter.AttributeName) {
 			return false
+		}
 
-		case []float64:
-			attrFloat, ok := attr.(float64)
-			if !ok {
-				log.Warnf("Type mismatch for attribute \"%+v\", expected float64, but got: %T", filter.AttributeName, attr)
-				return false
-			}
-			if /* NOT */ !assertForFloatArr(filter.Operator, filterValue, attrFloat, filter.AttributeName) {
-				return false
-			}
+	case []string:
+		attrStr, ok := attr.(string)
+		if !ok {
+			ev.log.Warn("Type mismatch for attribute", "attribute", filter.AttributeName, "expected", "string", "actual", fmt.Sprintf("%T", attr))
+			return false
+		}
+		if /* NOT */ !ev.assertForStringArr(op, filterValue, attrStr, filter.AttributeName) {
+			return false
+		}
 
-		case []bool:
-			attrBool, ok := attr.(bool)
-			if !ok {
-				log.Warnf("Type mismatch for attribute \"%+v\", expected bool, but got: %T", filter.AttributeName, attr)
-				return false
-			}
-			if /* NOT */ !asertForBoolArr(filter.Operator, filterValue, attrBool, filter.AttributeName) {
-				return false
-			}
+	// filterValue type will never be int, because json number is parsed as float64
+	case []int:
+		return false
 
-		case []time.Time:
-			attrStr, ok := attr.(string)
-			if !ok {
-				log.Warnf("Type mismatch for attribute \"%+v\", expected Date.string(), but got: %T", filter.AttributeName, attr)
-				return false
-			}
+	case []float64:
+		attrFloat, ok := attr.(float64)
+		if !ok {
+			ev.log.Warn("Type mismatch for attribute", "attribute", filter.AttributeName, "expected", "float64", "actual", fmt.Sprintf("%T", attr))
+			return false
+		}
+		if /* NOT */ !ev.assertForFloatArr(op, filterValue, attrFloat, filter.AttributeName) {
+			return false
+		}
 
-			attrDate, err := time.Parse(time.RFC3339, attrStr)
-			if err != nil {
-				log.Warnf("Cannot parse value \"%+v\" for attribute \"%+v\" as RFC3339(\"%+v\")", attrStr, filter.AttributeName, time.RFC3339)
-				return false
-			}
+	case []bool:
+		attrBool, ok := attr.(bool)
+		if !ok {
+			ev.log.Warn("Type mismatch for attribute", "attribute", filter.AttributeName, "expected", "bool", "actual", fmt.Sprintf("%T", attr))
+			return false
+		}
+		if /* NOT */ !ev.asertForBoolArr(op, filterValue, attrBool, filter.AttributeName) {
+			return false
+		}
 
-			if /* NOT */ !assertForDateArr(filter.Operator, filterValue, attrDate, filter.AttributeName) {
-				return false
-			}
+	case []time.Time:
+		attrDate, ok := ev.attributeDate(filter.AttributeName, attr)
+		if !ok {
+			return false
+		}
 
-		default:
-			log.Warnf("Filter value type mismatch for attribute \"%+v\", expected: bool, string, float64, date or array, but got: %T", filter.AttributeName, filterValue)
+		if /* NOT */ !ev.assertForDateArr(op, filterValue, attrDate, filter.AttributeName) {
 			return false
 		}
+
+	default:
+		ev.log.Warn("Filter value type mismatch, expected: bool, string, float64, date or array", "attribute", filter.AttributeName, "actual", fmt.Sprintf("%T", filterValue))
+		return false
 	}
 
-	// we have filters and all was matched
 	return true
 }
 
-func assertForString(op Operator, filterValue, attributeValue, attributeName string) bool {
+// attributeDate returns the value of the date attribute, which is time.Time or RFC3339 string
+func (ev *evaluator) attributeDate(attributeName string, attr interface{}) (time.Time, bool) {
+	switch v := attr.(type) {
+	case time.Time:
+		return v, true
+	case string:
+		attrDate, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			ev.log.Warn("Cannot parse attribute value as RFC3339", "attribute", attributeName, "value", v, "layout", time.RFC3339)
+			return time.Time{}, false
+		}
+		return attrDate, true
+	default:
+		ev.log.Warn("Type mismatch for attribute", "attribute", attributeName, "expected", "date string", "actual", fmt.Sprintf("%T", attr))
+		return time.Time{}, false
+	}
+}
+
+func (ev *evaluator) assertForString(op Operator, filterValue, attributeValue, attributeName string) bool {
 	switch op {
 	case is, in:
 		return filterValue == attributeValue
 	case isNot, notIn:
 		return filterValue != attributeValue
 	default:
-		log.Warnf("Cannot use operator \"%+v\" for string, attribute: \"%+v\", value: \"%+v\", filter: \"%+v\"",
-			op, attributeName, attributeValue, filterValue)
+		ev.log.Warn("Cannot use operator for string", "operator", op, "attribute", attributeName, "value", attributeValue, "filter", filterValue)
 		return false
 	}
 }
 
-func assertForStringArr(op Operator, filterValue []string, attributeValue, attributeName string) bool {
+func (ev *evaluator) assertForStringArr(op Operator, filterValue []string, attributeValue, attributeName string) bool {
 	switch op {
 	case in:
 		for _, v := range filterValue {
@@ -192,13 +329,24 @@ func assertForStringArr(op Operator, filterValue []string, attributeValue, attri
 		}
 		return true
 	default:
-		log.Warnf("Cannot use operator \"%+v\" for []string, attribute: \"%+v\", value: \"%+v\", filter: \"%+v\"",
-			op, attributeName, attributeValue, filterValue)
+		ev.log.Warn("Cannot use operator for []string", "operator", op, "attribute", attributeName, "value", attributeValue, "filter", filterValue)
+		return false
+	}
+}
+
+func (ev *evaluator) assertForStringSet(op Operator, filterValue stringSet, attributeValue, attributeName string) bool {
+	switch op {
+	case in:
+		return filterValue.contains(attributeValue)
+	case notIn:
+		return !filterValue.contains(attributeValue)
+	default:
+		ev.log.Warn("Cannot use operator for []string", "operator", op, "attribute", attributeName, "value", attributeValue)
 		return false
 	}
 }
 
-func assertForDate(op Operator, filterValue, attributeValue time.Time, attributeName string) bool {
+func (ev *evaluator) assertForDate(op Operator, filterValue, attributeValue time.Time, attributeName string) bool {
 	switch op {
 	case is:
 		return filterValue.Equal(attributeValue)
@@ -213,13 +361,12 @@ func assertForDate(op Operator, filterValue, attributeValue time.Time, attribute
 	case gte:
 		return attributeValue.After(filterValue) || attributeValue.Equal(filterValue)
 	default:
-		log.Warnf("Cannot use operator \"%+v\" for date, attribute: \"%+v\", value: \"%+v\", filter: \"%+v\"",
-			op, attributeName, attributeValue, filterValue)
+		ev.log.Warn("Cannot use operator for date", "operator", op, "attribute", attributeName, "value", attributeValue, "filter", filterValue)
 		return false
 	}
 }
 
-func assertForDateArr(op Operator, filterValue []time.Time, attributeValue time.Time, attributeName string) bool {
+func (ev *evaluator) assertForDateArr(op Operator, filterValue []time.Time, attributeValue time.Time, attributeName string) bool {
 	switch op {
 	case in:
 		for _, v := range filterValue {
@@ -236,13 +383,12 @@ func assertForDateArr(op Operator, filterValue []time.Time, attributeValue time.
 		}
 		return true
 	default:
-		log.Warnf("Cannot use operator \"%+v\" for []date, attribute: \"%+v\", value: \"%+v\", filter: \"%+v\"",
-			op, attributeName, attributeValue, filterValue)
+		ev.log.Warn("Cannot use operator for []date", "operator", op, "attribute", attributeName, "value", attributeValue, "filter", filterValue)
 		return false
 	}
 }
 
-func assertForFloat(op Operator, filterValue, attributeValue float64, attributeName string) bool {
+func (ev *evaluator) assertForFloat(op Operator, filterValue, attributeValue float64, attributeName string) bool {
 	switch op {
 	case is:
 		return filterValue == attributeValue
@@ -257,13 +403,12 @@ func assertForFloat(op Operator, filterValue, attributeValue float64, attributeN
 	case gte:
 		return attributeValue >= filterValue
 	default:
-		log.Warnf("Cannot use operator \"%+v\" for number, attribute: \"%+v\", value: \"%+v\", filter: \"%+v\"",
-			op, attributeName, attributeValue, filterValue)
+		ev.log.Warn("Cannot use operator for number", "operator", op, "attribute", attributeName, "value", attributeValue, "filter", filterValue)
 		return false
 	}
 }
 
-func assertForFloatArr(op Operator, filterValue []float64, attributeValue float64, attributeName string) bool {
+func (ev *evaluator) assertForFloatArr(op Operator, filterValue []float64, attributeValue float64, attributeName string) bool {
 	switch op {
 	case in:
 		for _, v := range filterValue {
@@ -280,26 +425,24 @@ func assertForFloatArr(op Operator, filterValue []float64, attributeValue float6
 		}
 		return true
 	default:
-		log.Warnf("Cannot use operator \"%+v\" for []number, attribute: \"%+v\", value: \"%+v\", filter: \"%+v\"",
-			op, attributeName, attributeValue, filterValue)
+		ev.log.Warn("Cannot use operator for []number", "operator", op, "attribute", attributeName, "value", attributeValue, "filter", filterValue)
 		return false
 	}
 }
 
-func assertForBool(op Operator, filterValue, attributeValue bool, attributeName string) bool {
+func (ev *evaluator) assertForBool(op Operator, filterValue, attributeValue bool, attributeName string) bool {
 	switch op {
 	case is:
 		return filterValue == attributeValue
 	case isNot:
 		return filterValue != attributeValue
 	default:
-		log.Warnf("Cannot use operator \"%+v\" for boolean, attribute: \"%+v\", value: \"%+v\", filter: \"%+v\"",
-			op, attributeName, attributeValue, filterValue)
+		ev.log.Warn("Cannot use operator for boolean", "operator", op, "attribute", attributeName, "value", attributeValue, "filter", filterValue)
 		return false
 	}
 }
 
-func asertForBoolArr(op Operator, filterValue []bool, attributeValue bool, attributeName string) bool {
+func (ev *evaluator) asertForBoolArr(op Operator, filterValue []bool, attributeValue bool, attributeName string) bool {
 	switch op {
 	case in:
 		for _, v := range filterValue {
@@ -316,8 +459,7 @@ func asertForBoolArr(op Operator, filterValue []bool, attributeValue bool, attri
 		}
 		return true
 	default:
-		log.Warnf("Cannot use operator \"%+v\" for []boolean, attribute: \"%+v\", value: \"%+v\", filter: \"%+v\"",
-			op, attributeName, attributeValue, filterValue)
+		ev.log.Warn("Cannot use operator for []boolean", "operator", op, "attribute", attributeName, "value", attributeValue, "filter", filterValue)
 		return false
 	}
 }
@@ -12,25 +12,33 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
+// matchEscapedFilters escapes the filters as SetConfig does and matches them with the attributes
+func (ev *evaluator) matchEscapedFilters(filters []*FlagFilter, attributes Attributes) bool {
+	for _, filter := range filters {
+		filter.escape(ev.log)
+	}
+	return ev.matchByFilters(filters, attributes)
+}
+
 func Test_matchByFilters(t *testing.T) {
 	t.Run("nil and empty", func(t *testing.T) {
 		attr := Attributes{}
 		filters := []*FlagFilter{}
-		assert.True(t, matchByFilters(nil, nil))
-		assert.True(t, matchByFilters(nil, attr))
-		assert.True(t, matchByFilters(filters, nil))
-		assert.True(t, matchByFilters(filters, attr))
+		assert.True(t, testEvaluator.matchEscapedFilters(nil, nil))
+		assert.True(t, testEvaluator.matchEscapedFilters(nil, attr))
+		assert.True(t, testEvaluator.matchEscapedFilters(filters, nil))
+		assert.True(t, testEvaluator.matchEscapedFilters(filters, attr))
 
 		filters = []*FlagFilter{{}}
-		assert.False(t, matchByFilters(filters, nil))
-		assert.False(t, matchByFilters(filters, attr))
+		assert.False(t, testEvaluator.matchEscapedFilters(filters, nil))
+		assert.False(t, testEvaluator.matchEscapedFilters(filters, attr))
 	})
 
 	t.Run("simple", func(t *testing.T) {
 
 		t.Run("pos1", func(t *testing.T) {
 			country := randCountry()
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -46,7 +54,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("neg1", func(t *testing.T) {
 			country := randCountry()
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -62,7 +70,7 @@ func Test_matchByFilters(t *testing.T) {
 	})
 
 	t.Run("no such attribute", func(t *testing.T) {
-		assert.False(t, matchByFilters(
+		assert.False(t, testEvaluator.matchEscapedFilters(
 			[]*FlagFilter{
 				{
 					AttributeName: "country",
@@ -77,7 +85,7 @@ func Test_matchByFilters(t *testing.T) {
 	})
 
 	t.Run("broken filters", func(t *testing.T) {
-		assert.False(t, matchByFilters(
+		assert.False(t, testEvaluator.matchEscapedFilters(
 			[]*FlagFilter{
 				{
 					AttributeName: "country",
@@ -95,7 +103,7 @@ func Test_matchByFilters(t *testing.T) {
 	t.Run("type mismatch", func(t *testing.T) {
 		t.Run("filter's value is int, which could not be parsed from string by json, so false", func(t *testing.T) {
 			age := randInt()
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "age",
@@ -107,7 +115,7 @@ func Test_matchByFilters(t *testing.T) {
 				randAttributes()))
 		})
 		t.Run("filter is float, attribute is string", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -121,7 +129,7 @@ func Test_matchByFilters(t *testing.T) {
 				)))
 		})
 		t.Run("filter is []float, attribute is string", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -136,7 +144,7 @@ func Test_matchByFilters(t *testing.T) {
 		})
 
 		t.Run("filter is string, attribute is integer", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -150,7 +158,7 @@ func Test_matchByFilters(t *testing.T) {
 				)))
 		})
 		t.Run("filter is []string, attribute is integer", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -165,7 +173,7 @@ func Test_matchByFilters(t *testing.T) {
 		})
 
 		t.Run("filter is bool, attribute is integer", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "isAdmin",
@@ -179,7 +187,7 @@ func Test_matchByFilters(t *testing.T) {
 				)))
 		})
 		t.Run("filter is []bool, attribute is integer", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "isAdmin",
@@ -194,7 +202,7 @@ func Test_matchByFilters(t *testing.T) {
 		})
 
 		t.Run("invalid filter value after parsing: unit", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -206,7 +214,7 @@ func Test_matchByFilters(t *testing.T) {
 				randAttributes()))
 		})
 		t.Run("invalid filter value after parsing: json unmarshal number to []float64, not []int", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "age",
@@ -221,7 +229,7 @@ func Test_matchByFilters(t *testing.T) {
 		t.Run("but flagger recover types", func(t *testing.T) {
 			t.Run("filter is float64, attribute is int => true", func(t *testing.T) {
 				v := float64(1)
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "probability",
@@ -237,7 +245,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("filter is float64, attribute is int => true", func(t *testing.T) {
 				v := float64(1)
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "probability",
@@ -258,7 +266,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("countries are equal", func(t *testing.T) {
 				country := randCountry()
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "country",
@@ -274,7 +282,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("countries don't match", func(t *testing.T) {
 				country := randCountry()
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "country",
@@ -293,7 +301,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("pos1", func(t *testing.T) {
 				probability := randFloat()
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "probability",
@@ -308,7 +316,7 @@ func Test_matchByFilters(t *testing.T) {
 			})
 
 			t.Run("filter float, attribute int", func(t *testing.T) {
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "friends",
@@ -325,7 +333,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("neg1", func(t *testing.T) {
 				probability := randFloat()
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "probability",
@@ -344,7 +352,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("pos1", func(t *testing.T) {
 				admin := randBool()
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "admin",
@@ -360,7 +368,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("neg1", func(t *testing.T) {
 				admin := randBool()
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "admin",
@@ -379,7 +387,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			createdAt := "2016-03-16T05:44:23Z"
 			t.Run("positive test", func(t *testing.T) {
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "createdAt",
@@ -394,7 +402,7 @@ func Test_matchByFilters(t *testing.T) {
 			})
 			t.Run("negative tests", func(t *testing.T) {
 				t.Run("client's value is a number", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -408,7 +416,7 @@ func Test_matchByFilters(t *testing.T) {
 						)))
 				})
 				t.Run("client's value is a number in string", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -422,7 +430,7 @@ func Test_matchByFilters(t *testing.T) {
 						)))
 				})
 				t.Run("client's value is in the wrong format, RFC 2822", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -436,7 +444,7 @@ func Test_matchByFilters(t *testing.T) {
 						)))
 				})
 				t.Run("server's value is a number", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -450,7 +458,7 @@ func Test_matchByFilters(t *testing.T) {
 						)))
 				})
 				t.Run("client's value is a string", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -464,7 +472,7 @@ func Test_matchByFilters(t *testing.T) {
 						)))
 				})
 				t.Run("client's value is an array", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -478,7 +486,7 @@ func Test_matchByFilters(t *testing.T) {
 						)))
 				})
 				t.Run("client's value is a boolean", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -492,7 +500,7 @@ func Test_matchByFilters(t *testing.T) {
 						)))
 				})
 				t.Run("values don't match", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -506,7 +514,7 @@ func Test_matchByFilters(t *testing.T) {
 						)))
 				})
 				t.Run("values don't match", func(t *testing.T) {
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -523,7 +531,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("neg1", func(t *testing.T) {
 				createdAt := randTS()
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "createdAt",
@@ -544,7 +552,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("pos1", func(t *testing.T) {
 				country := randCountry()
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "country",
@@ -564,7 +572,7 @@ func Test_matchByFilters(t *testing.T) {
 			t.Run("pos1", func(t *testing.T) {
 				// have no attribute country
 				country := randCountry()
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "country",
@@ -582,7 +590,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("neg1", func(t *testing.T) {
 				country := randCountry()
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "country",
@@ -604,7 +612,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("pos1", func(t *testing.T) {
 				probability := randFloat()
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "probability",
@@ -624,7 +632,7 @@ func Test_matchByFilters(t *testing.T) {
 			t.Run("pos2", func(t *testing.T) {
 				// have no attribute probability
 				probability := randFloat()
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "probability",
@@ -642,7 +650,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("neg1", func(t *testing.T) {
 				probability := randFloat()
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "probability",
@@ -664,7 +672,7 @@ func Test_matchByFilters(t *testing.T) {
 
 			t.Run("pos1", func(t *testing.T) {
 				admin := randBool()
-				assert.True(t, matchByFilters(
+				assert.True(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "admin",
@@ -682,7 +690,7 @@ func Test_matchByFilters(t *testing.T) {
 			})
 
 			// positive, no attribute admin
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -698,7 +706,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -719,7 +727,7 @@ func Test_matchByFilters(t *testing.T) {
 			now := time.Unix(time.Now().Unix(), 0)
 
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -736,7 +744,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// positive, no attribute createdAt
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -752,7 +760,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -774,7 +782,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("float", func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -789,7 +797,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -802,7 +810,7 @@ func Test_matchByFilters(t *testing.T) {
 					"age":         25,
 					"probability": 0.5,
 				}))
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -821,7 +829,7 @@ func Test_matchByFilters(t *testing.T) {
 			now := time.Unix(time.Now().Unix(), 0)
 
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -836,7 +844,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -849,7 +857,7 @@ func Test_matchByFilters(t *testing.T) {
 					"age":       25,
 					"createdAt": now.Format(time.RFC3339),
 				}))
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -867,7 +875,7 @@ func Test_matchByFilters(t *testing.T) {
 		t.Run("string", func(t *testing.T) {
 			t.Run("wrong operator", func(t *testing.T) {
 				country := randCountry()
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "country",
@@ -887,7 +895,7 @@ func Test_matchByFilters(t *testing.T) {
 			now2 := randTSNEq(now1)
 			now3 := randTSNEq(now2)
 
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -903,7 +911,7 @@ func Test_matchByFilters(t *testing.T) {
 		})
 
 		t.Run("wrong operator for []float64", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -921,7 +929,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("wrong operator for bool", func(t *testing.T) {
 			admin := randBool()
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -936,7 +944,7 @@ func Test_matchByFilters(t *testing.T) {
 		})
 
 		t.Run("wrong operator for []bool", func(t *testing.T) {
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -956,7 +964,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("float", func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -970,7 +978,7 @@ func Test_matchByFilters(t *testing.T) {
 					"probability": 0.4,
 				}))
 
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -985,7 +993,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1004,7 +1012,7 @@ func Test_matchByFilters(t *testing.T) {
 			now := time.Unix(time.Now().Unix(), 0)
 
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1017,7 +1025,7 @@ func Test_matchByFilters(t *testing.T) {
 					"age":       20,
 					"createdAt": now.Add(-3 * time.Hour).Format(time.RFC3339),
 				}))
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1032,7 +1040,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1052,7 +1060,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("float", func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1067,7 +1075,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1080,7 +1088,7 @@ func Test_matchByFilters(t *testing.T) {
 					"age":         25,
 					"probability": 0.1,
 				}))
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1099,7 +1107,7 @@ func Test_matchByFilters(t *testing.T) {
 			now := time.Unix(time.Now().Unix(), 0)
 
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1114,7 +1122,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1127,7 +1135,7 @@ func Test_matchByFilters(t *testing.T) {
 					"age":       20,
 					"createdAt": now.Format(time.RFC3339),
 				}))
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1147,7 +1155,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("float", func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1161,7 +1169,7 @@ func Test_matchByFilters(t *testing.T) {
 					"probability": 0.7,
 				}))
 
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1176,7 +1184,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1195,7 +1203,7 @@ func Test_matchByFilters(t *testing.T) {
 			now := time.Unix(time.Now().Unix(), 0)
 
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1209,7 +1217,7 @@ func Test_matchByFilters(t *testing.T) {
 					"createdAt": now.Add(4 * time.Hour).Format(time.RFC3339),
 				}))
 
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1224,7 +1232,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1243,7 +1251,7 @@ func Test_matchByFilters(t *testing.T) {
 	t.Run("in", func(t *testing.T) {
 		t.Run(filterTypeString, func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1258,7 +1266,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1273,7 +1281,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			t.Run("wrong operator", func(t *testing.T) {
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "country",
@@ -1289,7 +1297,7 @@ func Test_matchByFilters(t *testing.T) {
 		})
 
 		t.Run("bool", func(t *testing.T) {
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -1303,7 +1311,7 @@ func Test_matchByFilters(t *testing.T) {
 				)),
 			)
 
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -1320,7 +1328,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("float", func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1336,7 +1344,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1359,7 +1367,7 @@ func Test_matchByFilters(t *testing.T) {
 			t.Run("positive test", func(t *testing.T) {
 				t.Run("string type", func(t *testing.T) {
 					createdAtArr := []string{"2016-03-16T05:44:23Z"}
-					assert.True(t, matchByFilters(
+					assert.True(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -1373,7 +1381,7 @@ func Test_matchByFilters(t *testing.T) {
 						}))
 				})
 				t.Run("Time type", func(t *testing.T) {
-					assert.True(t, matchByFilters(
+					assert.True(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -1390,9 +1398,9 @@ func Test_matchByFilters(t *testing.T) {
 			})
 
 			t.Run("negative tests", func(t *testing.T) {
-				t.Run("attribute type is invalid(array)", func(t *testing.T) {
+				t.Run("no element of the array attribute is in the list", func(t *testing.T) {
 					createdAtArr := []string{"2016-03-16T05:44:23Z"}
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -1402,12 +1410,12 @@ func Test_matchByFilters(t *testing.T) {
 							},
 						},
 						Attributes{
-							"createdAt": []string{"2016-03-16T05:44:23Z"},
+							"createdAt": []string{"2017-03-16T05:44:23Z"},
 						}))
 				})
 				t.Run("attribute type is bool", func(t *testing.T) {
 					createdAtArr := []string{"2016-03-16T05:44:23Z"}
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -1423,7 +1431,7 @@ func Test_matchByFilters(t *testing.T) {
 
 				t.Run("attribute type is in wrong format", func(t *testing.T) {
 					createdAtArr := []string{"2016-03-16T05:44:23Z"}
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -1438,7 +1446,7 @@ func Test_matchByFilters(t *testing.T) {
 				})
 				t.Run("wrong date", func(t *testing.T) {
 					createdAtArr := []string{"2016-03-16T05:44:23Z"}
-					assert.False(t, matchByFilters(
+					assert.False(t, testEvaluator.matchEscapedFilters(
 						[]*FlagFilter{
 							{
 								AttributeName: "createdAt",
@@ -1460,7 +1468,7 @@ func Test_matchByFilters(t *testing.T) {
 	t.Run("not_in", func(t *testing.T) {
 		t.Run(filterTypeString, func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1475,7 +1483,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// positive, no attribute country
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1489,7 +1497,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1506,7 +1514,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("float", func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1522,7 +1530,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// positive, no attribute probability
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1537,7 +1545,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "probability",
@@ -1553,7 +1561,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			t.Run("wrong operator", func(t *testing.T) {
-				assert.False(t, matchByFilters(
+				assert.False(t, testEvaluator.matchEscapedFilters(
 					[]*FlagFilter{
 						{
 							AttributeName: "probability",
@@ -1571,7 +1579,7 @@ func Test_matchByFilters(t *testing.T) {
 
 		t.Run("bool", func(t *testing.T) {
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -1588,7 +1596,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// positive, no attribute admin
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -1604,7 +1612,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "admin",
@@ -1627,7 +1635,7 @@ func Test_matchByFilters(t *testing.T) {
 			now3 := randTSNEq(now2)
 
 			// positive
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1642,7 +1650,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// positive, no attribute age
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1656,7 +1664,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1671,7 +1679,7 @@ func Test_matchByFilters(t *testing.T) {
 				}))
 
 			// negative, date is in array
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "createdAt",
@@ -1691,7 +1699,7 @@ func Test_matchByFilters(t *testing.T) {
 		now := time.Unix(time.Now().Unix(), 0)
 
 		// positive
-		assert.True(t, matchByFilters(
+		assert.True(t, testEvaluator.matchEscapedFilters(
 			[]*FlagFilter{
 				{
 					AttributeName: "country",
@@ -1723,7 +1731,7 @@ func Test_matchByFilters(t *testing.T) {
 			}))
 
 		// negative
-		assert.False(t, matchByFilters(
+		assert.False(t, testEvaluator.matchEscapedFilters(
 			[]*FlagFilter{
 				{
 					AttributeName: "country",
@@ -1754,7 +1762,7 @@ func Test_matchByFilters(t *testing.T) {
 		t.Run("pos1", func(t *testing.T) {
 			country := randCountry()
 			fire := randBool()
-			assert.True(t, matchByFilters(
+			assert.True(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1785,7 +1793,7 @@ func Test_matchByFilters(t *testing.T) {
 		t.Run("neg1", func(t *testing.T) {
 			country := randCountry()
 			fire := randBool()
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1815,7 +1823,7 @@ func Test_matchByFilters(t *testing.T) {
 			country := randCountry()
 			age := randInt()
 			fire := randBool()
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1847,7 +1855,7 @@ func Test_matchByFilters(t *testing.T) {
 			country := randCountry()
 			age := randInt()
 			fire := randBool()
-			assert.False(t, matchByFilters(
+			assert.False(t, testEvaluator.matchEscapedFilters(
 				[]*FlagFilter{
 					{
 						AttributeName: "country",
@@ -1993,6 +2001,16 @@ func randCountryNEq(v string) string {
 	return v2
 }
 
+func Test_matchByFilters_readOnly(t *testing.T) {
+	filter := &FlagFilter{AttributeName: "Country", Operator: in, Value: []interface{}{"France"}, FilterType: filterTypeString}
+	testEvaluator.matchByFilters([]*FlagFilter{filter}, Attributes{"country": "France"})
+
+	// the filters are compiled by SetConfig only, the evaluation doesn't modify them
+	assert.Equal(t, "Country", filter.AttributeName)
+	assert.Equal(t, []interface{}{"France"}, filter.Value)
+	assert.Nil(t, filter.values)
+}
+
 func TestJSONUnmarshalToFloat64(t *testing.T) {
 	buf := []byte(`{"a":22.4,"b":44444444444}`)
 	var attributes map[string]interface{}
@@ -2009,3 +2027,82 @@ func TestJSONUnmarshalToFloat64(t *testing.T) {
 	}
 
 }
+
+func Test_matchByFilters_arraysAndNestedAttributes(t *testing.T) {
+	filter := func(name string, op Operator, value interface{}, filterType string) []*FlagFilter {
+		return []*FlagFilter{{AttributeName: name, Operator: op, Value: value, FilterType: filterType}}
+	}
+	attributes := Attributes{
+		"tags":    []string{"beta", "vip"},
+		"scores":  []int{3, 7},
+		"address": map[string]interface{}{"City": "Paris", "geo": map[string]interface{}{"zip": 75001}},
+		"plan.id": "flat",
+	}
+
+	t.Run("IN and NOT_IN match any element", func(t *testing.T) {
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("tags", in, []interface{}{"vip", "staff"}, filterTypeString), attributes))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("tags", in, []interface{}{"staff"}, filterTypeString), attributes))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("tags", notIn, []interface{}{"vip"}, filterTypeString), attributes))
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("tags", notIn, []interface{}{"staff"}, filterTypeString), attributes))
+	})
+
+	t.Run("scalar operators don't match arrays", func(t *testing.T) {
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("scores", gt, 5.0, filterTypeNumber), attributes))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("tags", is, "beta", filterTypeString), attributes))
+	})
+
+	t.Run("array of dates", func(t *testing.T) {
+		dates := Attributes{"logins": []string{"2016-03-16T05:44:23Z", "2017-03-16T05:44:23Z"}}
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("logins", in, []interface{}{"2017-03-16T05:44:23Z"}, filterTypeDate), dates))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("logins", allOf, []interface{}{"2017-03-16T05:44:23Z", "2018-03-16T05:44:23Z"}, filterTypeDate), dates))
+	})
+
+	t.Run("ANY_OF, ALL_OF and NONE_OF", func(t *testing.T) {
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("tags", anyOf, []interface{}{"vip", "staff"}, filterTypeString), attributes))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("tags", anyOf, []interface{}{"staff"}, filterTypeString), attributes))
+
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("scores", allOf, []interface{}{7.0, 3.0}, filterTypeNumber), attributes))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("scores", allOf, []interface{}{3.0, 5.0}, filterTypeNumber), attributes))
+
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("tags", noneOf, []interface{}{"staff"}, filterTypeString), attributes))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("tags", noneOf, []interface{}{"beta"}, filterTypeString), attributes))
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("missing", noneOf, []interface{}{"beta"}, filterTypeString), attributes))
+	})
+
+	t.Run("NONE_OF of missing attribute matches the rest of the filters", func(t *testing.T) {
+		filters := append(filter("missing", noneOf, []interface{}{"beta"}, filterTypeString), filter("tags", anyOf, []interface{}{"staff"}, filterTypeString)...)
+		assert.False(t, testEvaluator.matchEscapedFilters(filters, attributes))
+
+		filters = append(filter("missing", noneOf, []interface{}{"beta"}, filterTypeString), filter("tags", anyOf, []interface{}{"vip"}, filterTypeString)...)
+		assert.True(t, testEvaluator.matchEscapedFilters(filters, attributes))
+	})
+
+	t.Run("scalar attribute is a single element array for the list operators", func(t *testing.T) {
+		country := Attributes{"country": "France"}
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("country", anyOf, []interface{}{"France", "Spain"}, filterTypeString), country))
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("country", allOf, []interface{}{"France"}, filterTypeString), country))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("country", allOf, []interface{}{"France", "Spain"}, filterTypeString), country))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("country", noneOf, []interface{}{"France"}, filterTypeString), country))
+	})
+
+	t.Run("dotted path looks up nested attributes", func(t *testing.T) {
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("Address.City", is, "Paris", filterTypeString), attributes))
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("address.geo.zip", in, []interface{}{75001.0}, filterTypeNumber), attributes))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("address.country", is, "France", filterTypeString), attributes))
+		assert.False(t, testEvaluator.matchEscapedFilters(filter("tags.beta", is, "beta", filterTypeString), attributes))
+	})
+
+	t.Run("flat attribute with dotted name wins over the path", func(t *testing.T) {
+		assert.True(t, testEvaluator.matchEscapedFilters(filter("plan.id", is, "flat", filterTypeString), attributes))
+	})
+}
+
+func Test_matchByFilters_goTypes(t *testing.T) {
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	attributes := Attributes{"createdAt": createdAt, "userID": int64(42), "logins": []time.Time{createdAt}}
+
+	assert.True(t, testEvaluator.matchEscapedFilters([]*FlagFilter{{AttributeName: "createdAt", Operator: lt, Value: "2021-01-01T00:00:00Z", FilterType: filterTypeDate}}, attributes))
+	assert.True(t, testEvaluator.matchEscapedFilters([]*FlagFilter{{AttributeName: "createdAt", Operator: is, Value: "2020-01-02T03:04:05Z", FilterType: filterTypeDate}}, attributes))
+	assert.True(t, testEvaluator.matchEscapedFilters([]*FlagFilter{{AttributeName: "logins", Operator: in, Value: []interface{}{"2020-01-02T03:04:05Z"}, FilterType: filterTypeDate}}, attributes))
+	assert.True(t, testEvaluator.matchEscapedFilters([]*FlagFilter{{AttributeName: "userID", Operator: in, Value: []interface{}{42.0}, FilterType: filterTypeNumber}}, attributes))
+}
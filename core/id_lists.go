@@ -0,0 +1,90 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"strings"
+
+	"github.com/airdeploy/flagger-go/v3/log"
+)
+
+// IDList is a named list of IDs referenced by FlagFilter.ListRef. Large lists are sent as Data,
+// which is gzip'd newline separated IDs, base64 encoded in JSON. IDs and Data may be combined
+type IDList struct {
+	Name string   `json:"name"`
+	IDs  []string `json:"ids,omitempty"`
+	Data []byte   `json:"data,omitempty"`
+}
+
+// stringSet is a set of the filter string values
+type stringSet map[string]struct{}
+
+func newStringSet(values []string) stringSet {
+	set := make(stringSet, len(values))
+	for _, v := range values {
+		set[v] = struct{}{}
+	}
+	return set
+}
+
+func (s stringSet) contains(value string) bool {
+	_, ok := s[value]
+	return ok
+}
+
+// decode returns the set of all IDs of the list
+func (l *IDList) decode() (stringSet, error) {
+	set := newStringSet(l.IDs)
+	if len(l.Data) == 0 {
+		return set, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(l.Data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			set[id] = struct{}{}
+		}
+	}
+	return set, scanner.Err()
+}
+
+// resolveIDLists sets the values of the filters referencing ID lists,
+// the filters referencing missing or broken lists match no values
+func (c *Configuration) resolveIDLists(logger log.Logger) {
+	lists := make(map[string]stringSet, len(c.IDLists))
+	for _, l := range c.IDLists {
+		set, err := l.decode()
+		if err != nil {
+			logger.Warn("ID list cannot be decoded", "list", l.Name, "error", err)
+			set = stringSet{}
+		}
+		lists[l.Name] = set
+	}
+
+	resolve := func(filters []*FlagFilter, keysAndValues ...interface{}) {
+		for _, filter := range filters {
+			if filter.ListRef == "" {
+				continue
+			}
+			set, ok := lists[filter.ListRef]
+			if !ok {
+				logger.Warn("Filter ID list is missing", append(keysAndValues, "list", filter.ListRef)...)
+				set = stringSet{}
+			}
+			filter.values = set
+		}
+	}
+	for _, f := range c.Flags {
+		for _, sp := range f.FlagSubPopulations {
+			resolve(sp.Filters, "codename", f.Codename)
+		}
+	}
+	for _, s := range c.Segments {
+		resolve(s.Filters, "referencedBy", s.Name)
+	}
+}
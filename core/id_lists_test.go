@@ -0,0 +1,101 @@
+package core
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/airdeploy/flagger-go/v3/json"
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipIDs(t *testing.T, ids []string) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write([]byte(strings.Join(ids, "\n")))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestIDList_decode(t *testing.T) {
+	t.Run("plain and gzip'd IDs are combined", func(t *testing.T) {
+		set, err := (&IDList{IDs: []string{"1"}, Data: gzipIDs(t, []string{"2", "", " 3 "})}).decode()
+		assert.NoError(t, err)
+		assert.Equal(t, newStringSet([]string{"1", "2", "3"}), set)
+	})
+
+	t.Run("data is base64 in JSON", func(t *testing.T) {
+		buf, err := json.Marshal(&IDList{Name: "accounts", Data: gzipIDs(t, []string{"a", "b"})})
+		require.NoError(t, err)
+		var list IDList
+		require.NoError(t, json.Unmarshal(buf, &list))
+		set, err := list.decode()
+		assert.NoError(t, err)
+		assert.Equal(t, newStringSet([]string{"a", "b"}), set)
+	})
+
+	t.Run("broken data", func(t *testing.T) {
+		_, err := (&IDList{Data: []byte("not gzip")}).decode()
+		assert.Error(t, err)
+	})
+}
+
+func TestConfiguration_resolveIDLists(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&logrus.JSONFormatter{})
+
+	ids := make([]string, 200000)
+	for i := range ids {
+		ids[i] = "account-" + strconv.Itoa(i)
+	}
+	accounts := &FlagFilter{AttributeName: "id", Operator: in, ListRef: "accounts"}
+	missing := &FlagFilter{AttributeName: "id", Operator: notIn, ListRef: "missing"}
+	broken := &FlagFilter{AttributeName: "id", Operator: in, ListRef: "broken"}
+	configuration := &Configuration{
+		IDLists: []*IDList{
+			{Name: "accounts", Data: gzipIDs(t, ids)},
+			{Name: "broken", Data: []byte("not gzip")},
+		},
+		Flags: []*FlagConfig{{
+			Codename:           "beta",
+			FlagSubPopulations: []*FlagSubpopulation{{EntityType: "Account", Filters: []*FlagFilter{accounts, missing}}},
+		}},
+		Segments: []*Segment{{Name: "broken", Filters: []*FlagFilter{broken}}},
+	}
+	configuration.escape(log.NewLogrusLogger(l))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"list":"broken"`)
+		assert.Contains(t, lines[1], `"codename":"beta","level":"warning","list":"missing"`)
+	}
+
+	assert.True(t, testEvaluator.matchByFilters([]*FlagFilter{accounts}, Attributes{"id": "account-199999"}))
+	assert.False(t, testEvaluator.matchByFilters([]*FlagFilter{accounts}, Attributes{"id": "account-200000"}))
+	assert.True(t, testEvaluator.matchByFilters([]*FlagFilter{missing}, Attributes{"id": "account-1"}))
+	assert.False(t, testEvaluator.matchByFilters([]*FlagFilter{broken}, Attributes{"id": "account-1"}))
+
+	t.Run("ALL_OF matches the list", func(t *testing.T) {
+		roles := &FlagFilter{AttributeName: "roles", Operator: allOf, ListRef: "roles"}
+		configuration := &Configuration{
+			IDLists:  []*IDList{{Name: "roles", IDs: []string{"admin", "billing"}}},
+			Segments: []*Segment{{Name: "admins", Filters: []*FlagFilter{roles}}},
+		}
+		configuration.escape(log.NewLogrusLogger(l))
+		buf.Reset()
+
+		ev := &evaluator{log: log.NewLogrusLogger(l)}
+		assert.True(t, ev.matchByFilters([]*FlagFilter{roles}, Attributes{"roles": []string{"billing", "admin", "support"}}))
+		assert.False(t, ev.matchByFilters([]*FlagFilter{roles}, Attributes{"roles": []string{"admin"}}))
+		assert.False(t, ev.matchByFilters([]*FlagFilter{roles}, Attributes{"roles": "admin"}))
+		assert.Empty(t, buf.String())
+	})
+}
@@ -0,0 +1,109 @@
+package core
+
+import (
+	"github.com/airdeploy/flagger-go/v3/log"
+)
+
+// Segment is a named audience referenced by IN_SEGMENT and NOT_IN_SEGMENT filters.
+// The excluded entities are never in the segment, the included ones always are,
+// other entities are in the segment if they match all the filters
+type Segment struct {
+	Name    string        `json:"name"`
+	Filters []*FlagFilter `json:"filters,omitempty"`
+	Include []*Entity     `json:"include,omitempty"`
+	Exclude []*Entity     `json:"exclude,omitempty"`
+
+	include, exclude entitySet
+}
+
+func (s *Segment) escape(logger log.Logger) {
+	var result = make([]*FlagFilter, 0, len(s.Filters))
+
+	// filter out empty Operators and EscapeEntity Filter
+	for _, filter := range s.Filters {
+		if filter.Operator.isValid() {
+			filter.escape(logger)
+			result = append(result, filter)
+		}
+	}
+	s.Filters = result
+	s.include = newEntitySet(s.Include)
+	s.exclude = newEntitySet(s.Exclude)
+}
+
+// checkSegments warns about the filters referencing missing segments, such filters never match
+func (c *Configuration) checkSegments(logger log.Logger) {
+	check := func(filters []*FlagFilter, keysAndValues ...interface{}) {
+		for _, filter := range filters {
+			if !filter.Operator.isSegment() {
+				continue
+			}
+			name, _ := filter.Value.(string)
+			if _, ok := c.segments[name]; !ok {
+				logger.Warn("Filter segment is missing", append(keysAndValues, "segment", filter.Value)...)
+			}
+		}
+	}
+	for _, f := range c.Flags {
+		for _, sp := range f.FlagSubPopulations {
+			check(sp.Filters, "codename", f.Codename)
+		}
+	}
+	for _, s := range c.Segments {
+		check(s.Filters, "referencedBy", s.Name)
+	}
+}
+
+// segmentKey identifies the segment membership of the entity within an evaluation
+type segmentKey struct {
+	segment, id, Type string
+}
+
+// inSegment reports whether the entity is in the segment, the result is computed once per evaluation
+func (ev *evaluator) inSegment(name string, entity *Entity) bool {
+	key := segmentKey{segment: name, id: entity.ID, Type: entity.Type}
+	if matched, ok := ev.segmentMatches[key]; ok {
+		return matched
+	}
+	if ev.segmentMatches == nil {
+		ev.segmentMatches = make(map[segmentKey]bool)
+	}
+	// the segment referencing itself doesn't match
+	ev.segmentMatches[key] = false
+
+	segment, ok := ev.segments[name]
+	matched := ok && ev.matchSegment(segment, entity)
+	ev.segmentMatches[key] = matched
+	return matched
+}
+
+func (ev *evaluator) matchSegment(segment *Segment, entity *Entity) bool {
+	if segment.exclude.find(segment.Exclude, entity.ID, entity.Type) != nil {
+		return false
+	}
+	if segment.include.find(segment.Include, entity.ID, entity.Type) != nil {
+		return true
+	}
+	// the segment without filters has only the included entities
+	return len(segment.Filters) != 0 && ev.matchEntity(segment.Filters, entity)
+}
+
+// matchEntity matches the segment filters with the entity and the other filters with its attributes
+func (ev *evaluator) matchEntity(filters []*FlagFilter, entity *Entity) bool {
+	var attributeFilters []*FlagFilter
+	for _, filter := range filters {
+		if !filter.Operator.isSegment() {
+			attributeFilters = append(attributeFilters, filter)
+			continue
+		}
+		name, _ := filter.Value.(string)
+		if _, ok := ev.segments[name]; !ok {
+			// both IN_SEGMENT and NOT_IN_SEGMENT fail for the missing segment
+			return false
+		}
+		if ev.inSegment(name, entity) != (filter.Operator == inSegment) {
+			return false
+		}
+	}
+	return ev.matchByFilters(attributeFilters, entity.Attributes)
+}
@@ -0,0 +1,158 @@
+package core
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegments(t *testing.T) {
+	employees := &Segment{
+		Name:    "employees",
+		Filters: []*FlagFilter{{AttributeName: "company", Operator: is, Value: "Acme", FilterType: filterTypeString}},
+		Include: []*Entity{{ID: "contractor", Type: "User"}},
+		Exclude: []*Entity{{ID: "intern", Type: "User"}},
+	}
+	segmentFilter := func(op Operator, name string) []*FlagFilter {
+		return []*FlagFilter{{Operator: op, Value: name}}
+	}
+	user := func(id, company string) *Entity {
+		return &Entity{ID: id, Type: "User", Attributes: Attributes{"company": company}}
+	}
+
+	t.Run("filters, include and exclude lists", func(t *testing.T) {
+		ev := &evaluator{log: log.Default(), segments: map[string]*Segment{"employees": employees}}
+		assert.True(t, ev.matchEntity(segmentFilter(inSegment, "employees"), user("1", "Acme")))
+		assert.False(t, ev.matchEntity(segmentFilter(inSegment, "employees"), user("2", "Globex")))
+		assert.True(t, ev.matchEntity(segmentFilter(inSegment, "employees"), user("contractor", "Globex")))
+		assert.False(t, ev.matchEntity(segmentFilter(inSegment, "employees"), user("intern", "Acme")))
+		assert.True(t, ev.matchEntity(segmentFilter(notInSegment, "employees"), user("intern", "Acme")))
+	})
+
+	t.Run("missing segment fails the filter", func(t *testing.T) {
+		ev := &evaluator{log: log.Default()}
+		assert.False(t, ev.matchEntity(segmentFilter(inSegment, "missing"), user("1", "Acme")))
+		assert.False(t, ev.matchEntity(segmentFilter(notInSegment, "missing"), user("1", "Acme")))
+	})
+
+	t.Run("segment without filters has only the included entities", func(t *testing.T) {
+		ev := &evaluator{log: log.Default(), segments: map[string]*Segment{"beta": {Name: "beta", Include: []*Entity{{ID: "1", Type: "User"}}}}}
+		assert.True(t, ev.matchEntity(segmentFilter(inSegment, "beta"), user("1", "Acme")))
+		assert.False(t, ev.matchEntity(segmentFilter(inSegment, "beta"), user("2", "Acme")))
+	})
+
+	t.Run("include and exclude lists are looked up in the sets after the escape", func(t *testing.T) {
+		segment := &Segment{
+			Name:    "beta",
+			Include: []*Entity{{ID: "1", Type: "user"}},
+			Exclude: []*Entity{{ID: "2", Type: "USER"}},
+			Filters: []*FlagFilter{{AttributeName: "company", Operator: is, Value: "Acme", FilterType: filterTypeString}},
+		}
+		check := func(t *testing.T) {
+			ev := &evaluator{log: log.Default(), segments: map[string]*Segment{"beta": segment}}
+			assert.True(t, ev.matchEntity(segmentFilter(inSegment, "beta"), user("1", "Globex")))
+			assert.False(t, ev.matchEntity(segmentFilter(inSegment, "beta"), user("2", "Acme")))
+			assert.True(t, ev.matchEntity(segmentFilter(inSegment, "beta"), user("3", "Acme")))
+		}
+		t.Run("lists are scanned before the escape", check)
+
+		segment.escape(log.Default())
+		assert.Len(t, segment.include, 1)
+		assert.Len(t, segment.exclude, 1)
+		t.Run("lists are looked up in the sets", check)
+	})
+
+	t.Run("segment is evaluated once per entity", func(t *testing.T) {
+		segment := &Segment{Name: "acme", Filters: []*FlagFilter{{AttributeName: "company", Operator: is, Value: "Acme", FilterType: filterTypeString}}}
+		ev := &evaluator{log: log.Default(), segments: map[string]*Segment{"acme": segment}}
+		assert.True(t, ev.matchEntity(segmentFilter(inSegment, "acme"), user("1", "Acme")))
+
+		segment.Filters[0].Value = "Globex"
+		assert.True(t, ev.matchEntity(segmentFilter(inSegment, "acme"), user("1", "Acme")))
+		assert.True(t, ev.matchEntity(segmentFilter(inSegment, "acme"), user("2", "Globex")))
+	})
+
+	t.Run("segments referencing each other", func(t *testing.T) {
+		ev := &evaluator{log: log.Default(), segments: map[string]*Segment{
+			"a":         {Name: "a", Filters: segmentFilter(inSegment, "b")},
+			"b":         {Name: "b", Filters: segmentFilter(inSegment, "a")},
+			"c":         {Name: "c", Filters: segmentFilter(inSegment, "employees")},
+			"employees": employees,
+		}}
+		assert.False(t, ev.matchEntity(segmentFilter(inSegment, "a"), user("1", "Acme")))
+		assert.True(t, ev.matchEntity(segmentFilter(inSegment, "c"), user("1", "Acme")))
+	})
+
+	t.Run("Core evaluates segments of the configuration", func(t *testing.T) {
+		core := NewCore()
+		core.SetConfig(&Configuration{
+			Segments: []*Segment{{
+				Name:    "employees",
+				Filters: []*FlagFilter{{AttributeName: "Company", Operator: is, Value: "Acme", FilterType: filterTypeString}},
+			}},
+			Flags: []*FlagConfig{{
+				Codename:   "dogfood",
+				Variations: []*FlagVariation{{Codename: "on", Probability: 1}},
+				FlagSubPopulations: []*FlagSubpopulation{{
+					EntityType:         "User",
+					SamplingPercentage: 1,
+					Filters:            []*FlagFilter{{Operator: inSegment, Value: "employees"}},
+				}},
+			}},
+		})
+		assert.True(t, core.EvaluateFlag("dogfood", &Entity{ID: "1", Type: "User", Attributes: Attributes{"company": "Acme"}}).Enabled)
+		assert.False(t, core.EvaluateFlag("dogfood", &Entity{ID: "1", Type: "User", Attributes: Attributes{"company": "Globex"}}).Enabled)
+	})
+
+	t.Run("NOT_IN_SEGMENT of the missing segment matches nobody", func(t *testing.T) {
+		core := NewCore()
+		core.SetConfig(&Configuration{
+			Flags: []*FlagConfig{{
+				Codename:   "public-launch",
+				Variations: []*FlagVariation{{Codename: "on", Probability: 1}},
+				FlagSubPopulations: []*FlagSubpopulation{{
+					EntityType:         "User",
+					SamplingPercentage: 1,
+					Filters:            []*FlagFilter{{Operator: notInSegment, Value: "employees"}},
+				}},
+			}},
+		})
+		result := core.EvaluateFlag("public-launch", &Entity{ID: "1", Type: "User"})
+		assert.False(t, result.Enabled)
+		assert.False(t, result.Sampled)
+	})
+}
+
+func TestConfiguration_checkSegments(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&logrus.JSONFormatter{})
+
+	configuration := &Configuration{
+		Segments: []*Segment{
+			{Name: "employees"},
+			{Name: "beta", Filters: []*FlagFilter{{Operator: notInSegment, Value: "churned"}}},
+		},
+		Flags: []*FlagConfig{{
+			Codename: "dogfood",
+			FlagSubPopulations: []*FlagSubpopulation{{
+				EntityType: "User",
+				Filters:    []*FlagFilter{{Operator: inSegment, Value: "employees"}, {Operator: inSegment, Value: "staff"}},
+			}},
+		}},
+	}
+	configuration.escape(log.NewLogrusLogger(l))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"codename":"dogfood"`)
+		assert.Contains(t, lines[0], `"segment":"staff"`)
+		assert.Contains(t, lines[1], `"referencedBy":"beta"`)
+		assert.Contains(t, lines[1], `"segment":"churned"`)
+	}
+}
@@ -1,9 +1,14 @@
 package core
 
 import (
+	"fmt"
+	"math"
+	"reflect"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/airdeploy/flagger-go/v3/json"
 	"github.com/airdeploy/flagger-go/v3/log"
 )
 
@@ -12,12 +17,108 @@ type Configuration struct {
 	HashKey   string        `json:"hashKey"`
 	Flags     []*FlagConfig `json:"flags"`
 	SdkConfig SDKConfig     `json:"sdkConfig,omitempty"`
+	// Layers make the flags mutually exclusive, see FlagConfig.Layer
+	Layers []*Layer `json:"layers,omitempty"`
+	// Holdout is excluded from all the experiments, nil means no holdout
+	Holdout *Holdout `json:"holdout,omitempty"`
+	// Segments are referenced by IN_SEGMENT and NOT_IN_SEGMENT filters
+	Segments []*Segment `json:"segments,omitempty"`
+	// IDLists are referenced by FlagFilter.ListRef
+	IDLists []*IDList `json:"idLists,omitempty"`
+
+	// Segments by name
+	segments map[string]*Segment
 }
 
-// Escape represent method for escaping configuration
+// Holdout is the share of entities of EntityType which get the default variation
+// of every flag tagged as experiment, see FlagConfig.Experiment
+type Holdout struct {
+	HashKey    string  `json:"hashkey"`
+	Percentage float64 `json:"percentage"` // in range [0, 1]
+	EntityType string  `json:"entityType"`
+}
+
+// contains reports whether the entity or its group of EntityType is in the holdout
+func (h *Holdout) contains(entity *Entity) bool {
+	switch {
+	case entity.Type == h.EntityType:
+		return holdoutHash(h.HashKey, entity.ID, entity.Type) < h.Percentage
+	case entity.Group != nil && entity.Group.Type == h.EntityType:
+		return holdoutHash(h.HashKey, entity.Group.ID, entity.Group.Type) < h.Percentage
+	}
+	return false
+}
+
+func holdoutHash(hashKey, id, Type string) float64 {
+	// never change this key!!!
+	key := hashKey + id + Type
+	return HashMD5(key)
+}
+
+// Layer partitions the hash space into Slots. The flags of the layer take disjoint slot ranges,
+// so an entity is sampled in at most one flag of the layer
+type Layer struct {
+	Name  string `json:"name"`
+	Slots int    `json:"slots"`
+	// BucketBy is the entity attribute hashed instead of the entity ID, see FlagConfig.BucketBy
+	BucketBy string `json:"bucketBy,omitempty"`
+}
+
+// LayerSlots is the range of the layer slots [From, To) taken by the flag
+type LayerSlots struct {
+	Layer string `json:"layer"`
+	From  int    `json:"from"`
+	To    int    `json:"to"`
+}
+
+// Escape represent method for escaping configuration, warnings are written to the default logger
 func (c *Configuration) Escape() {
+	c.escape(log.Default())
+}
+
+func (c *Configuration) escape(logger log.Logger) {
+	for _, l := range c.Layers {
+		l.BucketBy = strings.ToLower(l.BucketBy)
+	}
 	for _, f := range c.Flags {
-		f.escape()
+		f.escape(logger)
+	}
+	c.segments = make(map[string]*Segment, len(c.Segments))
+	for _, s := range c.Segments {
+		s.escape(logger)
+		c.segments[s.Name] = s
+	}
+	c.resolveIDLists(logger)
+	c.checkLayers(logger)
+	c.checkSegments(logger)
+}
+
+// checkLayers warns about the flags with missing layers, bad and overlapping slot ranges
+func (c *Configuration) checkLayers(logger log.Logger) {
+	layers := make(map[string]*Layer, len(c.Layers))
+	for _, l := range c.Layers {
+		layers[l.Name] = l
+	}
+	taken := make(map[string][]*FlagConfig) // by layer name
+	for _, f := range c.Flags {
+		if f.Layer == nil {
+			continue
+		}
+		layer, ok := layers[f.Layer.Layer]
+		if !ok {
+			logger.Warn("Flag layer is missing, the flag is never sampled", "codename", f.Codename, "layer", f.Layer.Layer)
+			continue
+		}
+		if f.Layer.From < 0 || f.Layer.From >= f.Layer.To || f.Layer.To > layer.Slots {
+			logger.Warn("Flag layer slots are out of range", "codename", f.Codename, "layer", layer.Name,
+				"from", f.Layer.From, "to", f.Layer.To, "slots", layer.Slots)
+		}
+		for _, other := range taken[layer.Name] {
+			if f.Layer.From < other.Layer.To && other.Layer.From < f.Layer.To {
+				logger.Warn("Flag layer slots overlap", "codename", f.Codename, "other", other.Codename, "layer", layer.Name)
+			}
+		}
+		taken[layer.Name] = append(taken[layer.Name], f)
 	}
 }
 
@@ -25,6 +126,10 @@ func (c *Configuration) Escape() {
 type SDKConfig struct {
 	SDKIngestionInterval int `json:"SDK_INGESTION_INTERVAL,omitempty"`
 	SDKIngestionMaxItems int `json:"SDK_INGESTION_MAX_CALLS,omitempty"`
+	// SDKExposureSampleRate is the share of exposures to ingest in range (0, 1], other values are ignored
+	SDKExposureSampleRate float64 `json:"SDK_EXPOSURE_SAMPLE_RATE,omitempty"`
+	// SDKExposureDedupWindow in seconds, the same exposure is ingested once within the window
+	SDKExposureDedupWindow int `json:"SDK_EXPOSURE_DEDUP_WINDOW,omitempty"`
 }
 
 // IngestionIntervalDuration converts seconds to time.Duration. Prevents interval less than 1
@@ -39,8 +144,10 @@ func (s *SDKConfig) IngestionIntervalDuration() time.Duration {
 // Copy return copy instance SDKConfig
 func (s *SDKConfig) Copy() *SDKConfig {
 	return &SDKConfig{
-		SDKIngestionInterval: s.SDKIngestionInterval,
-		SDKIngestionMaxItems: s.SDKIngestionMaxItems,
+		SDKIngestionInterval:   s.SDKIngestionInterval,
+		SDKIngestionMaxItems:   s.SDKIngestionMaxItems,
+		SDKExposureSampleRate:  s.SDKExposureSampleRate,
+		SDKExposureDedupWindow: s.SDKExposureDedupWindow,
 	}
 }
 
@@ -67,12 +174,101 @@ type FlagConfig struct {
 	FlagSubPopulations []*FlagSubpopulation `json:"subpopulations,omitempty"`
 	Blacklist          []*Entity            `json:"blacklist,omitempty"`
 	Whitelist          []*Entity            `json:"whitelist,omitempty"`
+	// BucketBy is the entity attribute hashed instead of the entity ID, e.g. a device ID
+	// which is the same before and after the login. The ID is used if the entity has no such attribute,
+	// such entities are sampled with IsSampledByIDFallback reason
+	BucketBy string `json:"bucketBy,omitempty"`
+	// Layer is the slots of Configuration.Layers the flag takes, nil means the flag is not in a layer.
+	// Only the entities(or groups) in the slots are sampled
+	Layer *LayerSlots `json:"layer,omitempty"`
+	// Experiment flags return the default variation to the entities in Configuration.Holdout
+	Experiment bool `json:"experiment,omitempty"`
+	// ActiveFrom and ActiveUntil are RFC3339 times the flag is active within [ActiveFrom, ActiveUntil),
+	// empty means no bound. The flag returns the default variation out of the window
+	ActiveFrom  string `json:"activeFrom,omitempty"`
+	ActiveUntil string `json:"activeUntil,omitempty"`
+
+	// parsed ActiveFrom and ActiveUntil, zero means no bound
+	activeFrom, activeUntil time.Time
+	// Blacklist and Whitelist by ID and type
+	blacklist, whitelist entitySet
+	// cumulative upper bounds of Variations in basis points if the weights are used,
+	// otherwise in probabilities up to 1. Both are nil until the escape
+	buckets []int
+	bounds  []float64
 }
 
-func (fc *FlagConfig) escape() {
+var (
+	// the flag with invalid ActiveFrom is never active
+	neverActive = time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC)
+	// the flag with invalid ActiveUntil is always expired
+	alwaysExpired = time.Unix(0, 0).UTC()
+)
+
+func (fc *FlagConfig) escape(logger log.Logger) {
+	fc.BucketBy = strings.ToLower(fc.BucketBy)
+	fc.activeFrom = parseSchedule(fc.ActiveFrom, neverActive, fc.Codename, "activeFrom", logger)
+	fc.activeUntil = parseSchedule(fc.ActiveUntil, alwaysExpired, fc.Codename, "activeUntil", logger)
+	fc.blacklist = newEntitySet(fc.Blacklist)
+	fc.whitelist = newEntitySet(fc.Whitelist)
+	fc.normalizeVariations(logger)
 	for _, fs := range fc.FlagSubPopulations {
-		fs.escape()
+		fs.escape(logger)
+	}
+}
+
+// blacklisted returns the blacklist entry of the entity with the ID and type, nil if there is no such entry
+func (fc *FlagConfig) blacklisted(id, Type string) *Entity {
+	return fc.blacklist.find(fc.Blacklist, id, Type)
+}
+
+// whitelisted returns the whitelist entry of the entity with the ID and type, nil if there is no such entry
+func (fc *FlagConfig) whitelisted(id, Type string) *Entity {
+	return fc.whitelist.find(fc.Whitelist, id, Type)
+}
+
+type entityKey struct {
+	id, Type string
+}
+
+// entitySet is the list of entities by ID and lowercase type, the first entry wins
+type entitySet map[entityKey]*Entity
+
+func newEntitySet(entities []*Entity) entitySet {
+	set := make(entitySet, len(entities))
+	for _, e := range entities {
+		key := entityKey{id: e.ID, Type: strings.ToLower(e.Type)}
+		if _, ok := set[key]; !ok {
+			set[key] = e
+		}
+	}
+	return set
+}
+
+// find looks up the entity in the set, the list is scanned if the set is not built yet
+func (s entitySet) find(list []*Entity, id, Type string) *Entity {
+	if s != nil {
+		return s[entityKey{id: id, Type: strings.ToLower(Type)}]
+	}
+	for _, e := range list {
+		if e.ID == id && strings.EqualFold(e.Type, Type) {
+			return e
+		}
 	}
+	return nil
+}
+
+// parseSchedule parses RFC3339 value, returns invalid if the value cannot be parsed
+func parseSchedule(value string, invalid time.Time, codename, field string, logger log.Logger) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		logger.Warn("Flag schedule is invalid, the flag is disabled", "codename", codename, field, value)
+		return invalid
+	}
+	return t
 }
 
 // Entity represent flagger entity
@@ -85,8 +281,13 @@ type Entity struct {
 	Attributes Attributes `json:"attributes,omitempty"`
 }
 
-// EscapeEntity creates a new entity with all fields escaped
+// EscapeEntity creates a new entity with all fields escaped.
+// The dropped attributes are not reported, see Core.EscapeEntity
 func EscapeEntity(e *Entity) *Entity {
+	return escapeEntity(e, nil)
+}
+
+func escapeEntity(e *Entity, dropped dropFunc) *Entity {
 	if e == nil {
 		return nil
 	}
@@ -105,7 +306,7 @@ func EscapeEntity(e *Entity) *Entity {
 	}
 
 	if e.Attributes != nil {
-		res.Attributes = escapeAttributes(e.Attributes)
+		res.Attributes = escapeAttributes(e.Attributes, dropped)
 	}
 
 	// propagate "name" and "id" to attributes if not exists
@@ -122,7 +323,7 @@ func EscapeEntity(e *Entity) *Entity {
 	}
 
 	if e.Group != nil {
-		res.Group = escapeGroup(e.Group)
+		res.Group = escapeGroup(e.Group, dropped)
 	}
 
 	return &res
@@ -130,7 +331,7 @@ func EscapeEntity(e *Entity) *Entity {
 
 // lower casing attributes keys and propagate name and id to attributes
 // returns pointer to new group
-func escapeGroup(g *Group) *Group {
+func escapeGroup(g *Group, dropped dropFunc) *Group {
 	res := Group{
 		ID:         g.ID,
 		Type:       g.Type,
@@ -144,7 +345,7 @@ func escapeGroup(g *Group) *Group {
 	}
 
 	// lowercase all attribute keys
-	res.Attributes = escapeAttributes(res.Attributes)
+	res.Attributes = escapeAttributes(res.Attributes, dropped)
 
 	// propagate "name" and "id" to attributes if not exists
 	if _, ok := res.Attributes["name"]; !ok && res.Name != "" {
@@ -172,31 +373,205 @@ type Group struct {
 	Attributes Attributes `json:"attributes,omitempty"`
 }
 
-// Attributes must be a flat map with values one of these values: string, int, float or bool.
-// escapeAttributes function satisfies this invariant
+// entity returns the group as entity for hashing
+func (g *Group) entity() *Entity {
+	return &Entity{ID: g.ID, Type: g.Type, Attributes: g.Attributes}
+}
+
+// Attributes must be a map with values one of these values: string, float64, bool or time.Time,
+// an array of them or nested Attributes. escapeAttributes function satisfies this invariant
 type Attributes map[string]interface{}
 
+// dropFunc reports the attribute or the event property which is dropped because of its type, nil reports nothing
+type dropFunc func(kind, name string, value interface{})
+
+// maxDroppedNames is the max number of the names kept by droppedNames
+const maxDroppedNames = 1000
+
+// droppedNames keeps the names of the dropped attributes and event properties to warn about each of them once.
+// It's cleared when maxDroppedNames is reached, so the warnings may repeat
+type droppedNames struct {
+	mux   sync.Mutex
+	names map[string]struct{}
+}
+
+// warner returns dropFunc which warns the logger about the names which are not reported yet
+func (d *droppedNames) warner(logger log.Logger) dropFunc {
+	return func(kind, name string, value interface{}) {
+		if d.add(kind + ":" + name) {
+			logger.Warn("Value type is not supported, the "+kind+" is dropped", kind, name, "type", fmt.Sprintf("%T", value))
+		}
+	}
+}
+
+// add returns false if the name is already added
+func (d *droppedNames) add(name string) bool {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if _, ok := d.names[name]; ok {
+		return false
+	}
+	if d.names == nil || len(d.names) >= maxDroppedNames {
+		d.names = make(map[string]struct{})
+	}
+	d.names[name] = struct{}{}
+	return true
+}
+
 // sets all keys to lowercase and filters out keys-value pairs with invalid value
-func escapeAttributes(attributes Attributes) Attributes {
+func escapeAttributes(attributes Attributes, dropped dropFunc) Attributes {
 	var res = make(Attributes)
 	for key, value := range attributes {
-		switch v := value.(type) {
-		case int:
-			res[strings.ToLower(key)] = float64(v)
-		case float32:
-			res[strings.ToLower(key)] = float64(v)
-		case bool, string, float64:
-			res[strings.ToLower(key)] = v
+		key = strings.ToLower(key)
+		if v, ok := escapeAttributeValue(value, dropped); ok {
+			res[key] = v
+		} else if dropped != nil {
+			dropped("attribute", key, value)
 		}
 	}
 	return res
 }
 
+// escapeAttributeValue converts all numbers to float64, arrays to []interface{} of scalars
+// and nested maps to escaped Attributes. time.Time is kept to be matched by DATE filters
+func escapeAttributeValue(value interface{}, dropped dropFunc) (interface{}, bool) {
+	switch v := value.(type) {
+	case bool, string, time.Time:
+		return v, true
+	case map[string]interface{}:
+		return escapeAttributes(v, dropped), true
+	case Attributes:
+		return escapeAttributes(v, dropped), true
+	case nil:
+		return nil, false
+	}
+	if f, ok := toFloat64(value); ok {
+		return f, true
+	}
+
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, false
+	}
+
+	res := make([]interface{}, 0, rv.Len())
+	for i := 0; i < rv.Len(); i++ {
+		v, ok := escapeAttributeValue(rv.Index(i).Interface(), dropped)
+		if !ok {
+			continue
+		}
+		switch v.(type) {
+		case bool, string, float64, time.Time:
+			res = append(res, v)
+		}
+	}
+	return res, true
+}
+
+// toFloat64 converts all numeric kinds and json.Number to float64
+func toFloat64(value interface{}) (float64, bool) {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		return f, err == nil
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
+
 // FlagVariation represent variation entity of Flag
 type FlagVariation struct {
 	Codename    string  `json:"codename"`
 	Probability float64 `json:"probability"`
 	Payload     Payload `json:"payload"`
+	// Weight in basis points, 10000 is 100%. The weights are used instead of the probabilities
+	// if any variation of the flag has the weight
+	Weight int `json:"weight,omitempty"`
+}
+
+// basisPoints is the total weight of the flag variations
+const basisPoints = 10000
+
+// normalizeVariations converts the weights of the variations into cumulative buckets in basis points
+// or the probabilities into cumulative bounds. The buckets not covered by the weights are left unassigned,
+// see NoVariationChosen, the weights over basisPoints are cut. The probabilities always cover all
+// the entities: they are rescaled if they don't sum to 1 and the last bound is 1
+func (fc *FlagConfig) normalizeVariations(logger log.Logger) {
+	useWeights := false
+	for _, v := range fc.Variations {
+		if v.Weight != 0 {
+			useWeights = true
+		}
+	}
+	if !useWeights {
+		fc.normalizeProbabilities(logger)
+		return
+	}
+
+	fc.buckets = make([]int, len(fc.Variations))
+	cumulative := 0
+	for i, v := range fc.Variations {
+		if v.Weight > 0 {
+			cumulative += v.Weight
+		}
+		fc.buckets[i] = cumulative
+	}
+
+	switch {
+	case cumulative == 0:
+		logger.Warn("Flag variation weights are zero, no variation is chosen", "codename", fc.Codename)
+	case cumulative > basisPoints:
+		logger.Warn("Flag variation weights exceed 100%, the last variations are cut", "codename", fc.Codename, "total", cumulative, "expected", basisPoints)
+		for i := range fc.buckets {
+			if fc.buckets[i] > basisPoints {
+				fc.buckets[i] = basisPoints
+			}
+		}
+	}
+}
+
+func (fc *FlagConfig) normalizeProbabilities(logger log.Logger) {
+	total := 0.0
+	last := -1
+	for i, v := range fc.Variations {
+		if v.Probability > 0 {
+			total += v.Probability
+			last = i
+		}
+	}
+
+	fc.bounds = make([]float64, len(fc.Variations))
+	if last < 0 {
+		if len(fc.Variations) != 0 {
+			logger.Warn("Flag variation probabilities are zero, no variation is chosen", "codename", fc.Codename)
+		}
+		return
+	}
+	scale := 1.0
+	if math.Abs(total-1) > 1e-9 {
+		logger.Warn("Flag variation probabilities don't sum to 1, they are rescaled", "codename", fc.Codename, "total", total)
+		scale = 1 / total
+	}
+
+	cumulative := 0.0
+	for i, v := range fc.Variations {
+		if v.Probability > 0 {
+			cumulative += v.Probability * scale
+		}
+		fc.bounds[i] = cumulative
+	}
+	// the float sum may stop short of 1 and leave the last hashes unassigned
+	fc.bounds[last] = 1
+	for i := last + 1; i < len(fc.bounds); i++ {
+		fc.bounds[i] = 1
+	}
 }
 
 // Payload represent Flag payload
@@ -207,15 +582,18 @@ type FlagSubpopulation struct {
 	EntityType         string        `json:"entityType"`
 	SamplingPercentage float64       `json:"samplingPercentage"`
 	Filters            []*FlagFilter `json:"filters"`
+	// BucketBy overrides FlagConfig.BucketBy for the subpopulation
+	BucketBy string `json:"bucketBy,omitempty"`
 }
 
-func (fs *FlagSubpopulation) escape() {
+func (fs *FlagSubpopulation) escape(logger log.Logger) {
+	fs.BucketBy = strings.ToLower(fs.BucketBy)
 	var result = make([]*FlagFilter, 0, len(fs.Filters))
 
 	// filter out empty Operators and EscapeEntity Filter
 	for _, filter := range fs.Filters {
 		if filter.Operator.isValid() {
-			filter.escape()
+			filter.escape(logger)
 			result = append(result, filter)
 		}
 	}
@@ -234,9 +612,17 @@ const (
 	gte   Operator = "GTE"
 	in    Operator = "IN"
 	notIn Operator = "NOT_IN"
+	// the list operators compare the elements of an array attribute with the filter values,
+	// a scalar attribute is a single element array
+	anyOf  Operator = "ANY_OF"
+	allOf  Operator = "ALL_OF"
+	noneOf Operator = "NONE_OF"
+	// the segment operators take the segment name as value, see Segment
+	inSegment    Operator = "IN_SEGMENT"
+	notInSegment Operator = "NOT_IN_SEGMENT"
 )
 
-var supportedOperators = []Operator{is, isNot, lt, lte, gt, gte, in, notIn}
+var supportedOperators = []Operator{is, isNot, lt, lte, gt, gte, in, notIn, anyOf, allOf, noneOf, inSegment, notInSegment}
 
 func (o Operator) isValid() bool {
 	for _, valid := range supportedOperators {
@@ -247,22 +633,41 @@ func (o Operator) isValid() bool {
 	return false
 }
 
+// hasList reports whether the filter value of the operator is an array
+func (o Operator) hasList() bool {
+	switch o {
+	case in, notIn, anyOf, allOf, noneOf:
+		return true
+	}
+	return false
+}
+
+// isSegment reports whether the operator matches the entity with a segment instead of an attribute
+func (o Operator) isSegment() bool {
+	return o == inSegment || o == notInSegment
+}
+
 // FlagFilter represent one flag filter entity
 type FlagFilter struct {
 	AttributeName string      `json:"attributeName"`
 	Operator      Operator    `json:"operator"`
 	Value         FilterValue `json:"value"`
 	FilterType    string      `json:"type"`
+	// ListRef is the name of Configuration.IDLists used as STRING values instead of Value
+	ListRef string `json:"listRef,omitempty"`
+
+	// set of the string values or the referenced ID list
+	values stringSet
 }
 
-func (ff *FlagFilter) escape() {
+func (ff *FlagFilter) escape(logger log.Logger) {
 	ff.AttributeName = strings.ToLower(ff.AttributeName)
 	if ff.FilterType == filterTypeDate {
 
 		if ss, ok := ff.Value.(string); ok {
 			ts, err := time.Parse(time.RFC3339, ss)
 			if err != nil {
-				log.Warnf("Cannot parse value \"%+v\" for attribute \"%+v\" as RFC3339(\"%+v\")", ff.Value, ff.AttributeName, time.RFC3339)
+				logger.Warn("Cannot parse filter value as RFC3339", "attribute", ff.AttributeName, "value", ff.Value, "layout", time.RFC3339)
 				return
 			}
 			ff.Value = ts
@@ -273,7 +678,7 @@ func (ff *FlagFilter) escape() {
 			for _, s := range ss {
 				ts, err := time.Parse(time.RFC3339, s)
 				if err != nil {
-					log.Warnf("Cannot parse value \"%+v\" for attribute \"%+v\" as RFC3339(\"%+v\")", ff.Value, ff.AttributeName, time.RFC3339)
+					logger.Warn("Cannot parse filter value as RFC3339", "attribute", ff.AttributeName, "value", ff.Value, "layout", time.RFC3339)
 					continue
 				}
 				tss = append(tss, ts)
@@ -283,7 +688,7 @@ func (ff *FlagFilter) escape() {
 	}
 
 	// fix json unmarshal array of strings into []interface{}
-	if ff.Operator == in || ff.Operator == notIn {
+	if ff.Operator.hasList() {
 		switch values := ff.Value.(type) {
 		case []interface{}:
 			if ff.FilterType == filterTypeString {
@@ -334,6 +739,11 @@ func (ff *FlagFilter) escape() {
 			}
 		}
 	}
+
+	// the string lists are compiled into sets once, the lists may be large
+	if ss, ok := ff.Value.([]string); ok && ff.values == nil {
+		ff.values = newStringSet(ss)
+	}
 }
 
 // FilterValue placeholder for one of these values: [ int | float | string | bool | []int, []float | []string | []bool ]
@@ -341,18 +751,104 @@ type FilterValue interface{}
 
 // Event represent flagger event
 type Event struct {
-	Name            string     `json:"name"`
+	Name string `json:"name"`
+	// EventProperties may contain nested maps and slices, they are sent as JSON
 	EventProperties Attributes `json:"eventProperties"`
 	Entity          *Entity    `json:"entity,omitempty"`
+	// Value is the numeric value of the event, e.g. revenue. Zero means no value
+	Value float64 `json:"value,omitempty"`
+	// Timestamp is the time the event happened, zero means the time of Track.
+	// Set it to backfill past events
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// AliasEventName is the name of the event which links the previous entity to the current one, see NewAliasEvent
+const AliasEventName = "$alias"
+
+// NewAliasEvent returns the event which tells Airship that the previous entity(e.g. anonymous visitor)
+// and the current one(e.g. logged-in user) are the same
+func NewAliasEvent(previous, current *Entity) *Event {
+	previousType := previous.Type
+	if previousType == "" {
+		previousType = "User"
+	}
+	return &Event{
+		Name: AliasEventName,
+		EventProperties: Attributes{
+			"previous_id":   previous.ID,
+			"previous_type": previousType,
+		},
+		Entity: current,
+	}
 }
 
-// EscapeEvent represent method for escaping event
+// EscapeEvent represent method for escaping event.
+// Unlike entity attributes the nested properties are kept as JSON values.
+// The dropped properties are not reported, see Core.EscapeEvent
 func EscapeEvent(event *Event) *Event {
+	return escapeEvent(event, nil)
+}
+
+func escapeEvent(event *Event, dropped dropFunc) *Event {
+	timestamp := event.Timestamp
+	if timestamp.IsZero() {
+		timestamp = time.Now()
+	}
 	return &Event{
 		Name:            event.Name,
-		EventProperties: escapeAttributes(event.EventProperties),
-		Entity:          EscapeEntity(event.Entity),
+		EventProperties: escapeEventProperties(event.EventProperties, dropped),
+		Entity:          escapeEntity(event.Entity, dropped),
+		Value:           event.Value,
+		Timestamp:       timestamp,
+	}
+}
+
+func escapeEventProperties(properties Attributes, dropped dropFunc) Attributes {
+	var res = make(Attributes)
+	for key, value := range properties {
+		key = strings.ToLower(key)
+		switch v := value.(type) {
+		case nil, bool, string:
+			res[key] = v
+			continue
+		}
+		if f, ok := toFloat64(value); ok {
+			res[key] = f
+			continue
+		}
+		// nested values are converted to JSON values, other types are dropped
+		if isNested(value) {
+			if jsonValue, ok := toJSONValue(value); ok {
+				res[key] = jsonValue
+				continue
+			}
+		}
+		if dropped != nil {
+			dropped("property", key, value)
+		}
+	}
+	return res
+}
+
+// isNested reports whether the value is a map, slice, array or struct(e.g. time.Time)
+func isNested(value interface{}) bool {
+	switch reflect.TypeOf(value).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return true
+	}
+	return false
+}
+
+func toJSONValue(value interface{}) (interface{}, bool) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return nil, false
+	}
+	var res interface{}
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, false
 	}
+	return res, true
 }
 
 // Exposure represent flagger exposure
@@ -363,4 +859,8 @@ type Exposure struct {
 	Entity       *Entity   `json:"entity"`
 	MethodCalled string    `json:"methodCalled"`
 	Timestamp    time.Time `json:"timestamp"`
+	// SamplingWeight is the number of exposures the ingested one stands for, 1/sample rate
+	SamplingWeight float64 `json:"samplingWeight,omitempty"`
+	// Holdout is true if the entity is in Configuration.Holdout
+	Holdout bool `json:"holdout,omitempty"`
 }
@@ -1,11 +1,16 @@
 package core
 
 import (
+	"bytes"
 	"github.com/airdeploy/flagger-go/v3/json"
+	"github.com/airdeploy/flagger-go/v3/log"
 	"math/rand"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -104,9 +109,9 @@ func TestEscapeGroup(t *testing.T) {
 			"AGE": 42,
 		},
 	}
-	escapedGroup := escapeGroup(&group)
+	escapedGroup := escapeGroup(&group, nil)
 	t.Run("Escape is idempotent", func(t *testing.T) {
-		escapedGroup = escapeGroup(&group)
+		escapedGroup = escapeGroup(&group, nil)
 
 		assert.Equal(t, 42, group.Attributes["AGE"])
 		assert.Equal(t, 42., escapedGroup.Attributes["age"])
@@ -142,7 +147,7 @@ func TestFilterOperator(t *testing.T) {
 				Value:         nil,
 			}},
 	}
-	flagSubPopulations.escape()
+	flagSubPopulations.escape(log.Default())
 
 	assert.Equal(t, 1, len(flagSubPopulations.Filters))
 	assert.Equal(t, Operator("IS"), flagSubPopulations.Filters[0].Operator)
@@ -157,9 +162,11 @@ func TestFlaggerConfigurationEscape(t *testing.T) {
 		HashKey: "123",
 		Flags: []*FlagConfig{{
 			Codename: "test",
+			BucketBy: "DeviceID",
 			FlagSubPopulations: []*FlagSubpopulation{{
 				EntityType:         "User",
 				SamplingPercentage: 0.3,
+				BucketBy:           "AccountID",
 				Filters: []*FlagFilter{
 					{
 						AttributeName: "TesTATTRiBUTe",
@@ -199,6 +206,8 @@ func TestFlaggerConfigurationEscape(t *testing.T) {
 
 	assert.Equal(t, "testattribute", configuration.Flags[0].FlagSubPopulations[0].Filters[0].AttributeName)
 	assert.Equal(t, 3, len(configuration.Flags[0].FlagSubPopulations[0].Filters))
+	assert.Equal(t, "deviceid", configuration.Flags[0].BucketBy)
+	assert.Equal(t, "accountid", configuration.Flags[0].FlagSubPopulations[0].BucketBy)
 
 	filters := configuration.Flags[0].FlagSubPopulations[0].Filters
 	for i := 0; i < len(filters); i++ {
@@ -208,29 +217,118 @@ func TestFlaggerConfigurationEscape(t *testing.T) {
 	}
 }
 
+func TestConfiguration_checkLayers(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&logrus.JSONFormatter{})
+
+	configuration := &Configuration{
+		Layers: []*Layer{{Name: "checkout", Slots: 100, BucketBy: "DeviceID"}},
+		Flags: []*FlagConfig{
+			{Codename: "first", Layer: &LayerSlots{Layer: "checkout", From: 0, To: 50}},
+			{Codename: "second", Layer: &LayerSlots{Layer: "checkout", From: 50, To: 100}},
+			{Codename: "overlapping", Layer: &LayerSlots{Layer: "checkout", From: 40, To: 60}},
+			{Codename: "out-of-range", Layer: &LayerSlots{Layer: "checkout", From: 100, To: 120}},
+			{Codename: "missing", Layer: &LayerSlots{Layer: "search", From: 0, To: 10}},
+			{Codename: "no-layer"},
+		},
+	}
+	configuration.escape(log.NewLogrusLogger(l))
+	assert.Equal(t, "deviceid", configuration.Layers[0].BucketBy)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 4) {
+		assert.Contains(t, lines[0], `"msg":"Flag layer slots overlap","other":"first"`)
+		assert.Contains(t, lines[1], `"msg":"Flag layer slots overlap","other":"second"`)
+		assert.Contains(t, lines[2], `"codename":"out-of-range"`)
+		assert.Contains(t, lines[3], `"codename":"missing"`)
+	}
+}
+
 func TestEscapeAttributes(t *testing.T) {
 	t.Run("test key is in lowercase", func(t *testing.T) {
-		assert.Equal(t, escapeAttributes(Attributes{"KEY": "CorrectStringValue"}), Attributes{"key": "CorrectStringValue"})
+		assert.Equal(t, escapeAttributes(Attributes{"KEY": "CorrectStringValue"}, nil), Attributes{"key": "CorrectStringValue"})
 	})
 
 	t.Run("test type of the value is string", func(t *testing.T) {
-		assert.Equal(t, escapeAttributes(Attributes{"KEY": "CorrectStringValue"}), Attributes{"key": "CorrectStringValue"})
+		assert.Equal(t, escapeAttributes(Attributes{"KEY": "CorrectStringValue"}, nil), Attributes{"key": "CorrectStringValue"})
 	})
 
 	t.Run("test type of the value is bool", func(t *testing.T) {
-		assert.Equal(t, escapeAttributes(Attributes{"KEY": true}), Attributes{"key": true})
+		assert.Equal(t, escapeAttributes(Attributes{"KEY": true}, nil), Attributes{"key": true})
 	})
 
 	t.Run("int is converted to float64 because of json unmarshalling", func(t *testing.T) {
-		assert.Equal(t, escapeAttributes(Attributes{"KEY": 123456789}), Attributes{"key": 123456789.})
+		assert.Equal(t, escapeAttributes(Attributes{"KEY": 123456789}, nil), Attributes{"key": 123456789.})
 	})
 
 	t.Run("test type of the value is float", func(t *testing.T) {
-		assert.Equal(t, escapeAttributes(Attributes{"KEY": 23.0}), Attributes{"key": 23.0})
+		assert.Equal(t, escapeAttributes(Attributes{"KEY": 23.0}, nil), Attributes{"key": 23.0})
 	})
 
 	t.Run("test type of the value is incorrect", func(t *testing.T) {
-		assert.Equal(t, escapeAttributes(Attributes{"KEY": map[string]string{"key": "value"}}), Attributes{})
+		assert.Equal(t, escapeAttributes(Attributes{"KEY": map[string]string{"key": "value"}}, nil), Attributes{})
+	})
+
+	t.Run("arrays keep the scalar elements", func(t *testing.T) {
+		assert.Equal(t, Attributes{"key": []interface{}{1., "a", true}}, escapeAttributes(Attributes{"KEY": []interface{}{1, "a", true, struct{}{}, []int{2}}}, nil))
+		assert.Equal(t, Attributes{"key": []interface{}{1., 2.}}, escapeAttributes(Attributes{"KEY": []int{1, 2}}, nil))
+	})
+
+	t.Run("nested attributes are escaped", func(t *testing.T) {
+		assert.Equal(t,
+			Attributes{"address": Attributes{"city": "Paris", "geo": Attributes{"zip": 75001.}}},
+			escapeAttributes(Attributes{"Address": map[string]interface{}{"City": "Paris", "Geo": Attributes{"ZIP": 75001, "bad": struct{}{}}}}, nil),
+		)
+	})
+
+	t.Run("all numeric kinds and json.Number are float64", func(t *testing.T) {
+		assert.Equal(t,
+			Attributes{"int64": 1., "int32": 2., "uint": 3., "uint8": 4., "float32": 5.5, "number": 6.5},
+			escapeAttributes(Attributes{"int64": int64(1), "int32": int32(2), "uint": uint(3), "uint8": uint8(4), "float32": float32(5.5), "number": json.Number("6.5")}, nil),
+		)
+		assert.Equal(t, Attributes{}, escapeAttributes(Attributes{"number": json.Number("forty-two")}, nil))
+	})
+
+	t.Run("time.Time is kept as date", func(t *testing.T) {
+		createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		assert.Equal(t, Attributes{"createdat": createdAt}, escapeAttributes(Attributes{"createdAt": createdAt}, nil))
+	})
+
+	t.Run("dropped attributes are reported", func(t *testing.T) {
+		var dropped []string
+		escapeAttributes(Attributes{"Unsupported-Channel": make(chan int), "nested": Attributes{"Bad": struct{}{}}}, func(kind, name string, value interface{}) {
+			dropped = append(dropped, kind+":"+name)
+		})
+		assert.ElementsMatch(t, []string{"attribute:unsupported-channel", "attribute:bad"}, dropped)
+	})
+}
+
+func TestDroppedNames(t *testing.T) {
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&logrus.JSONFormatter{})
+
+	var names droppedNames
+	warn := names.warner(log.NewLogrusLogger(l))
+	warn("attribute", "channel", make(chan int))
+	warn("attribute", "channel", make(chan int))
+	warn("property", "channel", make(chan int))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"attribute":"channel"`)
+		assert.Contains(t, lines[1], `"property":"channel"`)
+	}
+
+	t.Run("the names are bounded", func(t *testing.T) {
+		var names droppedNames
+		for i := 0; i < maxDroppedNames*2; i++ {
+			assert.True(t, names.add(strconv.Itoa(i)))
+		}
+		assert.True(t, len(names.names) <= maxDroppedNames)
 	})
 }
 
@@ -243,7 +341,7 @@ func TestFlagFilterEscape(t *testing.T) {
 			Value:         value,
 			FilterType:    filterTypeDate,
 		}
-		filter.escape()
+		filter.escape(log.Default())
 
 		assert.Equal(t, value, filter.Value)
 	})
@@ -256,7 +354,7 @@ func TestFlagFilterEscape(t *testing.T) {
 			Value:         value,
 			FilterType:    filterTypeDate,
 		}
-		filter.escape()
+		filter.escape(log.Default())
 
 		assert.Equal(t, []time.Time{
 			time.Date(2016, 3, 16, 5, 44, 23, 0, time.UTC),
@@ -271,7 +369,7 @@ func TestFlagFilterEscape(t *testing.T) {
 			Value:         createdAt,
 			FilterType:    filterTypeDate,
 		}
-		filter.escape()
+		filter.escape(log.Default())
 
 		assert.Equal(t, time.Date(2016, 03, 16, 5, 44, 23, 0, time.UTC), filter.Value)
 	})
@@ -284,7 +382,7 @@ func TestFlagFilterEscape(t *testing.T) {
 			Value:         createdAt,
 			FilterType:    filterTypeDate,
 		}
-		filter.escape()
+		filter.escape(log.Default())
 
 		assert.Equal(t, []time.Time{
 			time.Date(2016, 3, 16, 5, 44, 23, 0, time.UTC),
@@ -305,7 +403,7 @@ func TestFlagFilterEscape(t *testing.T) {
 			if err != nil {
 				assert.Fail(t, err.Error())
 			}
-			filter.escape()
+			filter.escape(log.Default())
 			assert.Equal(t, []string{"FR", "AT"}, filter.Value)
 		})
 
@@ -322,7 +420,7 @@ func TestFlagFilterEscape(t *testing.T) {
 			if err != nil {
 				assert.Fail(t, err.Error())
 			}
-			filter.escape()
+			filter.escape(log.Default())
 			assert.Equal(t, []float64{21, 42, 52.1}, filter.Value)
 		})
 
@@ -339,7 +437,7 @@ func TestFlagFilterEscape(t *testing.T) {
 			if err != nil {
 				assert.Fail(t, err.Error())
 			}
-			filter.escape()
+			filter.escape(log.Default())
 			assert.Equal(t, []bool{true, false}, filter.Value)
 		})
 
@@ -356,7 +454,7 @@ func TestFlagFilterEscape(t *testing.T) {
 			if err != nil {
 				assert.Fail(t, err.Error())
 			}
-			filter.escape()
+			filter.escape(log.Default())
 			assert.Equal(t, []time.Time{time.Date(2016, 3, 16, 5, 44, 23, 0, time.UTC)}, filter.Value)
 		})
 	})
@@ -376,13 +474,14 @@ func TestSDKConfig(t *testing.T) {
 
 	t.Run("Copy creates deep copy", func(t *testing.T) {
 		config := SDKConfig{
-			SDKIngestionInterval: 60,
-			SDKIngestionMaxItems: 500,
+			SDKIngestionInterval:   60,
+			SDKIngestionMaxItems:   500,
+			SDKExposureSampleRate:  0.5,
+			SDKExposureDedupWindow: 60,
 		}
 		configCopy := config.Copy()
 
-		assert.Equal(t, config.SDKIngestionInterval, configCopy.SDKIngestionInterval)
-		assert.Equal(t, config.SDKIngestionMaxItems, configCopy.SDKIngestionMaxItems)
+		assert.Equal(t, config, *configCopy)
 
 		config.SDKIngestionMaxItems = 100
 
@@ -407,13 +506,24 @@ func TestSDKInfo_Copy(t *testing.T) {
 	})
 }
 
+func TestNewAliasEvent(t *testing.T) {
+	current := &Entity{ID: "user-1"}
+	event := NewAliasEvent(&Entity{ID: "cookie-1"}, current)
+	assert.Equal(t, AliasEventName, event.Name)
+	assert.Equal(t, Attributes{"previous_id": "cookie-1", "previous_type": "User"}, event.EventProperties)
+	assert.Equal(t, current, event.Entity)
+
+	event = NewAliasEvent(&Entity{ID: "visitor-1", Type: "Visitor"}, current)
+	assert.Equal(t, "Visitor", event.EventProperties["previous_type"])
+}
+
 func TestEscapeEvent(t *testing.T) {
 	t.Run("EscapeEvent escapes both entity and attributes", func(t *testing.T) {
 		event := EscapeEvent(&Event{
 			Name: "test",
 			EventProperties: Attributes{
 				"KEY":            "SomeStringValue",
-				"wrongValueTYpe": uint(1),
+				"wrongValueTYpe": make(chan int),
 			},
 			Entity: &Entity{
 				ID: "1",
@@ -426,4 +536,66 @@ func TestEscapeEvent(t *testing.T) {
 		assert.Equal(t, "1", event.Entity.ID)
 		assert.Equal(t, "1", event.Entity.Attributes["id"])
 	})
+
+	t.Run("dropped properties are reported", func(t *testing.T) {
+		var dropped []string
+		escapeEvent(&Event{
+			Name:            "purchase",
+			EventProperties: Attributes{"Channel": make(chan int), "number": json.Number("forty-two"), "plan": "Bronze"},
+			Entity:          &Entity{ID: "1", Attributes: Attributes{"Bad": struct{}{}}},
+		}, func(kind, name string, value interface{}) {
+			dropped = append(dropped, kind+":"+name)
+		})
+		assert.ElementsMatch(t, []string{"property:channel", "property:number", "attribute:bad"}, dropped)
+	})
+
+	t.Run("all numeric kinds and json.Number are float64", func(t *testing.T) {
+		event := EscapeEvent(&Event{
+			Name: "purchase",
+			EventProperties: Attributes{
+				"int64": int64(1), "int32": int32(2), "uint": uint(3), "uint8": uint8(4),
+				"float32": float32(5.5), "number": json.Number("6.5"), "broken": json.Number("forty-two"),
+			},
+		})
+		assert.Equal(t, Attributes{"int64": 1., "int32": 2., "uint": 3., "uint8": 4., "float32": 5.5, "number": 6.5}, event.EventProperties)
+	})
+
+	t.Run("nested properties are kept as JSON values", func(t *testing.T) {
+		timestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		event := EscapeEvent(&Event{
+			Name: "purchase",
+			EventProperties: Attributes{
+				"Cart": map[string]interface{}{
+					"Items": []string{"a", "b"},
+					"total": 10,
+				},
+				"sizes":   []int{1, 2},
+				"paidAt":  timestamp,
+				"address": struct{ City string }{City: "Paris"},
+				"channel": make(chan int),
+			},
+		})
+
+		assert.Equal(t, map[string]interface{}{
+			"Items": []interface{}{"a", "b"},
+			"total": 10.0,
+		}, event.EventProperties["cart"])
+		assert.Equal(t, []interface{}{1.0, 2.0}, event.EventProperties["sizes"])
+		assert.Equal(t, "2020-01-02T03:04:05Z", event.EventProperties["paidat"])
+		assert.Equal(t, map[string]interface{}{"City": "Paris"}, event.EventProperties["address"])
+		_, ok := event.EventProperties["channel"]
+		assert.False(t, ok)
+	})
+
+	t.Run("value and timestamp", func(t *testing.T) {
+		timestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		event := EscapeEvent(&Event{Name: "purchase", Value: 9.99, Timestamp: timestamp})
+		assert.Equal(t, 9.99, event.Value)
+		assert.Equal(t, timestamp, event.Timestamp)
+
+		before := time.Now()
+		event = EscapeEvent(&Event{Name: "purchase"})
+		assert.False(t, event.Timestamp.Before(before))
+		assert.NotNil(t, event.EventProperties)
+	})
 }
@@ -0,0 +1,47 @@
+package core
+
+import (
+	"strings"
+	"time"
+)
+
+// Virtual attributes are resolved at evaluation time, the entity attributes with the same names are ignored.
+// The names are lowercase because the attribute names of the filters are case insensitive
+const (
+	// VirtualNow is the current time as RFC3339 date string, use it with DATE filters
+	VirtualNow = "$now"
+	// VirtualWeekday is the current weekday in the timezone of Core, e.g. "Saturday"
+	VirtualWeekday = "$weekday"
+	// VirtualHour is the current hour in range [0, 23] in the timezone of Core
+	VirtualHour = "$hour"
+	// VirtualSDKVersion is the version of the SDK, see Core.SetSDKVersion
+	VirtualSDKVersion = "$sdkversion"
+)
+
+// virtualAttributes returns the attributes resolved at the current time
+func (ev *evaluator) virtualAttributes() Attributes {
+	location := ev.location
+	if location == nil {
+		location = time.UTC
+	}
+	now := ev.clock().In(location)
+	return Attributes{
+		VirtualNow:        now.Format(time.RFC3339),
+		VirtualWeekday:    now.Weekday().String(),
+		VirtualHour:       float64(now.Hour()),
+		VirtualSDKVersion: ev.sdkVersion,
+	}
+}
+
+// withVirtualAttributes adds the virtual attributes to the escaped attributes if any filter uses them
+func (ev *evaluator) withVirtualAttributes(filters []*FlagFilter, attributes Attributes) Attributes {
+	for _, filter := range filters {
+		if strings.HasPrefix(filter.AttributeName, "$") {
+			for name, value := range ev.virtualAttributes() {
+				attributes[name] = value
+			}
+			return attributes
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualAttributes(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	// Friday 20:00 in UTC is Saturday 05:00 in Tokyo
+	friday := time.Date(2021, 3, 5, 20, 0, 0, 0, time.UTC)
+	newEvaluator := func(location *time.Location) *evaluator {
+		return &evaluator{
+			log:        log.Default(),
+			now:        func() time.Time { return friday },
+			location:   location,
+			sdkVersion: "3.1.0",
+		}
+	}
+	weekend := []*FlagFilter{{
+		AttributeName: "$weekday",
+		Operator:      in,
+		Value:         []interface{}{"Saturday", "Sunday"},
+		FilterType:    filterTypeString,
+	}}
+
+	t.Run("weekday in the timezone", func(t *testing.T) {
+		assert.False(t, newEvaluator(nil).matchEscapedFilters(weekend, Attributes{}))
+		assert.True(t, newEvaluator(tokyo).matchEscapedFilters(weekend, Attributes{}))
+	})
+
+	t.Run("hour in the timezone", func(t *testing.T) {
+		morning := []*FlagFilter{{AttributeName: "$hour", Operator: lt, Value: 9.0, FilterType: filterTypeNumber}}
+		assert.False(t, newEvaluator(nil).matchEscapedFilters(morning, Attributes{}))
+		assert.True(t, newEvaluator(tokyo).matchEscapedFilters(morning, Attributes{}))
+	})
+
+	t.Run("now is compared as date", func(t *testing.T) {
+		launched := []*FlagFilter{{AttributeName: "$now", Operator: gte, Value: "2021-03-06T06:00:00+09:00", FilterType: filterTypeDate}}
+		assert.False(t, newEvaluator(nil).matchEscapedFilters(launched, Attributes{}))
+
+		ev := newEvaluator(nil)
+		ev.now = func() time.Time { return friday.Add(time.Hour) }
+		assert.True(t, ev.matchEscapedFilters(launched, Attributes{}))
+	})
+
+	t.Run("SDK version, the name is case insensitive", func(t *testing.T) {
+		filters := []*FlagFilter{{AttributeName: "$sdkVersion", Operator: is, Value: "3.1.0", FilterType: filterTypeString}}
+		assert.True(t, newEvaluator(nil).matchEscapedFilters(filters, Attributes{}))
+	})
+
+	t.Run("entity attributes cannot override virtual ones", func(t *testing.T) {
+		attributes := Attributes{"$weekday": "Sunday", "$WEEKDAY": "Sunday", "country": "France"}
+		assert.False(t, newEvaluator(nil).matchEscapedFilters(weekend, attributes))
+		// the attributes of the caller are not modified
+		assert.Equal(t, Attributes{"$weekday": "Sunday", "$WEEKDAY": "Sunday", "country": "France"}, attributes)
+	})
+
+	t.Run("virtual attributes are combined with the entity ones", func(t *testing.T) {
+		filters := append([]*FlagFilter{{AttributeName: "country", Operator: is, Value: "France", FilterType: filterTypeString}}, weekend...)
+		assert.True(t, newEvaluator(tokyo).matchEscapedFilters(filters, Attributes{"country": "France"}))
+		assert.False(t, newEvaluator(tokyo).matchEscapedFilters(filters, Attributes{"country": "Spain"}))
+	})
+
+	t.Run("Core resolves the attributes", func(t *testing.T) {
+		core := NewCore()
+		core.SetClock(func() time.Time { return friday })
+		core.SetTimezone(tokyo)
+		core.SetSDKVersion("3.1.0")
+		core.SetConfig(&Configuration{Flags: []*FlagConfig{{
+			Codename:           "weekend-banner",
+			Variations:         []*FlagVariation{{Codename: "on", Probability: 1}},
+			FlagSubPopulations: []*FlagSubpopulation{{EntityType: "User", SamplingPercentage: 1, Filters: weekend}},
+		}}})
+		assert.True(t, core.EvaluateFlag("weekend-banner", &Entity{ID: "1", Type: "User", Attributes: Attributes{}}).Enabled)
+
+		core.SetTimezone(nil)
+		assert.False(t, core.EvaluateFlag("weekend-banner", &Entity{ID: "1", Type: "User", Attributes: Attributes{}}).Enabled)
+	})
+}
@@ -1,6 +1,7 @@
 package flagger
 
 import (
+	"context"
 	"github.com/airdeploy/flagger-go/v3/internal/httputils"
 	"net/http"
 	"os"
@@ -21,29 +22,49 @@ var _ interface {
 	Init(args *InitArgs) error
 	Publish(entity *core.Entity)
 	Track(event *core.Event)
+	Alias(previous, current *core.Entity)
 	SetEntity(entity *core.Entity)
+	Status() HealthStatus
+	Flush(ctx context.Context) error
 	IsEnabled(codename string, entity *core.Entity) bool
 	IsSampled(codename string, entity *core.Entity) bool
 	GetVariation(codename string, entity *core.Entity) string
 	GetPayload(codename string, entity *core.Entity) core.Payload
 } = new(Flagger)
 
-// NewFlagger return the new instance Flagger
-func NewFlagger() *Flagger {
+// NewFlagger return the new instance Flagger.
+// Every instance has its own http client, logger, SDKInfo and default URLs, see Option
+func NewFlagger(opts ...Option) *Flagger {
+	o := newOptions(opts...)
+	logger := newInstanceLogger(o.logger)
+	o.logger = logger
+
+	c := core.NewCore()
+	c.SetLogger(logger)
+	c.SetAssignmentStore(o.assignments)
+	c.SetClock(o.clock)
+	c.SetTimezone(o.timezone)
+	c.SetSDKVersion(o.sdkInfo.Version)
 	return &Flagger{
-		rt:   http.DefaultTransport,
-		core: core.NewCore(),
+		opts: o,
+		core: c,
+		log:  logger,
 	}
 }
 
 // Flagger represent flagger client implementation
 type Flagger struct {
-	rt       http.RoundTripper
+	opts     *options // readonly
 	core     *core.Core
 	ingester *ingester.Ingester
 	sse      *sse.Client
+	log      *instanceLogger
+	spool    *ingester.Spool // opened by the first newIngester, see WithIngestionSpool
+	config   configState
 	mux      sync.RWMutex
 	enabled  bool
+
+	cancelWatch context.CancelFunc // stops watchConfigAge
 }
 
 // InitArgs represent init arguments for Flagger
@@ -53,15 +74,36 @@ type InitArgs struct {
 	BackupSourceURL string
 	IngestionURL    string
 	SSEURL          string
-	LogLevel        string
+	LogLevel        string   // applies to the default logger of the instance only
+	AuthMode        AuthMode // AuthModePath if empty
+}
+
+// SetLogger sets the structured logger used by this Flagger instance and its components.
+// Passing nil restores the default logrus based logger of the instance.
+func (flagger *Flagger) SetLogger(logger log.Logger) {
+	if logger == nil {
+		logger = log.NewLogrusLogger(flagger.opts.logrus)
+	}
+	flagger.log.set(logger)
+}
+
+func (flagger *Flagger) logger() log.Logger {
+	return flagger.log
 }
 
 // Init gets FlaggerConfiguration, establishes and maintains SSE connections and initialize Ingester
 func (flagger *Flagger) Init(args *InitArgs) error {
-	args, err := prepareInitArgs(args, SDKInfo)
+	logger := flagger.logger()
+	args, err := prepareInitArgs(args, flagger.opts)
 	if err != nil {
 		return err
 	}
+	flagger.log.setAPIKey(args.APIKey)
+
+	opts := flagger.opts
+	if args.AuthMode == AuthModeHeader {
+		opts = opts.withHeaders(http.Header{"Authorization": []string{"Bearer " + args.APIKey}})
+	}
 
 	flagger.Shutdown(1 * time.Second)
 
@@ -69,43 +111,110 @@ func (flagger *Flagger) Init(args *InitArgs) error {
 	defer flagger.mux.Unlock()
 
 	// Ingester
-	flagger.ingester = ingester.NewIngester(SDKInfo, firstExposuresIngestThreshold)
+	flagger.ingester = flagger.newIngester(opts)
 
 	// get configuration from SourceURL/BackupSourceURL
-	var configuration *core.Configuration
-	err = httputils.GetConfiguration(flagger.rt, args.SourceURL, defaultAttemptsConnection, &configuration)
+	rt := opts.configRoundTripper()
+	configuration, source, err := flagger.fetchConfiguration(rt, args)
 	if err != nil {
-		log.Warnf("Unable to fetch FlaggerConfiguration from SourceURL")
-		err := httputils.GetConfiguration(flagger.rt, args.BackupSourceURL, defaultAttemptsConnection, &configuration)
-		if err != nil {
-			log.Warnf("Unable to fetch FlaggerConfiguration from BackupSourceURL")
-			return err
-		}
-		bytes, _ := json.Marshal(configuration)
-		log.Debugf("init flagger from BackupSourceURL was success: %+v", string(bytes))
-	} else {
-		bytes, _ := json.Marshal(configuration)
-		log.Debugf("init flagger from SourceURL was success: %+v", string(bytes))
+		// the URLs of the path auth mode contain the API key
+		return flagger.log.redactError(err)
 	}
 
 	flagger.enabled = true
 
 	// init returns err if flagger fails to get the configuration
 	flagger.core.SetConfig(configuration)
+	flagger.config.set(source)
 
 	flagger.ingester.Activate(args.IngestionURL, &configuration.SdkConfig)
 	flagger.ingester.SendEmptyIngestion()
 
-	// SSE
-	flagger.sse = sse.NewClient(func(v *core.Configuration) {
+	updateConfig := func(v *core.Configuration, source ConfigSource) {
 		flagger.core.SetConfig(v)
+		flagger.config.set(source)
 		flagger.ingester.Shutdown(time.Second)
 		flagger.ingester.Activate(args.IngestionURL, &v.SdkConfig)
-	})
+	}
+
+	// SSE
+	flagger.sse = sse.NewClient(func(v *core.Configuration) {
+		updateConfig(v, ConfigSourceSSE)
+	}, opts.sseRoundTripper())
+	flagger.sse.SetLogger(logger)
 	flagger.sse.SetURL(args.SSEURL)
+
+	// stale configuration
+	if flagger.opts.maxConfigAge > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		flagger.cancelWatch = cancel
+		go flagger.watchConfigAge(ctx, func(ctx context.Context) error {
+			v, source, err := flagger.fetchConfiguration(rt, args)
+			if err != nil {
+				return err
+			}
+			// prevents updating the configuration after Shutdown
+			flagger.mux.RLock()
+			defer flagger.mux.RUnlock()
+			if ctx.Err() == nil {
+				updateConfig(v, source)
+			}
+			return nil
+		})
+	}
 	return nil
 }
 
+// fetchConfiguration gets configuration from SourceURL, falls back to BackupSourceURL
+func (flagger *Flagger) fetchConfiguration(rt http.RoundTripper, args *InitArgs) (*core.Configuration, ConfigSource, error) {
+	logger := flagger.logger()
+	var configuration *core.Configuration
+	err := httputils.GetConfiguration(rt, args.SourceURL, defaultAttemptsConnection, &configuration)
+	if err == nil {
+		bytes, _ := json.Marshal(configuration)
+		logger.Debug("init flagger from SourceURL was success", "configuration", string(bytes))
+		return configuration, ConfigSourceURL, nil
+	}
+	logger.Warn("Unable to fetch FlaggerConfiguration from SourceURL", "error", err)
+
+	err = httputils.GetConfiguration(rt, args.BackupSourceURL, defaultAttemptsConnection, &configuration)
+	if err != nil {
+		logger.Warn("Unable to fetch FlaggerConfiguration from BackupSourceURL", "error", err)
+		return nil, "", err
+	}
+	bytes, _ := json.Marshal(configuration)
+	logger.Debug("init flagger from BackupSourceURL was success", "configuration", string(bytes))
+	return configuration, ConfigSourceBackupURL, nil
+}
+
+// not thread safe
+func (flagger *Flagger) newIngester(opts *options) *ingester.Ingester {
+	i := ingester.NewIngester(opts.sdkInfo, firstExposuresIngestThreshold, opts.ingestionClient())
+	i.SetLogger(flagger.log)
+	if opts.dropHandler != nil {
+		i.SetDropHandler(opts.dropHandler)
+	}
+	i.SetExposureSampling(opts.exposureRate, opts.exposureWindow)
+	i.SetExposureAggregation(opts.aggregate)
+	i.SetAirshipIngestion(!opts.noAirship)
+	i.SetBuffer(opts.bufferSize, opts.overflow, opts.blockTimeout)
+	for _, sink := range opts.sinks {
+		i.AddSink(sink.sink, sink.opts)
+	}
+
+	if opts.spoolDir != "" && flagger.spool == nil {
+		spool, err := ingester.OpenSpool(opts.spoolDir, opts.spoolMaxSize, flagger.log)
+		if err != nil {
+			flagger.logger().Error("Cannot open ingestion spool, failed data is kept in memory", "dir", opts.spoolDir, "error", err)
+		}
+		flagger.spool = spool
+	}
+	if flagger.spool != nil {
+		i.SetSpool(flagger.spool)
+	}
+	return i
+}
+
 func (flagger *Flagger) silentInit() (res bool) {
 	apiKey := os.Getenv(FlaggerAPIKey)
 	sourceURL := os.Getenv(FlaggerSourceURL)
@@ -113,17 +222,20 @@ func (flagger *Flagger) silentInit() (res bool) {
 	ingestionURL := os.Getenv(FlaggerIngestionURL)
 	sseURL := os.Getenv(FlaggerSSEUrl)
 	logLevel := os.Getenv(FlaggerLogLevel)
-	log.Debugf("Trying to initialise flagger using environment variables, "+
-		"FLAGGER_API_KEY: '%s', "+
-		"FLAGGER_SOURCE_URL: '%s', "+
-		"FLAGGER_BACKUP_SOURCE_URL: '%s', "+
-		"FLAGGER_INGESTION_URL: '%s', "+
-		"FLAGGER_SSE_URL: '%s', "+
-		"FLAGGER_LOG_LEVEL: '%s'", apiKey, sourceURL, backupSourceURL, ingestionURL, sseURL, logLevel)
+	authMode := os.Getenv(FlaggerAuthMode)
+	logger := flagger.logger()
+	logger.Debug("Trying to initialise flagger using environment variables",
+		FlaggerAPIKey, redactAPIKey(apiKey),
+		FlaggerSourceURL, sourceURL,
+		FlaggerBackupSourceURL, backupSourceURL,
+		FlaggerIngestionURL, ingestionURL,
+		FlaggerSSEUrl, sseURL,
+		FlaggerLogLevel, logLevel,
+		FlaggerAuthMode, authMode)
 	err := flagger.Init(nil)
 	res = err == nil
 	if !res {
-		log.Errorf("Could not initialize flagger using environment variables, set LogLevel to debug to see environment variables values, for more info see: https://docs.airdeploy.io/flagger-sdk/quick-start")
+		logger.Error("Could not initialize flagger using environment variables, set LogLevel to debug to see environment variables values, for more info see: https://docs.airdeploy.io/flagger-sdk/quick-start")
 	}
 	return res
 }
@@ -140,6 +252,12 @@ func (flagger *Flagger) Shutdown(timeout time.Duration) bool {
 
 	flagger.core.SetConfig(nil)
 	flagger.core.SetEntity(nil)
+	flagger.config.reset()
+
+	if flagger.cancelWatch != nil {
+		flagger.cancelWatch()
+		flagger.cancelWatch = nil
+	}
 
 	// this could happen if Shutdown is called before init
 	if flagger.sse != nil {
@@ -152,19 +270,31 @@ func (flagger *Flagger) Shutdown(timeout time.Duration) bool {
 	return false
 }
 
+// Flush sends the ingestion data immediately without shutting down, e.g. at the end of a serverless invocation.
+// Flush waits for the ingestion requests, including the data queued for retries, to finish
+// or for ctx to expire and returns the first error
+func (flagger *Flagger) Flush(ctx context.Context) error {
+	flagger.mux.RLock()
+	defer flagger.mux.RUnlock()
+	if flagger.ingester == nil {
+		return nil
+	}
+	return flagger.log.redactError(flagger.ingester.Flush(ctx))
+}
+
 // Publish explicitly notifies Airship about an Entity
 func (flagger *Flagger) Publish(entity *core.Entity) {
 	if entity == nil {
-		log.Warnf("Could not publish because entity is empty")
+		flagger.logger().Warn("Could not publish because entity is empty")
 		return
 	}
 
 	if entity.ID == "" {
-		log.Warnf("Could not publish because entity.id is empty")
+		flagger.logger().Warn("Could not publish because entity.id is empty")
 		return
 	}
 
-	escapedEntity := core.EscapeEntity(entity)
+	escapedEntity := flagger.core.EscapeEntity(entity)
 
 	flagger.checkFlaggerInitialized(func() {
 		flagger.ingester.Publish(escapedEntity)
@@ -173,29 +303,50 @@ func (flagger *Flagger) Publish(entity *core.Entity) {
 
 // Track is simple event tracking API.
 // Entity could be omitted if it has already been set before.
+// The event is validated against the schema registered with WithEventSchemas
 func (flagger *Flagger) Track(event *core.Event) {
 	if event == nil {
-		log.Warnf("Could not track because event is empty")
+		flagger.logger().Warn("Could not track because event is empty")
 		return
 	}
 
 	if event.Name == "" {
-		log.Warnf("Could not track because event.name is empty")
+		flagger.logger().Warn("Could not track because event.name is empty")
 		return
 	}
 
 	if event.Entity != nil && event.Entity.ID == "" {
-		log.Warnf("Could not track because event.entity.id is empty")
+		flagger.logger().Warn("Could not track because event.entity.id is empty", "event", event.Name)
 		return
 	}
 
-	escapedEvent := core.EscapeEvent(event)
+	escapedEvent := flagger.core.EscapeEvent(event)
+	if schema, ok := flagger.opts.eventSchemas[escapedEvent.Name]; ok {
+		for _, warning := range schema.Validate(escapedEvent) {
+			flagger.logger().Warn("Event does not match the schema: "+warning, "event", escapedEvent.Name)
+		}
+	}
 
 	flagger.checkFlaggerInitialized(func() {
 		flagger.ingester.Track(escapedEvent)
 	})
 }
 
+// Alias links the previous entity to the current one, e.g. the anonymous visitor to the logged-in user,
+// by tracking core.AliasEventName event of the current entity.
+// Set FlagConfig.BucketBy to keep the assignments of the flags consistent across the transition
+func (flagger *Flagger) Alias(previous, current *core.Entity) {
+	if previous == nil || previous.ID == "" {
+		flagger.logger().Warn("Could not alias because previous entity or its id is empty")
+		return
+	}
+	if current == nil || current.ID == "" {
+		flagger.logger().Warn("Could not alias because current entity or its id is empty")
+		return
+	}
+	flagger.Track(core.NewAliasEvent(previous, current))
+}
+
 func (flagger *Flagger) checkFlaggerInitialized(callback func()) {
 	flagger.mux.RLock()
 	if !flagger.enabled {
@@ -221,36 +372,36 @@ func (flagger *Flagger) SetEntity(entity *core.Entity) {
 	// entity could be nil in case user wants to reset Flagger's scope entity to nil
 	if entity != nil && entity.ID == "" {
 		bytes, _ := json.Marshal(entity)
-		log.Warnf("Could not setEntity because id is empty, entity: %+v", string(bytes))
+		flagger.logger().Warn("Could not setEntity because id is empty", "entity", string(bytes))
 		return
 	}
-	escapedEntity := core.EscapeEntity(entity)
+	escapedEntity := flagger.core.EscapeEntity(entity)
 
 	flagger.mux.Lock()
 	flagger.core.SetEntity(escapedEntity)
 
 	if flagger.ingester == nil {
-		flagger.ingester = ingester.NewIngester(SDKInfo, firstExposuresIngestThreshold)
+		flagger.ingester = flagger.newIngester(flagger.opts)
 	}
 	flagger.ingester.SetEntity(escapedEntity)
 	flagger.mux.Unlock()
 
 	bytes, _ := json.Marshal(escapedEntity)
-	log.Debugf("New entity is set to Flagger, entity: %+v", string(bytes))
+	flagger.logger().Debug("New entity is set to Flagger", "entity", string(bytes))
 }
 
 // IsEnabled checks whether a flag is enabled for an entity
 func (flagger *Flagger) IsEnabled(codename string, entity *core.Entity) bool {
-	escapedEntity := core.EscapeEntity(entity)
+	escapedEntity := flagger.core.EscapeEntity(entity)
 
 	var flagResult *core.FlagResult
 	flagger.checkFlaggerInitialized(func() {
-		flagResult = flagger.core.EvaluateFlag(codename, escapedEntity)
+		flagResult = flagger.evaluateFlag(codename, escapedEntity)
 		flagger.ingestExposure("isEnabled", codename, flagResult)
 	})
 
 	bytes, _ := json.Marshal(flagResult)
-	log.Debugf("IsEnabled: %+v", string(bytes))
+	flagger.logger().Debug("IsEnabled", "codename", codename, "result", string(bytes))
 	if flagResult == nil {
 		return false
 	}
@@ -261,16 +412,16 @@ func (flagger *Flagger) IsEnabled(codename string, entity *core.Entity) bool {
 // However, the entity may or may not be "sampled".
 // A sampled entity may someday receive this feature, but this function only determines whether entity is sampled.
 func (flagger *Flagger) IsSampled(codename string, entity *core.Entity) bool {
-	escapedEntity := core.EscapeEntity(entity)
+	escapedEntity := flagger.core.EscapeEntity(entity)
 
 	var flagResult *core.FlagResult
 	flagger.checkFlaggerInitialized(func() {
-		flagResult = flagger.core.EvaluateFlag(codename, escapedEntity)
+		flagResult = flagger.evaluateFlag(codename, escapedEntity)
 		flagger.ingestExposure("isSampled", codename, flagResult)
 	})
 
 	bytes, _ := json.Marshal(flagResult)
-	log.Debugf("IsSampled: %+v", string(bytes))
+	flagger.logger().Debug("IsSampled", "codename", codename, "result", string(bytes))
 	if flagResult == nil {
 		return false
 	}
@@ -280,16 +431,16 @@ func (flagger *Flagger) IsSampled(codename string, entity *core.Entity) bool {
 // GetVariation returns the variation that the entity will receive (after resolving all Flagging Rules).
 // This is a more general flag function that is useful for multivariate flags.
 func (flagger *Flagger) GetVariation(codename string, entity *core.Entity) string {
-	escapedEntity := core.EscapeEntity(entity)
+	escapedEntity := flagger.core.EscapeEntity(entity)
 
 	var flagResult *core.FlagResult
 	flagger.checkFlaggerInitialized(func() {
-		flagResult = flagger.core.EvaluateFlag(codename, escapedEntity)
+		flagResult = flagger.evaluateFlag(codename, escapedEntity)
 		flagger.ingestExposure("getVariation", codename, flagResult)
 	})
 
 	bytes, _ := json.Marshal(flagResult)
-	log.Debugf("GetVariation: %+v", string(bytes))
+	flagger.logger().Debug("GetVariation", "codename", codename, "result", string(bytes))
 	if flagResult == nil {
 		return core.DefaultVariation().Codename
 	}
@@ -298,22 +449,31 @@ func (flagger *Flagger) GetVariation(codename string, entity *core.Entity) strin
 
 // GetPayload returns the payload associated with the treatment assigned to the entity
 func (flagger *Flagger) GetPayload(codename string, entity *core.Entity) core.Payload {
-	escapedEntity := core.EscapeEntity(entity)
+	escapedEntity := flagger.core.EscapeEntity(entity)
 
 	var flagResult *core.FlagResult
 	flagger.checkFlaggerInitialized(func() {
-		flagResult = flagger.core.EvaluateFlag(codename, escapedEntity)
+		flagResult = flagger.evaluateFlag(codename, escapedEntity)
 		flagger.ingestExposure("getPayload", codename, flagResult)
 	})
 
 	bytes, _ := json.Marshal(flagResult)
-	log.Debugf("GetPayload: %+v", string(bytes))
+	flagger.logger().Debug("GetPayload", "codename", codename, "result", string(bytes))
 	if flagResult == nil {
 		return core.DefaultVariation().Payload
 	}
 	return flagResult.Payload
 }
 
+// evaluateFlag resolves the flag with the default variation if the configuration is stale, see StaleConfigDefaults
+// not thread safe
+func (flagger *Flagger) evaluateFlag(codename string, entity *core.Entity) *core.FlagResult {
+	if flagger.useDefaultsForStaleConfig() {
+		return staleConfigResult(entity)
+	}
+	return flagger.core.EvaluateFlag(codename, entity)
+}
+
 // flagger must be initialized
 // not thread safe
 func (flagger *Flagger) ingestExposure(methodName, codename string, result *core.FlagResult) {
@@ -321,6 +481,7 @@ func (flagger *Flagger) ingestExposure(methodName, codename string, result *core
 	if result.Reason != core.CodenameIsEmpty &&
 		result.Reason != core.NoEntityProvided &&
 		result.Reason != core.FlaggerIsNotInitialized &&
+		result.Reason != core.ConfigIsStale &&
 		result.Reason != core.IDIsEmpty {
 		exposure := &core.Exposure{
 			Codename:     codename,
@@ -329,6 +490,7 @@ func (flagger *Flagger) ingestExposure(methodName, codename string, result *core
 			Entity:       result.Entity,
 			MethodCalled: methodName,
 			Timestamp:    time.Now(),
+			Holdout:      result.Holdout,
 		}
 
 		flagger.ingester.PublishExposure(exposure, result.IsNew)
@@ -17,8 +17,10 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -33,6 +35,67 @@ const (
 var errAPIKeyNotFound = errors.New("API keys not found")
 
 func Test_validateIngestionSchema(t *testing.T) {
+	isEnabled := func(f *flagger.Flagger) {
+		f.IsEnabled("test", &core.Entity{
+			ID:   "1234",
+			Type: "User",
+			Name: "John",
+			Group: &core.Group{
+				ID:   "5678",
+				Type: "Company",
+				Name: "Stark Int",
+				Attributes: map[string]interface{}{
+					"active": true,
+				},
+			},
+			Attributes: map[string]interface{}{
+				"lastName": "Travolta",
+			},
+		})
+	}
+
+	t.Run("exposures", func(t *testing.T) {
+		validateIngestionSchema(t, isEnabled, func(data *ingester.IngestionDataRequest) {
+			assert.Len(t, data.Exposures, 1)
+		})
+	})
+
+	t.Run("aggregated exposures", func(t *testing.T) {
+		validateIngestionSchema(t, isEnabled, func(data *ingester.IngestionDataRequest) {
+			assert.Len(t, data.AggregatedExposures, 1)
+		}, flagger.WithExposureAggregation())
+	})
+
+	t.Run("events", func(t *testing.T) {
+		timestamp := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+		validateIngestionSchema(t, func(f *flagger.Flagger) {
+			f.Track(&core.Event{
+				Name: "purchase",
+				EventProperties: core.Attributes{
+					"plan":  "Bronze",
+					"items": []map[string]interface{}{{"sku": "a-1", "price": 9.99}},
+					"at":    timestamp,
+				},
+				Entity:    &core.Entity{ID: "1234"},
+				Value:     9.99,
+				Timestamp: timestamp,
+			})
+		}, func(data *ingester.IngestionDataRequest) {
+			if assert.Len(t, data.Events, 1) {
+				event := data.Events[0]
+				assert.Equal(t, 9.99, event.Value)
+				assert.True(t, timestamp.Equal(event.Timestamp))
+				assert.Equal(t, "2020-01-02T03:04:05Z", event.EventProperties["at"])
+				assert.Equal(t, []interface{}{map[string]interface{}{"sku": "a-1", "price": 9.99}},
+					event.EventProperties["items"])
+			}
+		})
+	})
+}
+
+// validateIngestionSchema validates the ingestion data sent after the call against ingestion.schema.json
+func validateIngestionSchema(t *testing.T, call func(f *flagger.Flagger),
+	check func(data *ingester.IngestionDataRequest), opts ...flagger.Option) {
 	catchIngestion(2)
 	defer gock.OffAll()
 	defer gock.Observe(nil)
@@ -60,6 +123,7 @@ func Test_validateIngestionSchema(t *testing.T) {
 			if isEmpty(data) {
 				return
 			}
+			check(data)
 
 			// additionally validates against schema
 			documentLoader := gojsonschema.NewBytesLoader(buf)
@@ -76,25 +140,10 @@ func Test_validateIngestionSchema(t *testing.T) {
 		}
 	})
 
-	f, err := initFlaggerInstance(ingestionConfig)
+	f, err := initFlaggerInstance(ingestionConfig, opts...)
 	assert.NoError(t, err)
 
-	f.IsEnabled("test", &core.Entity{
-		ID:   "1234",
-		Type: "User",
-		Name: "John",
-		Group: &core.Group{
-			ID:   "5678",
-			Type: "Company",
-			Name: "Stark Int",
-			Attributes: map[string]interface{}{
-				"active": true,
-			},
-		},
-		Attributes: map[string]interface{}{
-			"lastName": "Travolta",
-		},
-	})
+	call(f)
 
 	timeout := f.Shutdown(1 * time.Second)
 	assert.False(t, timeout)
@@ -418,6 +467,40 @@ func TestFlagger_Track(t *testing.T) {
 	})
 }
 
+func TestFlagger_Alias(t *testing.T) {
+	catchIngestion(2)
+	defer gock.OffAll()
+	defer gock.Observe(nil)
+
+	var events []*core.Event
+	gock.Observe(func(request *http.Request, mock gock.Mock) {
+		if request.Method == http.MethodPost {
+			data, err := utils.ParseIngestionBody(request.Body)
+			assert.NoError(t, err)
+			events = append(events, data.Events...)
+		}
+	})
+
+	f, err := initFlaggerInstance(ingestionConfig)
+	assert.Nil(t, err)
+
+	f.Alias(&core.Entity{ID: "cookie-1"}, &core.Entity{ID: "user-1"})
+
+	// invalid
+	f.Alias(nil, &core.Entity{ID: "user-1"})
+	f.Alias(&core.Entity{ID: "cookie-1"}, &core.Entity{})
+
+	timeout := f.Shutdown(1 * time.Second)
+	assert.False(t, timeout)
+
+	if assert.Len(t, events, 1) {
+		assert.Equal(t, core.AliasEventName, events[0].Name)
+		assert.Equal(t, "user-1", events[0].Entity.ID)
+		assert.Equal(t, "cookie-1", events[0].EventProperties["previous_id"])
+		assert.Equal(t, "User", events[0].EventProperties["previous_type"])
+	}
+}
+
 func TestFlagger_Publish(t *testing.T) {
 
 	t.Run("publish adds entity to ingester", func(t *testing.T) {
@@ -490,6 +573,93 @@ func TestFlagger_Publish(t *testing.T) {
 	})
 }
 
+func TestFlagger_SetLogger(t *testing.T) {
+	t.Run("custom logger receives structured messages", func(t *testing.T) {
+		catchIngestion(2)
+		defer gock.OffAll()
+
+		logger := &recordingLogger{}
+		f, err := initFlaggerInstance(ingestionConfig)
+		assert.NoError(t, err)
+		f.SetLogger(logger)
+
+		f.Publish(nil)
+		f.IsEnabled("", &core.Entity{ID: "1"})
+
+		timeout := f.Shutdown(1 * time.Second)
+		assert.False(t, timeout)
+
+		warnings := logger.messages("warn")
+		if assert.Len(t, warnings, 2) {
+			assert.Equal(t, "Could not publish because entity is empty", warnings[0].msg)
+			assert.Equal(t, "entity", warnings[1].keysAndValues[0])
+		}
+	})
+}
+
+// urlErrorTransport fails every request with the url.Error which contains the request URL
+type urlErrorTransport struct{}
+
+func (urlErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, &url.Error{Op: req.Method, URL: req.URL.String(), Err: errors.New("connection refused")}
+}
+
+func TestFlagger_APIKeyRedaction(t *testing.T) {
+	t.Run("API key is redacted from logged errors", func(t *testing.T) {
+		logger := &recordingLogger{}
+		f := flagger.NewFlagger(flagger.WithLogger(logger))
+		err := f.Init(&flagger.InitArgs{
+			APIKey:          utils.APIKey,
+			SourceURL:       "http://127.0.0.1:1/config/",
+			BackupSourceURL: "http://127.0.0.1:1/config/",
+		})
+		assert.Error(t, err)
+		f.Shutdown(time.Second)
+
+		warnings := logger.messages("warn")
+		assert.NotEmpty(t, warnings)
+		for _, e := range warnings {
+			assert.NotContains(t, fmt.Sprint(e.msg, e.keysAndValues), utils.APIKey)
+		}
+	})
+
+	t.Run("API key is redacted from Init error in path auth mode", func(t *testing.T) {
+		f := flagger.NewFlagger(flagger.WithLogger(&recordingLogger{}), flagger.WithRoundTripper(urlErrorTransport{}))
+		err := f.Init(&flagger.InitArgs{
+			APIKey:          utils.APIKey,
+			SourceURL:       "http://127.0.0.1:1/config/",
+			BackupSourceURL: "http://127.0.0.1:1/config/",
+			AuthMode:        flagger.AuthModePath,
+		})
+		f.Shutdown(time.Second)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "127.0.0.1:1/config/")
+			assert.NotContains(t, err.Error(), utils.APIKey)
+		}
+	})
+
+	t.Run("API key is redacted from silent init", func(t *testing.T) {
+		setFlaggerEnvVars()
+		defer unsetFlaggerEnvVars()
+		defer gock.OffAll()
+		gock.New(utils.FlagsURL).
+			Get(utils.FlagsPath + utils.APIKey).
+			Reply(http.StatusOK).
+			JSON(&core.Configuration{})
+
+		logger := &recordingLogger{}
+		f := flagger.NewFlagger(flagger.WithLogger(logger))
+		f.IsEnabled("", &core.Entity{ID: "1"})
+		f.Shutdown(time.Second)
+
+		debug := logger.messages("debug")
+		assert.NotEmpty(t, debug)
+		for _, e := range debug {
+			assert.NotContains(t, fmt.Sprint(e.msg, e.keysAndValues), utils.APIKey)
+		}
+	})
+}
+
 func TestFlagFunctions(t *testing.T) {
 	t.Run("IsEnabled", func(t *testing.T) {
 		catchIngestion(3)
@@ -779,6 +949,68 @@ func TestShutdown(t *testing.T) {
 	})
 }
 
+func TestFlagger_Flush(t *testing.T) {
+	t.Run("not initialized", func(t *testing.T) {
+		assert.NoError(t, flagger.NewFlagger().Flush(context.Background()))
+	})
+
+	t.Run("the data is ingested immediately, the flagger keeps working", func(t *testing.T) {
+		defer gock.OffAll()
+		gock.New(utils.IngestionURL).
+			Post(utils.IngestionPath + utils.APIKey).
+			Persist().
+			Reply(http.StatusOK)
+
+		var mux sync.Mutex
+		var entities []string
+		exposures := 0
+		gock.Observe(func(request *http.Request, mock gock.Mock) {
+			if request.Method == http.MethodPost {
+				data, err := utils.ParseIngestionBody(request.Body)
+				assert.NoError(t, err)
+				mux.Lock()
+				for _, entity := range data.Entities {
+					entities = append(entities, entity.ID)
+				}
+				exposures += len(data.Exposures)
+				mux.Unlock()
+			}
+		})
+		defer gock.Observe(nil)
+
+		f, err := initFlaggerInstance(ingestionConfig)
+		assert.NoError(t, err)
+		defer f.Shutdown(time.Second)
+
+		f.Publish(&core.Entity{ID: "flushed"})
+		assert.NoError(t, f.Flush(context.Background()))
+		mux.Lock()
+		assert.Contains(t, entities, "flushed")
+		mux.Unlock()
+
+		assert.True(t, f.IsEnabled("new-signup-flow", enabledEntity()))
+		assert.NoError(t, f.Flush(context.Background()))
+		mux.Lock()
+		assert.Equal(t, 1, exposures)
+		mux.Unlock()
+	})
+
+	t.Run("the ingestion error is returned", func(t *testing.T) {
+		// the ingestion is not mocked, the requests fail
+		defer gock.OffAll()
+		f, err := initFlaggerInstance(ingestionConfig)
+		assert.NoError(t, err)
+		defer f.Shutdown(time.Second)
+
+		f.Publish(&core.Entity{ID: "1"})
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		err = f.Flush(ctx)
+		assert.Error(t, err)
+		assert.NotContains(t, err.Error(), utils.APIKey)
+	})
+}
+
 func TestIngestion(t *testing.T) {
 
 	t.Run("First 10 exposures are always ingested", func(t *testing.T) {
@@ -1087,7 +1319,7 @@ func BenchmarkFlagger_flagFunctions(b *testing.B) {
 	}
 }
 
-func initFlaggerInstance(configFileName string) (*flagger.Flagger, error) {
+func initFlaggerInstance(configFileName string, opts ...flagger.Option) (*flagger.Flagger, error) {
 
 	var configuration *core.Configuration
 	utils.MustJSONFile(configFileName, &configuration)
@@ -1097,7 +1329,7 @@ func initFlaggerInstance(configFileName string) (*flagger.Flagger, error) {
 		Reply(http.StatusOK).
 		JSON(configuration)
 
-	f := flagger.NewFlagger()
+	f := flagger.NewFlagger(opts...)
 	err := f.Init(&flagger.InitArgs{APIKey: utils.APIKey, SSEURL: utils.SseURL})
 	return f, err
 }
@@ -1125,6 +1357,7 @@ func catchIngestion(times int) {
 func isEmpty(dr *ingester.IngestionDataRequest) bool {
 	return len(dr.Entities) == 0 &&
 		len(dr.Exposures) == 0 &&
+		len(dr.AggregatedExposures) == 0 &&
 		len(dr.DetectedFlags) == 0 &&
 		len(dr.Events) == 0
 }
@@ -1143,3 +1376,44 @@ func unsetFlaggerEnvVars() {
 	_ = os.Unsetenv(flagger.FlaggerIngestionURL)
 	_ = os.Unsetenv(flagger.FlaggerSSEUrl)
 }
+
+type logEntry struct {
+	level         string
+	msg           string
+	keysAndValues []interface{}
+}
+
+type recordingLogger struct {
+	mux     sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) record(level, msg string, keysAndValues []interface{}) {
+	l.mux.Lock()
+	l.entries = append(l.entries, logEntry{level: level, msg: msg, keysAndValues: keysAndValues})
+	l.mux.Unlock()
+}
+
+func (l *recordingLogger) messages(level string) []logEntry {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	var res []logEntry
+	for _, e := range l.entries {
+		if e.level == level {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+func (l *recordingLogger) Debug(msg string, keysAndValues ...interface{}) {
+	l.record("debug", msg, keysAndValues)
+}
+
+func (l *recordingLogger) Warn(msg string, keysAndValues ...interface{}) {
+	l.record("warn", msg, keysAndValues)
+}
+
+func (l *recordingLogger) Error(msg string, keysAndValues ...interface{}) {
+	l.record("error", msg, keysAndValues)
+}
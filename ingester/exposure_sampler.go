@@ -0,0 +1,129 @@
+package ingester
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/core"
+)
+
+// maxDedupKeys limits the memory used by the deduplication,
+// the remembered exposures are forgotten when the limit is reached
+const maxDedupKeys = 100000
+
+// exposureSampler decides which exposures are ingested:
+// the same (entity, flag, variation) exposure is ingested once within the dedup window,
+// the rest of exposures are sampled with the sample rate
+type exposureSampler struct {
+	mux sync.Mutex
+
+	// set by SetExposureSampling, used if SDKConfig doesn't provide the values
+	localRate   float64
+	localWindow time.Duration
+
+	rate   float64       // (0, 1], 1 means every exposure is ingested
+	window time.Duration // 0 means no deduplication
+
+	seen      map[exposureKey]time.Time // the time the exposure is seen first within the window
+	lastSweep time.Time
+
+	now    func() time.Time
+	random func() float64
+}
+
+type exposureKey struct {
+	entityType, entityID, codename, variation string
+}
+
+func newExposureSampler() *exposureSampler {
+	return &exposureSampler{
+		localRate: 1,
+		rate:      1,
+		seen:      map[exposureKey]time.Time{},
+		now:       time.Now,
+		random:    rand.Float64,
+	}
+}
+
+// setLocal sets the sample rate and the dedup window used when SDKConfig doesn't override them
+func (s *exposureSampler) setLocal(rate float64, window time.Duration) {
+	if rate <= 0 || rate > 1 {
+		rate = 1
+	}
+	if window < 0 {
+		window = 0
+	}
+	s.mux.Lock()
+	s.localRate, s.localWindow = rate, window
+	s.rate, s.window = rate, window
+	s.mux.Unlock()
+}
+
+// configure applies the values provided by SDKConfig, the local ones are used otherwise
+func (s *exposureSampler) configure(config *core.SDKConfig) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.rate, s.window = s.localRate, s.localWindow
+	if config == nil {
+		return
+	}
+	if config.SDKExposureSampleRate > 0 && config.SDKExposureSampleRate <= 1 {
+		s.rate = config.SDKExposureSampleRate
+	}
+	if config.SDKExposureDedupWindow > 0 {
+		s.window = time.Duration(config.SDKExposureDedupWindow) * time.Second
+	}
+}
+
+// sample returns the sampling weight of the exposure, 0 means the exposure must not be ingested
+func (s *exposureSampler) sample(exposure *core.Exposure) float64 {
+	s.mux.Lock()
+	rate, window := s.rate, s.window
+	if window > 0 && exposure.Entity != nil {
+		if s.isDuplicate(exposure, window) {
+			s.mux.Unlock()
+			return 0
+		}
+	}
+	s.mux.Unlock()
+
+	if rate < 1 && s.random() >= rate {
+		return 0
+	}
+	return 1 / rate
+}
+
+// isDuplicate remembers the exposure, returns true if it's already seen within the window
+// Caution: must be called under the lock
+func (s *exposureSampler) isDuplicate(exposure *core.Exposure, window time.Duration) bool {
+	now := s.now()
+	if now.Sub(s.lastSweep) > window || len(s.seen) >= maxDedupKeys {
+		s.sweep(now, window)
+	}
+
+	key := exposureKey{
+		entityType: exposure.Entity.Type,
+		entityID:   exposure.Entity.ID,
+		codename:   exposure.Codename,
+		variation:  exposure.Variation,
+	}
+	if seenAt, ok := s.seen[key]; ok && now.Sub(seenAt) < window {
+		return true
+	}
+	s.seen[key] = now
+	return false
+}
+
+// sweep forgets the exposures seen before the window, all of them if there are too many
+func (s *exposureSampler) sweep(now time.Time, window time.Duration) {
+	s.lastSweep = now
+	for key, seenAt := range s.seen {
+		if now.Sub(seenAt) >= window {
+			delete(s.seen, key)
+		}
+	}
+	if len(s.seen) >= maxDedupKeys {
+		s.seen = map[exposureKey]time.Time{}
+	}
+}
@@ -0,0 +1,155 @@
+package ingester
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSampler(rate float64, window time.Duration) (*exposureSampler, *time.Time) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := newExposureSampler()
+	s.setLocal(rate, window)
+	s.now = func() time.Time { return now }
+	return s, &now
+}
+
+func testExposure(entityID, codename, variation string) *core.Exposure {
+	return &core.Exposure{
+		Codename:  codename,
+		Variation: variation,
+		Entity:    &core.Entity{ID: entityID, Type: "User"},
+	}
+}
+
+func TestExposureSampler(t *testing.T) {
+	t.Run("every exposure is ingested by default", func(t *testing.T) {
+		s := newExposureSampler()
+		for i := 0; i < 10; i++ {
+			assert.Equal(t, 1.0, s.sample(testExposure("1", "flag", "on")))
+		}
+	})
+
+	t.Run("the same exposure is ingested once within the window", func(t *testing.T) {
+		s, now := newTestSampler(1, time.Minute)
+
+		assert.Equal(t, 1.0, s.sample(testExposure("1", "flag", "on")))
+		assert.Zero(t, s.sample(testExposure("1", "flag", "on")))
+
+		// other entity, flag or variation is not a duplicate
+		assert.Equal(t, 1.0, s.sample(testExposure("2", "flag", "on")))
+		assert.Equal(t, 1.0, s.sample(testExposure("1", "other-flag", "on")))
+		assert.Equal(t, 1.0, s.sample(testExposure("1", "flag", "off")))
+
+		*now = now.Add(59 * time.Second)
+		assert.Zero(t, s.sample(testExposure("1", "flag", "on")))
+
+		*now = now.Add(time.Second)
+		assert.Equal(t, 1.0, s.sample(testExposure("1", "flag", "on")))
+	})
+
+	t.Run("expired exposures are forgotten", func(t *testing.T) {
+		s, now := newTestSampler(1, time.Minute)
+		for i := 0; i < 10; i++ {
+			s.sample(testExposure(strconv.Itoa(i), "flag", "on"))
+		}
+		assert.Len(t, s.seen, 10)
+
+		*now = now.Add(2 * time.Minute)
+		s.sample(testExposure("1", "flag", "on"))
+		assert.Len(t, s.seen, 1)
+	})
+
+	t.Run("exposures are sampled with the rate and carry the weight", func(t *testing.T) {
+		s, _ := newTestSampler(0.25, 0)
+		random := []float64{0.1, 0.3, 0.24, 0.9}
+		s.random = func() float64 {
+			r := random[0]
+			random = random[1:]
+			return r
+		}
+
+		var weights []float64
+		for i := 0; i < 4; i++ {
+			weights = append(weights, s.sample(testExposure("1", "flag", "on")))
+		}
+		assert.Equal(t, []float64{4, 0, 4, 0}, weights)
+	})
+
+	t.Run("sampled share is close to the rate", func(t *testing.T) {
+		s, _ := newTestSampler(0.1, 0)
+		sampled := 0
+		for i := 0; i < 100000; i++ {
+			if s.sample(testExposure(strconv.Itoa(i), "flag", "on")) > 0 {
+				sampled++
+			}
+		}
+		assert.InDelta(t, 10000, sampled, 1000)
+	})
+
+	t.Run("SDKConfig overrides local values", func(t *testing.T) {
+		s, _ := newTestSampler(0.5, time.Minute)
+
+		s.configure(&core.SDKConfig{SDKExposureSampleRate: 0.1, SDKExposureDedupWindow: 3600})
+		assert.Equal(t, 0.1, s.rate)
+		assert.Equal(t, time.Hour, s.window)
+
+		// invalid and missing values fall back to the local ones
+		s.configure(&core.SDKConfig{SDKExposureSampleRate: 2})
+		assert.Equal(t, 0.5, s.rate)
+		assert.Equal(t, time.Minute, s.window)
+
+		s.configure(nil)
+		assert.Equal(t, 0.5, s.rate)
+	})
+
+	t.Run("invalid local values are ignored", func(t *testing.T) {
+		s, _ := newTestSampler(-1, -time.Second)
+		assert.Equal(t, 1.0, s.rate)
+		assert.Zero(t, s.window)
+	})
+}
+
+func TestIngester_PublishExposure_sampling(t *testing.T) {
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0, nil)
+
+	var mux sync.Mutex
+	var exposures []*core.Exposure
+	var detectedFlags []string
+	ingester.strategy.httpRequest = func(buf []byte, ingestionURL string) error {
+		var data IngestionDataRequest
+		assert.NoError(t, json.Unmarshal(buf, &data))
+		mux.Lock()
+		exposures = append(exposures, data.Exposures...)
+		detectedFlags = append(detectedFlags, data.DetectedFlags...)
+		mux.Unlock()
+		return nil
+	}
+	ingester.Activate("", &core.SDKConfig{
+		SDKIngestionInterval:   1000,
+		SDKIngestionMaxItems:   500,
+		SDKExposureDedupWindow: 60,
+	})
+
+	for i := 0; i < 3; i++ {
+		ingester.PublishExposure(testExposure("1", "flag", "on"), false)
+	}
+	// the new flag is reported even if its exposure is a duplicate
+	ingester.PublishExposure(testExposure("1", "new-flag", "on"), true)
+	ingester.PublishExposure(testExposure("1", "new-flag", "on"), true)
+	assert.False(t, ingester.Shutdown(time.Second))
+
+	mux.Lock()
+	defer mux.Unlock()
+	if assert.Len(t, exposures, 2) {
+		assert.Equal(t, "flag", exposures[0].Codename)
+		assert.Equal(t, 1.0, exposures[0].SamplingWeight)
+		assert.Equal(t, "new-flag", exposures[1].Codename)
+	}
+	assert.Equal(t, []string{"new-flag", "new-flag"}, detectedFlags)
+}
@@ -7,9 +7,17 @@ import (
 	"github.com/airdeploy/flagger-go/v3/log"
 	"github.com/google/uuid"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// DefaultBufferSize is the number of data requests waiting for the ingestion worker
+	DefaultBufferSize = 10000
+	// DefaultBlockTimeout is the max time Publish is blocked with OverflowBlock policy
+	DefaultBlockTimeout = 100 * time.Millisecond
+)
+
 func newGroupStrategy(sdkInfo *core.SDKInfo, httpRequest httpRequestType, firstExposuresIngestThreshold int) *groupStrategy {
 	gs := &groupStrategy{
 		wg: sync.WaitGroup{},
@@ -19,9 +27,15 @@ func newGroupStrategy(sdkInfo *core.SDKInfo, httpRequest httpRequestType, firstE
 		httpRequest: httpRequest,
 		sdkInfo:     sdkInfo,
 		sdkConfig:   defaultSDKConfig,
+		log:         log.Default(),
 
 		retryPolicy: newRetryPolicy(),
 
+		buffer:       make(chan *IngestionDataRequest, DefaultBufferSize),
+		flushes:      make(chan chan<- error),
+		overflow:     OverflowDropNewest,
+		blockTimeout: DefaultBlockTimeout,
+
 		callCount:                     0,
 		firstExposuresIngestThreshold: firstExposuresIngestThreshold,
 		accumulator:                   make([]*IngestionDataRequest, 0, 100),
@@ -29,42 +43,108 @@ func newGroupStrategy(sdkInfo *core.SDKInfo, httpRequest httpRequestType, firstE
 	return gs
 }
 
+// setBuffer must be called before Activate
+func (gs *groupStrategy) setBuffer(size int, overflow OverflowPolicy, blockTimeout time.Duration) {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	if blockTimeout <= 0 {
+		blockTimeout = DefaultBlockTimeout
+	}
+	gs.lock.Lock()
+	gs.buffer = make(chan *IngestionDataRequest, size)
+	gs.overflow = overflow
+	gs.blockTimeout = blockTimeout
+	gs.lock.Unlock()
+}
+
+// setDropHandler must be called before Activate
+func (gs *groupStrategy) setDropHandler(handler DropHandler) {
+	gs.lock.Lock()
+	gs.retryPolicy.onDrop = handler
+	gs.lock.Unlock()
+}
+
+// setSpool must be called before Activate
+func (gs *groupStrategy) setSpool(spool *Spool) {
+	gs.lock.Lock()
+	gs.retryPolicy.spool = spool
+	gs.lock.Unlock()
+}
+
+// setAggregation switches exposures to AggregatedExposures, must be called before Activate
+func (gs *groupStrategy) setAggregation(aggregate bool) {
+	gs.lock.Lock()
+	gs.aggregate = aggregate
+	gs.lock.Unlock()
+}
+
+// setLogger must be called before Activate
+func (gs *groupStrategy) setLogger(logger log.Logger) {
+	gs.lock.Lock()
+	gs.log = logger
+	gs.retryPolicy.log = logger
+	gs.lock.Unlock()
+}
+
 func (gs *groupStrategy) shouldSendIngestionData(ingestionMaxCalls int, data *IngestionDataRequest) bool {
 	return (gs.callCount >= ingestionMaxCalls) ||
 		(len(data.DetectedFlags) > 0) ||
 		(len(data.Exposures) > 0 && gs.exposuresCount <= gs.firstExposuresIngestThreshold)
 }
 
+// startWorker starts the goroutine which drains the buffer into the accumulator and ingests it
+// when maxItems is reached, on the ingestion interval and on shutdown
 func (gs *groupStrategy) startWorker() {
+	gs.lock.Lock()
+	previous := gs.workerDone
+	done := make(chan struct{})
+	gs.workerDone = done
+	ctx := gs.ctx
+	sdkConfig := gs.sdkConfig
+	ingestionURL := gs.url
+	gs.lock.Unlock()
 
 	go func() {
-		gs.lock.RLock()
-		sdkConfig := gs.sdkConfig
-		ingestionURL := gs.url
-		gs.lock.RUnlock()
+		defer close(done)
+		if previous != nil {
+			// the previous worker drains the buffer on shutdown
+			<-previous
+		}
+
 		ingestionInterval := sdkConfig.IngestionIntervalDuration() // use 50*time.Milliseconds instead of 0
 		ingestionTimer := time.NewTimer(ingestionInterval)
+		defer ingestionTimer.Stop()
 		for {
 			select {
+			case data := <-gs.buffer:
+				gs.accumulate(data, ingestionURL, sdkConfig.SDKIngestionMaxItems)
+
+			case result := <-gs.flushes:
+				gs.drain(ingestionURL, sdkConfig.SDKIngestionMaxItems)
+				if gs.callCount > 0 {
+					gs.wg.Add(1)
+					gs.ingestAndNotify(ingestionURL, func(err error) {
+						gs.wg.Done()
+					}, result)
+				} else {
+					result <- nil
+				}
+
 			case <-ingestionTimer.C:
 				//Ingestion timer expires
-				gs.lock.RLock()
-				count := gs.callCount
-				gs.lock.RUnlock()
-
-				gs.wg.Add(1)
-				if count > 0 {
+				if gs.callCount > 0 {
+					gs.wg.Add(1)
 					gs.ingest(ingestionURL, func(err error) {
 						gs.wg.Done()
 					})
-				} else {
-					gs.wg.Done()
 				}
 				ingestionTimer.Reset(ingestionInterval)
 
-			case <-gs.ctx.Done():
+			case <-ctx.Done():
 				// this case is triggered by ShutdownWithTimeout
 				// gs.wg delta is 1
+				gs.drain(ingestionURL, sdkConfig.SDKIngestionMaxItems)
 				if gs.callCount > 0 {
 					gs.ingest(ingestionURL, func(err error) {
 						gs.wg.Done()
@@ -76,52 +156,188 @@ func (gs *groupStrategy) startWorker() {
 			}
 		}
 	}()
+}
+
+// accumulate adds the data to the accumulator and ingests it if needed, called by the worker
+func (gs *groupStrategy) accumulate(data *IngestionDataRequest, ingestionURL string, maxItems int) {
+	gs.accumulator = append(gs.accumulator, data)
+	gs.callCount++
+
+	if exposuresCount := len(data.Exposures); exposuresCount > 0 && (gs.exposuresCount <= gs.firstExposuresIngestThreshold) {
+		gs.exposuresCount += exposuresCount
+	}
 
+	if gs.shouldSendIngestionData(maxItems, data) {
+		gs.wg.Add(1)
+		gs.ingest(ingestionURL, func(err error) {
+			gs.wg.Done()
+		})
+	}
 }
 
-// side effects notice: it clears callCount and accumulator
-func (gs *groupStrategy) ingest(ingestionURL string, callback RetryPolicyCallback) {
-	gs.lock.Lock()
-	defer gs.lock.Unlock()
-	bytes, err := transformToBytes(gs.accumulator, gs.sdkInfo)
-	if err == nil {
-		rpr := &retryPolicyRequest{
-			data:         bytes,
-			ingestionURL: ingestionURL,
-			httpRequest:  gs.httpRequest,
-			callback:     callback,
+// drain accumulates the data left in the buffer, called by the worker
+func (gs *groupStrategy) drain(ingestionURL string, maxItems int) {
+	for {
+		select {
+		case data := <-gs.buffer:
+			gs.accumulate(data, ingestionURL, maxItems)
+		default:
+			return
 		}
-		go gs.retryPolicy.ingest(rpr)
 	}
+}
+
+// side effects notice: it clears callCount and accumulator, called by the worker
+func (gs *groupStrategy) ingest(ingestionURL string, callback RetryPolicyCallback) {
+	gs.ingestAndNotify(ingestionURL, callback, nil)
+}
+
+// ingestAndNotify is ingest which sends the result of the first request to the result channel if it's not nil.
+// Unlike callback which is called when the data is sent or dropped
+func (gs *groupStrategy) ingestAndNotify(ingestionURL string, callback RetryPolicyCallback, result chan<- error) {
+	accumulator := gs.accumulator
+	atomic.AddInt64(&gs.pending, -int64(gs.callCount))
 	gs.callCount = 0
-	gs.accumulator = []*IngestionDataRequest{}
+	gs.accumulator = make([]*IngestionDataRequest, 0, len(accumulator))
+
+	gs.lock.RLock()
+	aggregate := gs.aggregate
+	gs.lock.RUnlock()
+
+	bytes, err := transformToBytes(accumulator, gs.sdkInfo, aggregate, gs.log)
+	if err != nil {
+		gs.log.Error("Ingester: cannot serialize ingestion data", "error", err)
+		callback(err)
+		if result != nil {
+			result <- err
+		}
+		return
+	}
+	rpr := &retryPolicyRequest{
+		data:         bytes,
+		ingestionURL: ingestionURL,
+		httpRequest:  gs.httpRequest,
+		callback:     callback,
+	}
+	atomic.AddInt64(&gs.inflight, 1)
+	go func() {
+		err := gs.retryPolicy.ingest(rpr)
+		atomic.AddInt64(&gs.inflight, -1)
+		if result != nil {
+			result <- err
+		}
+	}()
+}
+
+// Flush ingests the accumulated data immediately and sends the data queued for retries.
+// Waits for the requests to finish or ctx to expire, returns the first error
+func (gs *groupStrategy) Flush(ctx context.Context) error {
+	gs.lock.RLock()
+	active, ingestionURL, workerDone := gs.isActive, gs.url, gs.workerDone
+	gs.lock.RUnlock()
+	if !active {
+		return nil
+	}
+
+	// buffered, so the worker never waits for the flushing goroutine
+	result := make(chan error, 1)
+	select {
+	case gs.flushes <- result:
+	case <-workerDone:
+		// shutdown sends the data
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		if err := <-result; err != nil {
+			done <- err
+			return
+		}
+		// the data ingested by the worker before the flush request may be still in flight
+		for atomic.LoadInt64(&gs.inflight) > 0 {
+			select {
+			case <-ctx.Done():
+				done <- ctx.Err()
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+		done <- gs.retryPolicy.flush(ctx, ingestionURL, gs.httpRequest)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
+// Publish puts the data to the buffer, it never waits for the serialization nor the http request.
+// If the buffer is full the overflow policy is applied
 func (gs *groupStrategy) Publish(data *IngestionDataRequest) {
-	gs.lock.Lock()
-	url := gs.url
+	gs.lock.RLock()
 	if !gs.isActive {
-		gs.lock.Unlock()
+		gs.lock.RUnlock()
 		return
 	}
+	buffer, overflow, blockTimeout := gs.buffer, gs.overflow, gs.blockTimeout
+	gs.lock.RUnlock()
 
-	gs.accumulator = append(gs.accumulator, data)
-	gs.callCount++
+	atomic.AddInt64(&gs.pending, 1)
+	select {
+	case buffer <- data:
+		return
+	default:
+	}
 
-	if exposuresCount := len(data.Exposures); exposuresCount > 0 && (gs.exposuresCount <= gs.firstExposuresIngestThreshold) {
-		gs.exposuresCount += exposuresCount
+	switch overflow {
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-buffer:
+				gs.drop()
+			default:
+			}
+			select {
+			case buffer <- data:
+				return
+			default:
+			}
+		}
+
+	case OverflowBlock:
+		timer := time.NewTimer(blockTimeout)
+		defer timer.Stop()
+		select {
+		case buffer <- data:
+		case <-timer.C:
+			gs.drop()
+		}
+
+	default:
+		gs.drop()
 	}
-	maxItems := gs.sdkConfig.SDKIngestionMaxItems
+}
 
-	if gs.shouldSendIngestionData(maxItems, data) {
-		gs.lock.Unlock()
-		gs.wg.Add(1)
-		gs.ingest(url, func(err error) {
-			gs.wg.Done()
-		})
-	} else {
-		gs.lock.Unlock()
+// drop counts the data dropped because the buffer is full
+func (gs *groupStrategy) drop() {
+	atomic.AddInt64(&gs.pending, -1)
+	if atomic.AddInt64(&gs.dropped, 1) == 1 {
+		gs.log.Warn("Ingester: ingestion buffer is full, data is dropped")
+	}
+}
+
+// Status returns the number of pending data requests and the retry policy state
+func (gs *groupStrategy) Status() Status {
+	s := Status{
+		Pending: int(atomic.LoadInt64(&gs.pending)),
+		Dropped: int(atomic.LoadInt64(&gs.dropped)),
 	}
+	gs.retryPolicy.status(&s)
+	return s
 }
 
 func (gs *groupStrategy) Activate(ingestionURL string, config *core.SDKConfig) {
@@ -138,6 +354,20 @@ func (gs *groupStrategy) Activate(ingestionURL string, config *core.SDKConfig) {
 	gs.lock.Unlock()
 
 	gs.startWorker()
+	go gs.retryPolicy.retryLoop(ctx, ingestionURL, gs.httpRequest)
+	gs.replay(ingestionURL)
+}
+
+// replay sends the data left in the spool, e.g. by the previous process
+func (gs *groupStrategy) replay(ingestionURL string) {
+	if gs.retryPolicy.spool == nil || gs.retryPolicy.spool.Len() == 0 {
+		return
+	}
+	gs.wg.Add(1)
+	go func() {
+		defer gs.wg.Done()
+		_ = gs.retryPolicy.releaseWait(ingestionURL, gs.httpRequest)
+	}()
 }
 
 // ShutdownWithTimeout features:
@@ -165,17 +395,17 @@ func (gs *groupStrategy) ShutdownWithTimeout(timeout time.Duration) bool {
 	select {
 	case <-c:
 		timer.Stop()
-		log.Debugf("ShutdownWithTimeout is finished by sending all requests")
+		gs.log.Debug("ShutdownWithTimeout is finished by sending all requests")
 		return false // completed normally
 	case <-timer.C:
 		timer.Stop()
 
-		log.Warnf("ShutdownWithTimeout exited with a timeout, some requests are not finished")
+		gs.log.Warn("ShutdownWithTimeout exited with a timeout, some requests are not finished", "timeout", timeout)
 		return true // timed out
 	}
 }
 
-func transformToBytes(acc []*IngestionDataRequest, sdkInfo *core.SDKInfo) ([]byte, error) {
+func transformToBytes(acc []*IngestionDataRequest, sdkInfo *core.SDKInfo, aggregate bool, logger log.Logger) ([]byte, error) {
 	var entitiesMap = make(map[string]*core.Entity, 4)
 	var events = make([]*core.Event, 0, 4)
 	var exposures = make([]*core.Exposure, 0, 4)
@@ -197,17 +427,88 @@ func transformToBytes(acc []*IngestionDataRequest, sdkInfo *core.SDKInfo) ([]byt
 
 	id, err := uuid.NewRandom()
 	if err != nil {
-		log.Errorf("Error while generating UUID: %+v", err)
+		logger.Error("Error while generating UUID", "error", err)
 	}
 
-	return json.Marshal(&IngestionDataRequest{
+	request := &IngestionDataRequest{
 		ID:            id.String(),
 		Entities:      entityMapToSlice(entitiesMap),
 		Exposures:     exposures,
 		Events:        events,
 		SDKInfo:       sdkInfo,
 		DetectedFlags: detectedFlagsMapToSlice(detectedFlags),
-	})
+	}
+	if aggregate {
+		request.Exposures = []*core.Exposure{}
+		request.AggregatedExposures = aggregateExposures(exposures)
+	}
+	return json.Marshal(request)
+}
+
+type exposureCountKey struct {
+	codename, variation, hashKey, methodCalled, entityType string
+	holdout                                                bool
+}
+
+// aggregateExposures rolls up the exposures into counts, the counts are in order of the first exposure
+func aggregateExposures(exposures []*core.Exposure) []*ExposureCount {
+	counts := make([]*ExposureCount, 0, 4)
+	index := make(map[exposureCountKey]int, 4)
+	entityIDs := make(map[exposureCountKey]map[string]struct{}, 4) // map used as set
+
+	for _, exposure := range exposures {
+		entityType := ""
+		if exposure.Entity != nil {
+			entityType = exposure.Entity.Type
+		}
+		key := exposureCountKey{
+			codename:     exposure.Codename,
+			variation:    exposure.Variation,
+			hashKey:      exposure.HashKey,
+			methodCalled: exposure.MethodCalled,
+			entityType:   entityType,
+			holdout:      exposure.Holdout,
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(counts)
+			index[key] = i
+			entityIDs[key] = make(map[string]struct{}, 4)
+			counts = append(counts, &ExposureCount{
+				Codename:     key.codename,
+				Variation:    key.variation,
+				HashKey:      key.hashKey,
+				MethodCalled: key.methodCalled,
+				EntityType:   key.entityType,
+				Holdout:      key.holdout,
+				EntityIDs:    []string{},
+				From:         exposure.Timestamp,
+				To:           exposure.Timestamp,
+			})
+		}
+
+		count := counts[i]
+		count.Count++
+		if exposure.SamplingWeight > 0 {
+			count.WeightedCount += exposure.SamplingWeight
+		} else {
+			count.WeightedCount++
+		}
+		if exposure.Timestamp.Before(count.From) {
+			count.From = exposure.Timestamp
+		}
+		if exposure.Timestamp.After(count.To) {
+			count.To = exposure.Timestamp
+		}
+		if exposure.Entity != nil {
+			if _, seen := entityIDs[key][exposure.Entity.ID]; !seen {
+				entityIDs[key][exposure.Entity.ID] = struct{}{}
+				count.EntityIDs = append(count.EntityIDs, exposure.Entity.ID)
+			}
+		}
+	}
+	return counts
 }
 
 func entityMapToSlice(entityMap map[string]*core.Entity) []*core.Entity {
@@ -1,10 +1,13 @@
 package ingester
 
 import (
+	"context"
+	"errors"
 	"github.com/airdeploy/flagger-go/v3/core"
 	"github.com/airdeploy/flagger-go/v3/json"
 	"github.com/airdeploy/flagger-go/v3/log"
 	"github.com/stretchr/testify/assert"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -142,7 +145,7 @@ func TestNewGroupStrategy(t *testing.T) {
 	t.Run("ShutdownWithTimeout check current state and sends all current data", func(t *testing.T) {
 		gs := initGroupStrategy(0, 60, 3, func(data []byte, ingestionURL string) error {
 			time.Sleep(100 * time.Millisecond)
-			log.Debugf("send is finished")
+			log.Debug("send is finished")
 			return nil
 		})
 
@@ -157,7 +160,7 @@ func TestNewGroupStrategy(t *testing.T) {
 
 	t.Run("ShutdownWithTimeout doesn't do anything with an empty Ingester", func(t *testing.T) {
 		gs := initGroupStrategy(0, 60, 3, func(data []byte, ingestionURL string) error {
-			log.Debugf("ingest is triggered")
+			log.Debug("ingest is triggered")
 			time.Sleep(100 * time.Millisecond)
 			return nil
 		})
@@ -171,7 +174,7 @@ func TestNewGroupStrategy(t *testing.T) {
 
 	t.Run("ShutdownWithTimeout waits for current ingestion to finish", func(t *testing.T) {
 		gs := initGroupStrategy(0, 60, 3, func(data []byte, ingestionURL string) error {
-			log.Debugf("ingest is triggered")
+			log.Debug("ingest is triggered")
 			time.Sleep(100 * time.Millisecond)
 			return nil
 		})
@@ -188,7 +191,7 @@ func TestNewGroupStrategy(t *testing.T) {
 
 	t.Run("ShutdownWithTimeout ingest current data", func(t *testing.T) {
 		gs := initGroupStrategy(0, 60, 5, func(data []byte, ingestionURL string) error {
-			log.Debugf("ingest is triggered")
+			log.Debug("ingest is triggered")
 			time.Sleep(100 * time.Millisecond)
 			return nil
 		})
@@ -206,7 +209,7 @@ func TestNewGroupStrategy(t *testing.T) {
 
 		count := 0
 		gs := initGroupStrategy(0, 60, 3, func(data []byte, ingestionURL string) error {
-			log.Debugf("ingest is triggered")
+			log.Debug("ingest is triggered")
 			count++
 			return nil
 		})
@@ -266,7 +269,7 @@ func TestNewGroupStrategy(t *testing.T) {
 		count := 0
 
 		gs := initGroupStrategy(0, 60, 3, func(data []byte, ingestionURL string) error {
-			log.Debugf("ingest is triggered")
+			log.Debug("ingest is triggered")
 			time.Sleep(1 * time.Second)
 			count++
 			return nil
@@ -312,7 +315,7 @@ func TestNewGroupStrategy(t *testing.T) {
 	t.Run("data is still ingesting even if retryPolicy httpRequest is froze", func(t *testing.T) {
 
 		gs := initGroupStrategy(0, 60, 500, func(data []byte, ingestionURL string) error {
-			log.Debugf("ingest is triggered")
+			log.Debug("ingest is triggered")
 			time.Sleep(100 * time.Second)
 			return nil
 		})
@@ -396,6 +399,261 @@ func TestNewGroupStrategy(t *testing.T) {
 
 	})
 
+	t.Run("Status reports pending data, backlog and the last error", func(t *testing.T) {
+		var fail atomic.Value
+		fail.Store(true)
+		gs := initGroupStrategy(0, 60, 2, func(data []byte, ingestionURL string) error {
+			if fail.Load().(bool) {
+				return errors.New("connection refused")
+			}
+			return nil
+		})
+		assert.Equal(t, Status{}, gs.Status())
+
+		gs.Publish(ingestionDataRequest(false))
+		assert.Equal(t, Status{Pending: 1}, gs.Status())
+
+		// maxItems is reached, the request fails and is put to the queue
+		gs.Publish(ingestionDataRequest(false))
+		assert.Eventually(t, func() bool {
+			return gs.Status().Backlog == 1
+		}, time.Second, 10*time.Millisecond)
+		status := gs.Status()
+		assert.Zero(t, status.Pending)
+		assert.EqualError(t, status.LastError, "connection refused")
+		assert.WithinDuration(t, time.Now(), status.LastErrorAt, time.Second)
+
+		// successful request drains the queue and clears the error
+		fail.Store(false)
+		gs.Publish(ingestionDataRequest(false))
+		gs.Publish(ingestionDataRequest(false))
+		assert.Eventually(t, func() bool {
+			return gs.Status().Backlog == 0
+		}, time.Second, 10*time.Millisecond)
+		assert.NoError(t, gs.Status().LastError)
+
+		finishedWithTimeout := gs.ShutdownWithTimeout(1 * time.Second)
+		assert.False(t, finishedWithTimeout)
+	})
+}
+
+func TestGroupStrategy_aggregation(t *testing.T) {
+	var requests []IngestionDataRequest
+	gs := newGroupStrategy(&core.SDKInfo{Name: "go", Version: "3.0.0"}, func(data []byte, ingestionURL string) error {
+		var request IngestionDataRequest
+		assert.NoError(t, json.Unmarshal(data, &request))
+		requests = append(requests, request)
+		return nil
+	}, 0)
+	gs.setAggregation(true)
+	gs.Activate(defaultURL, &core.SDKConfig{
+		SDKIngestionInterval: 60,
+		SDKIngestionMaxItems: 500,
+	})
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	exposure := func(entityID, entityType, variation string, minutes int) *IngestionDataRequest {
+		entity := &core.Entity{ID: entityID, Type: entityType}
+		return &IngestionDataRequest{
+			Entities: []*core.Entity{entity},
+			Exposures: []*core.Exposure{{
+				Codename:       "sound",
+				HashKey:        "hashkey",
+				Variation:      variation,
+				Entity:         entity,
+				MethodCalled:   "isEnabled",
+				Timestamp:      start.Add(time.Duration(minutes) * time.Minute),
+				SamplingWeight: 2,
+			}},
+		}
+	}
+	gs.Publish(exposure("1", "User", "enabled", 1))
+	gs.Publish(exposure("2", "User", "enabled", 0))
+	gs.Publish(exposure("1", "User", "enabled", 2))
+	gs.Publish(exposure("1", "User", "off", 3))
+	gs.Publish(exposure("1", "Company", "enabled", 4))
+	heldOut := exposure("3", "User", "enabled", 5)
+	heldOut.Exposures[0].Holdout = true
+	gs.Publish(heldOut)
+
+	assert.False(t, gs.ShutdownWithTimeout(time.Second))
+	if !assert.Len(t, requests, 1) {
+		return
+	}
+	assert.Empty(t, requests[0].Exposures)
+	assert.Len(t, requests[0].Entities, 4)
+	assert.Equal(t, []*ExposureCount{
+		{
+			Codename: "sound", Variation: "enabled", HashKey: "hashkey", MethodCalled: "isEnabled", EntityType: "User",
+			Count: 3, WeightedCount: 6, EntityIDs: []string{"1", "2"},
+			From: start, To: start.Add(2 * time.Minute),
+		},
+		{
+			Codename: "sound", Variation: "off", HashKey: "hashkey", MethodCalled: "isEnabled", EntityType: "User",
+			Count: 1, WeightedCount: 2, EntityIDs: []string{"1"},
+			From: start.Add(3 * time.Minute), To: start.Add(3 * time.Minute),
+		},
+		{
+			Codename: "sound", Variation: "enabled", HashKey: "hashkey", MethodCalled: "isEnabled", EntityType: "Company",
+			Count: 1, WeightedCount: 2, EntityIDs: []string{"1"},
+			From: start.Add(4 * time.Minute), To: start.Add(4 * time.Minute),
+		},
+		{
+			Codename: "sound", Variation: "enabled", HashKey: "hashkey", MethodCalled: "isEnabled", EntityType: "User",
+			Holdout: true, Count: 1, WeightedCount: 2, EntityIDs: []string{"3"},
+			From: start.Add(5 * time.Minute), To: start.Add(5 * time.Minute),
+		},
+	}, requests[0].AggregatedExposures)
+}
+
+func TestGroupStrategy_overflow(t *testing.T) {
+	// the worker is not started, the buffer is not drained
+	newInactiveWorker := func(overflow OverflowPolicy, blockTimeout time.Duration) *groupStrategy {
+		gs := newGroupStrategy(&core.SDKInfo{Name: "go", Version: "3.0.0"}, func(data []byte, ingestionURL string) error {
+			return nil
+		}, 0)
+		gs.setBuffer(2, overflow, blockTimeout)
+		gs.isActive = true
+		return gs
+	}
+	published := func(id string) *IngestionDataRequest {
+		return &IngestionDataRequest{ID: id}
+	}
+	buffered := func(gs *groupStrategy) []string {
+		var ids []string
+		for len(gs.buffer) > 0 {
+			ids = append(ids, (<-gs.buffer).ID)
+		}
+		return ids
+	}
+
+	t.Run("drop newest", func(t *testing.T) {
+		gs := newInactiveWorker(OverflowDropNewest, 0)
+		for _, id := range []string{"1", "2", "3", "4"} {
+			gs.Publish(published(id))
+		}
+		assert.Equal(t, Status{Pending: 2, Dropped: 2}, gs.Status())
+		assert.Equal(t, []string{"1", "2"}, buffered(gs))
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+		gs := newInactiveWorker(OverflowDropOldest, 0)
+		for _, id := range []string{"1", "2", "3", "4"} {
+			gs.Publish(published(id))
+		}
+		assert.Equal(t, Status{Pending: 2, Dropped: 2}, gs.Status())
+		assert.Equal(t, []string{"3", "4"}, buffered(gs))
+	})
+
+	t.Run("block with timeout", func(t *testing.T) {
+		gs := newInactiveWorker(OverflowBlock, 50*time.Millisecond)
+		gs.Publish(published("1"))
+		gs.Publish(published("2"))
+
+		start := time.Now()
+		gs.Publish(published("3"))
+		assert.True(t, time.Since(start) >= 50*time.Millisecond)
+		assert.Equal(t, Status{Pending: 2, Dropped: 1}, gs.Status())
+
+		// Publish is unblocked as soon as there is room in the buffer
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			<-gs.buffer
+		}()
+		start = time.Now()
+		gs.Publish(published("4"))
+		assert.True(t, time.Since(start) < 50*time.Millisecond)
+		assert.Equal(t, []string{"2", "4"}, buffered(gs))
+		assert.Equal(t, 1, gs.Status().Dropped)
+	})
+
+	t.Run("Publish doesn't wait for the serialization nor the request", func(t *testing.T) {
+		block := make(chan struct{})
+		gs := initGroupStrategy(0, 60, 10, func(data []byte, ingestionURL string) error {
+			<-block
+			return nil
+		})
+		start := time.Now()
+		for i := 0; i < 1000; i++ {
+			gs.Publish(ingestionDataRequest(false))
+		}
+		assert.True(t, time.Since(start) < time.Second)
+		close(block)
+		assert.False(t, gs.ShutdownWithTimeout(time.Second))
+		assert.Equal(t, Status{}, gs.Status())
+	})
+}
+
+func TestGroupStrategy_Flush(t *testing.T) {
+	t.Run("accumulated data is sent immediately, the strategy keeps working", func(t *testing.T) {
+		var count int64
+		gs := initGroupStrategy(0, 60, 500, func(data []byte, ingestionURL string) error {
+			atomic.AddInt64(&count, 1)
+			return nil
+		})
+		for i := 0; i < 3; i++ {
+			gs.Publish(ingestionDataRequest(false))
+		}
+		assert.NoError(t, gs.Flush(context.Background()))
+		assert.Equal(t, int64(1), atomic.LoadInt64(&count))
+		assert.Equal(t, Status{}, gs.Status())
+
+		// nothing to send
+		assert.NoError(t, gs.Flush(context.Background()))
+		assert.Equal(t, int64(1), atomic.LoadInt64(&count))
+
+		gs.Publish(ingestionDataRequest(false))
+		assert.NoError(t, gs.Flush(context.Background()))
+		assert.Equal(t, int64(2), atomic.LoadInt64(&count))
+		assert.False(t, gs.ShutdownWithTimeout(time.Second))
+	})
+
+	t.Run("the data queued for retries is sent", func(t *testing.T) {
+		var fail atomic.Value
+		fail.Store(true)
+		var sent int64
+		gs := initGroupStrategy(0, 60, 500, func(data []byte, ingestionURL string) error {
+			if fail.Load().(bool) {
+				return errors.New("connection refused")
+			}
+			atomic.AddInt64(&sent, 1)
+			return nil
+		})
+		gs.Publish(ingestionDataRequest(false))
+		assert.EqualError(t, gs.Flush(context.Background()), "connection refused")
+		assert.Equal(t, 1, gs.Status().Backlog)
+
+		fail.Store(false)
+		gs.Publish(ingestionDataRequest(false))
+		assert.NoError(t, gs.Flush(context.Background()))
+		assert.Equal(t, int64(2), atomic.LoadInt64(&sent))
+		assert.Zero(t, gs.Status().Backlog)
+		assert.False(t, gs.ShutdownWithTimeout(time.Second))
+	})
+
+	t.Run("Flush returns when the context expires", func(t *testing.T) {
+		block := make(chan struct{})
+		gs := initGroupStrategy(0, 60, 500, func(data []byte, ingestionURL string) error {
+			<-block
+			return nil
+		})
+		gs.Publish(ingestionDataRequest(false))
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, gs.Flush(ctx))
+
+		close(block)
+		assert.False(t, gs.ShutdownWithTimeout(time.Second))
+	})
+
+	t.Run("Flush does nothing if the strategy is not active", func(t *testing.T) {
+		gs := newGroupStrategy(&core.SDKInfo{Name: "go", Version: "3.0.0"}, func(data []byte, ingestionURL string) error {
+			assert.Fail(t, "must not be called")
+			return nil
+		}, 0)
+		assert.NoError(t, gs.Flush(context.Background()))
+	})
 }
 
 func initGroupStrategy(firstExposuresIngestThreshold int, interval, maxItems int, callback httpRequestType) *groupStrategy {
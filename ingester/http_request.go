@@ -3,19 +3,68 @@ package ingester
 import (
 	"bytes"
 	"compress/gzip"
-	"github.com/airdeploy/flagger-go/v3/log"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
 )
 
-var httpClient = &http.Client{
-	Timeout: 30 * time.Second,
+// DefaultTimeout is the timeout of the ingestion http client used when no client is provided
+const DefaultTimeout = 30 * time.Second
+
+func newHTTPRequest(client *http.Client) httpRequestType {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	return func(data []byte, URL string) error {
+		return httpRequest(client, data, URL)
+	}
+}
+
+// StatusError is returned when the ingestion server responds with non 200 status
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration // zero if the server doesn't provide Retry-After header
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Status)
+}
+
+// isPermanent returns true if the request must not be retried:
+// 4xx statuses mean the data is rejected, but 408 Request Timeout and 429 Too Many Requests
+func isPermanent(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500 &&
+		statusErr.StatusCode != http.StatusRequestTimeout &&
+		statusErr.StatusCode != http.StatusTooManyRequests
 }
 
-func httpRequest(data []byte, URL string) error {
+// parseRetryAfter parses Retry-After header value which is either seconds or HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+func httpRequest(client *http.Client, data []byte, URL string) error {
 	var req *http.Request
 	if len(data) > 1024 {
 		var compressed bytes.Buffer
@@ -43,18 +92,20 @@ func httpRequest(data []byte, URL string) error {
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := httpClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("%d: %s", resp.StatusCode, resp.Status)
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
 	}
 
-	if _, err = ioutil.ReadAll(resp.Body); err == nil {
-		log.Debugf("Http Call Executed, url: %+v, data: %+v", URL, string(data))
-	}
+	_, err = ioutil.ReadAll(resp.Body)
 	return errors.Wrap(err, "ioutil.ReadAll")
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"github.com/airdeploy/flagger-go/v3/core"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -71,7 +72,7 @@ func TestHttpRequest(t *testing.T) {
 			Compression("gzip").
 			Reply(200)
 
-		err = httpRequest(dataStr, url)
+		err = httpRequest(http.DefaultClient, dataStr, url)
 		assert.Nil(t, err)
 	})
 
@@ -114,7 +115,7 @@ func TestHttpRequest(t *testing.T) {
 			MatchType("json").
 			Reply(200)
 
-		err = httpRequest(dataStr, url)
+		err = httpRequest(http.DefaultClient, dataStr, url)
 		assert.Nil(t, err)
 	})
 
@@ -127,22 +128,58 @@ func TestHttpRequest(t *testing.T) {
 			MatchType("json").
 			Reply(500)
 
-		err = httpRequest(dataStr, url)
+		err = httpRequest(http.DefaultClient, dataStr, url)
 		assert.NotNil(t, err)
 		gock.OffAll()
 	})
 
+	t.Run("status code != 200 with Retry-After", func(t *testing.T) {
+		defer gock.OffAll()
+		gock.New(serverURL).
+			Post(postPath).
+			Reply(429).
+			SetHeader("Retry-After", "120")
+
+		err := httpRequest(http.DefaultClient, []byte("{}"), url)
+		statusErr, ok := err.(*StatusError)
+		assert.True(t, ok)
+		assert.Equal(t, 429, statusErr.StatusCode)
+		assert.Equal(t, 2*time.Minute, statusErr.RetryAfter)
+		assert.False(t, isPermanent(err))
+	})
+
 	t.Run("wrong URL", func(t *testing.T) {
 		data := generateIngestionDataRequest(1, 1)
 		dataStr, err := json.Marshal(data)
 		assert.Nil(t, err)
 
-		err = httpRequest(dataStr, "https://(&TGR(&#$G$#&($:1234/dada/dasdsa/dasda")
+		err = httpRequest(http.DefaultClient, dataStr, "https://(&TGR(&#$G$#&($:1234/dada/dasdsa/dasda")
 		log.Printf("%+v", err)
 		assert.NotNil(t, err)
 	})
 }
 
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 5*time.Second, parseRetryAfter("5", now))
+	assert.Equal(t, 90*time.Second, parseRetryAfter("Wed, 01 Jan 2020 00:01:30 GMT", now))
+	assert.Zero(t, parseRetryAfter("Tue, 31 Dec 2019 23:00:00 GMT", now))
+	assert.Zero(t, parseRetryAfter("-1", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+	assert.Zero(t, parseRetryAfter("", now))
+}
+
+func TestIsPermanent(t *testing.T) {
+	assert.True(t, isPermanent(&StatusError{StatusCode: 400}))
+	assert.True(t, isPermanent(&StatusError{StatusCode: 403}))
+	assert.False(t, isPermanent(&StatusError{StatusCode: 408}))
+	assert.False(t, isPermanent(&StatusError{StatusCode: 429}))
+	assert.False(t, isPermanent(&StatusError{StatusCode: 500}))
+	assert.False(t, isPermanent(errors.New("connection refused")))
+	assert.False(t, isPermanent(nil))
+}
+
 func gUnzipData(data []byte) (resData []byte, err error) {
 	b := bytes.NewBuffer(data)
 
@@ -1,9 +1,11 @@
 package ingester
 
 import (
+	"context"
 	"github.com/airdeploy/flagger-go/v3/core"
 	"github.com/airdeploy/flagger-go/v3/log"
 	"github.com/google/uuid"
+	"net/http"
 	"time"
 )
 
@@ -14,19 +16,130 @@ var _ interface {
 	PublishExposure(exposure *core.Exposure, isNewFlag bool)
 	SetEntity(entity *core.Entity)
 	Activate(ingestionURL string, config *core.SDKConfig)
+	Status() Status
+	Flush(ctx context.Context) error
 } = new(Ingester)
 
-// NewIngester creates new instance of ingester
-func NewIngester(sdkInfo *core.SDKInfo, firstExposuresIngestThreshold int) *Ingester {
+// NewIngester creates new instance of ingester.
+// client is used to send ingestion data, nil means a client with DefaultTimeout
+func NewIngester(sdkInfo *core.SDKInfo, firstExposuresIngestThreshold int, client *http.Client) *Ingester {
 	return &Ingester{
-		strategy: newGroupStrategy(sdkInfo, httpRequest, firstExposuresIngestThreshold),
+		strategy: newGroupStrategy(sdkInfo, newHTTPRequest(client), firstExposuresIngestThreshold),
+		sampler:  newExposureSampler(),
+		log:      log.Default(),
 	}
 }
 
+// SetLogger sets the logger used by the ingester. Must be called before Activate
+func (i *Ingester) SetLogger(logger log.Logger) {
+	i.mux.Lock()
+	i.log = logger
+	for _, sink := range i.sinks {
+		sink.log = logger
+	}
+	i.mux.Unlock()
+	i.strategy.setLogger(logger)
+}
+
+// AddSink adds the sink the exposures and the tracked events are delivered to besides Airship.
+// Every sink has its own buffer and goroutine, see SinkOptions. Must be called before Activate
+func (i *Ingester) AddSink(sink EventSink, opts SinkOptions) {
+	i.mux.Lock()
+	i.sinks = append(i.sinks, newSinkWorker(sink, opts, i.log))
+	i.mux.Unlock()
+}
+
+// SetAirshipIngestion enables or disables sending the data to Airship ingestion endpoint,
+// the sinks still receive the data if it's disabled. Must be called before Activate
+func (i *Ingester) SetAirshipIngestion(enabled bool) {
+	i.mux.Lock()
+	i.noAirship = !enabled
+	i.mux.Unlock()
+}
+
+// SetDropHandler sets the handler which is called with the data that will never be sent, see DropHandler.
+// Must be called before Activate
+func (i *Ingester) SetDropHandler(handler DropHandler) {
+	i.strategy.setDropHandler(handler)
+}
+
+// SetExposureSampling sets the share of exposures to ingest in range (0, 1] and the window
+// the same (entity, flag, variation) exposure is ingested once within, 0 disables the deduplication.
+// The values provided by SDKConfig take precedence. Must be called before Activate
+func (i *Ingester) SetExposureSampling(rate float64, dedupWindow time.Duration) {
+	i.sampler.setLocal(rate, dedupWindow)
+}
+
+// SetExposureAggregation switches the ingestion of exposures to AggregatedExposures:
+// exposures are rolled up into counts with distinct entity IDs per ingestion interval.
+// Must be called before Activate
+func (i *Ingester) SetExposureAggregation(aggregate bool) {
+	i.strategy.setAggregation(aggregate)
+}
+
+// SetBuffer sets the size of the buffer the published data waits in for the ingestion worker
+// and the policy applied when the buffer is full, blockTimeout is used by OverflowBlock.
+// Non-positive size and blockTimeout mean DefaultBufferSize and DefaultBlockTimeout. Must be called before Activate
+func (i *Ingester) SetBuffer(size int, overflow OverflowPolicy, blockTimeout time.Duration) {
+	i.strategy.setBuffer(size, overflow, blockTimeout)
+}
+
+// SetSpool sets the spool that keeps the data which is failed to be sent.
+// The data left in the spool is sent on Activate. Must be called before Activate
+func (i *Ingester) SetSpool(spool *Spool) {
+	i.strategy.setSpool(spool)
+}
+
 // Shutdown shutdowns the ingester
 // return true if existed because of timeout
 func (i *Ingester) Shutdown(timeout time.Duration) bool {
-	return i.strategy.ShutdownWithTimeout(timeout)
+	i.mux.RLock()
+	sinks := i.sinks
+	i.mux.RUnlock()
+
+	// the sinks and the strategy are shut down in parallel
+	timeouts := make(chan bool, len(sinks))
+	for _, sink := range sinks {
+		go func(sink *sinkWorker) {
+			timeouts <- sink.stop(timeout)
+		}(sink)
+	}
+	timedOut := i.strategy.ShutdownWithTimeout(timeout)
+	for range sinks {
+		if <-timeouts {
+			timedOut = true
+		}
+	}
+	return timedOut
+}
+
+// Flush ingests the published data immediately and sends the data queued for retries,
+// the sinks write their buffered records. Waits for the requests to finish or ctx to expire,
+// returns the first error. Unlike Shutdown the ingester keeps working
+func (i *Ingester) Flush(ctx context.Context) error {
+	i.mux.RLock()
+	sinks, noAirship := i.sinks, i.noAirship
+	i.mux.RUnlock()
+
+	errs := make(chan error, len(sinks)+1)
+	for _, sink := range sinks {
+		go func(sink *sinkWorker) {
+			errs <- sink.flush(ctx)
+		}(sink)
+	}
+	if noAirship {
+		errs <- nil
+	} else {
+		errs <- i.strategy.Flush(ctx)
+	}
+
+	var firstErr error
+	for n := 0; n < len(sinks)+1; n++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // Publish publishes new entity
@@ -42,7 +155,7 @@ func (i *Ingester) Track(event *core.Event) {
 
 	// do not publish if entity is not provided to the ingester
 	if event.Entity == nil && i.entity == nil {
-		log.Warnf("No entity provided to the flagger. Event will not be recorded, %+v", event)
+		i.log.Warn("No entity provided to the flagger. Event will not be recorded", "event", event.Name)
 		i.mux.RUnlock()
 		return
 	}
@@ -60,31 +173,47 @@ func (i *Ingester) Track(event *core.Event) {
 		Entities: entities,
 		Events:   []*core.Event{event},
 	}
+	for _, sink := range i.sinks {
+		sink.push(&SinkRecord{Event: event})
+	}
 	i.mux.RUnlock()
 
 	i.publish(request)
 }
 
-// PublishExposure adds new exposure to the ingester
+// PublishExposure adds new exposure to the ingester.
+// Duplicated and not sampled exposures are skipped, see SetExposureSampling
 func (i *Ingester) PublishExposure(exposure *core.Exposure, isNewFlag bool) {
-	i.mux.Lock()
-	defer i.mux.Unlock()
-
+	i.mux.RLock()
 	if exposure.Entity == nil && i.entity == nil {
+		i.mux.RUnlock()
 		return // have no entity
 
 	} else if exposure.Entity == nil {
 		exposure.Entity = i.entity
 	}
+	sinks := i.sinks
+	i.mux.RUnlock()
 
-	ingestionData := &IngestionDataRequest{
-		Exposures: []*core.Exposure{exposure},
-	}
-
+	ingestionData := &IngestionDataRequest{}
 	if isNewFlag {
 		ingestionData.DetectedFlags = []string{exposure.Codename}
 	}
 
+	weight := i.sampler.sample(exposure)
+	if weight == 0 {
+		if isNewFlag {
+			// the new flag is reported anyway
+			i.publish(ingestionData)
+		}
+		return
+	}
+	exposure.SamplingWeight = weight
+	for _, sink := range sinks {
+		sink.push(&SinkRecord{Exposure: exposure})
+	}
+
+	ingestionData.Exposures = []*core.Exposure{exposure}
 	ingestionData.Entities = []*core.Entity{exposure.Entity}
 	i.publish(ingestionData)
 }
@@ -101,6 +230,12 @@ func (i *Ingester) SendEmptyIngestion() {
 }
 
 func (i *Ingester) publish(data *IngestionDataRequest) {
+	i.mux.RLock()
+	noAirship := i.noAirship
+	i.mux.RUnlock()
+	if noAirship {
+		return
+	}
 	i.strategy.Publish(data)
 }
 
@@ -111,7 +246,24 @@ func (i *Ingester) SetEntity(entity *core.Entity) {
 	i.mux.Unlock()
 }
 
+// Status returns the ingestion backlog and the last ingestion error
+func (i *Ingester) Status() Status {
+	status := i.strategy.Status()
+	i.mux.RLock()
+	for _, sink := range i.sinks {
+		status.SinkDropped += sink.droppedCount()
+	}
+	i.mux.RUnlock()
+	return status
+}
+
 // Activate activates ingester strategy. Must be the first method called after NewIngester
 func (i *Ingester) Activate(ingestionURL string, config *core.SDKConfig) {
+	i.sampler.configure(config)
+	i.mux.RLock()
+	for _, sink := range i.sinks {
+		sink.start()
+	}
+	i.mux.RUnlock()
 	i.strategy.Activate(ingestionURL, config)
 }
@@ -19,7 +19,7 @@ import (
 const apiKey = "testApiKey"
 
 func TestNoEntityProvided(t *testing.T) {
-	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0)
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0, nil)
 	ingester.Activate("", &core.SDKConfig{
 		SDKIngestionInterval: 1,
 		SDKIngestionMaxItems: 500,
@@ -82,7 +82,7 @@ func TestIngestionSendAfter500Calls(t *testing.T) {
 		}
 	})
 
-	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0)
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0, nil)
 	ingester.Activate("https://ingestion.airdeploy.io/collector?envKey="+apiKey, &core.SDKConfig{
 		SDKIngestionInterval: 1,
 		SDKIngestionMaxItems: maxItems,
@@ -146,7 +146,7 @@ func TestIngestionDeduped25Entities(t *testing.T) {
 		}
 	})
 
-	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0)
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0, nil)
 	ingester.Activate("https://ingestion.airdeploy.io/collector?envKey="+apiKey, &core.SDKConfig{
 		SDKIngestionInterval: 1,
 		SDKIngestionMaxItems: maxItems,
@@ -179,7 +179,7 @@ func TestDetectedFlagShouldImmediatelyIngest(t *testing.T) {
 		Post("/v3/ingest/12345678").
 		Reply(200)
 
-	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 10)
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 10, nil)
 	ingester.Activate("https://ingestion.com/v3/ingest/12345678", &core.SDKConfig{
 		SDKIngestionInterval: 60,
 		SDKIngestionMaxItems: 500,
@@ -213,7 +213,7 @@ func TestIngester_SendEmptyIngestion(t *testing.T) {
 	gock.New("https://ingestion.com").
 		Post("/v3/ingest/12345678").
 		Reply(200)
-	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 10)
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 10, nil)
 	ingester.Activate("https://ingestion.com/v3/ingest/12345678", &core.SDKConfig{
 		SDKIngestionInterval: 60,
 		SDKIngestionMaxItems: 500,
@@ -251,7 +251,7 @@ func TestFirst10ExposureIngest(t *testing.T) {
 		Times(11).
 		Reply(200)
 
-	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 10)
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 10, nil)
 	ingester.Activate("https://ingestion.com/v3/ingest/12345678", &core.SDKConfig{
 		SDKIngestionInterval: 60,
 		SDKIngestionMaxItems: 500,
@@ -290,7 +290,7 @@ func TestFirst10ExposureIngest(t *testing.T) {
 
 func TestIngester_PublishExposure(t *testing.T) {
 	t.Run("exposure has no entity, ingester's entity is used", func(t *testing.T) {
-		ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 10)
+		ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 10, nil)
 		ingester.Activate("https://ingestion.com/v3/ingest/12345678", &core.SDKConfig{
 			SDKIngestionInterval: 60,
 			SDKIngestionMaxItems: 500,
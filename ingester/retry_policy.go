@@ -1,97 +1,343 @@
 package ingester
 
 import (
+	"context"
 	"errors"
 	"github.com/airdeploy/flagger-go/v3/log"
+	"math/rand"
+	"time"
 )
 
-const defaultMaxMemorySize = 2e8 // 100 MB
+const (
+	defaultMaxMemorySize = 2e8 // 100 MB
+
+	defaultRetryMinDelay = 1 * time.Second
+	defaultRetryMaxDelay = 5 * time.Minute
+)
+
+var (
+	// ErrQueueIsFull - the oldest data is dropped to free the memory for the new one
+	ErrQueueIsFull = errors.New("queue is full, first element removed")
+
+	// ErrSpoolIsFull - the oldest data is dropped from the spool to free the space for the new one
+	ErrSpoolIsFull = errors.New("spool is full, the oldest data is removed")
+
+	// ErrBatchIsTooLarge - the data is larger than the queue
+	ErrBatchIsTooLarge = errors.New("data is too large")
+)
 
 func newRetryPolicy() *retryPolicy {
 	return &retryPolicy{
+		log:                  log.Default(),
 		maxMemorySizeInBytes: defaultMaxMemorySize,
+		minDelay:             defaultRetryMinDelay,
+		maxDelay:             defaultRetryMaxDelay,
+		wake:                 make(chan struct{}, 1),
 	}
 }
 
 // this method will trigger ingest with data and ingestionURL
 // if it fails to do so, retryPolicy remembers the data(if there is enough space)
-// and will try again at the next ingest call.
+// and will try again at the next ingest call or by the retry loop.
 // If the next call of ingest doesn't return error then retryPolicy tries to send remembered data
-// in the queue order
-func (rt *retryPolicy) ingest(request *retryPolicyRequest) {
+// in the queue order.
+// Data rejected by the server(see isPermanent) is dropped without retries.
+// Returns the error of the request
+func (rt *retryPolicy) ingest(request *retryPolicyRequest) error {
 	//add one httpRequest to the wait group
 	err := request.httpRequest(request.data, request.ingestionURL)
-	if err != nil {
-		rt.putToQueue(request.data, request.callback)
-	} else {
+	rt.setLastError(err)
+	switch {
+	case err == nil:
 		// server is up
+		rt.log.Debug("Ingester: data is sent", "url", request.ingestionURL, "data", string(request.data))
 		request.callback(nil)
-		rt.releaseWait(request.ingestionURL, request.httpRequest)
+		_ = rt.releaseWait(request.ingestionURL, request.httpRequest)
+		return nil
+
+	case isPermanent(err):
+		rt.log.Warn("Ingester: data is rejected by the server, dropping it", "url", request.ingestionURL, "error", err)
+		rt.drop(request.data, err)
+		request.callback(err)
+		return err
+
+	default:
+		rt.log.Debug("Ingester: request failed, putting data to the queue", "url", request.ingestionURL, "error", err)
+		rt.putToQueue(request.data, request.callback)
+		return err
 	}
 }
 
 func (rt *retryPolicy) putToQueue(data []byte, callback RetryPolicyCallback) {
-	if rt.currentMemorySize+size(data) < rt.maxMemorySizeInBytes {
-		rt.addToQueue(data, callback)
-	} else {
-		if size(data) > rt.maxMemorySizeInBytes {
-			log.Warnf("Ingester: data is too large, size: %d, max size: %d", size(data), rt.maxMemorySizeInBytes)
-			return
-		}
-		// removes first element from queue until there is enough space to add new data chunk
-		for {
-			if rt.currentMemorySize+size(data) < rt.maxMemorySizeInBytes {
-				rt.addToQueue(data, nil)
-				break
-			}
+	defer rt.wakeUp()
 
-			first := rt.shift()
-			// notify about data will never be sent
-			first.callback(errors.New("queue is full, first element removed"))
+	if rt.spool != nil {
+		dropped, err := rt.spool.push(data)
+		if len(dropped) > 0 {
+			rt.log.Warn("Ingester: spool is full, the oldest data is dropped", "batches", len(dropped))
+			for _, d := range dropped {
+				rt.drop(d, ErrSpoolIsFull)
+			}
 		}
+		if err == nil {
+			// data is persisted, it's up to the spool to send it
+			callback(nil)
+			return
+		}
+		rt.log.Warn("Ingester: cannot put data to the spool, keeping it in memory", "error", err)
 	}
-}
 
-// removes first element from queue
-// Caution: must be called when queue.length > 0
-func (rt *retryPolicy) shift() *queueElement {
-	first := rt.queue[0]
-	rt.queue = rt.queue[1:]
-	rt.currentMemorySize -= size(first.data)
-	return first
-}
+	if size(data) >= rt.maxMemorySizeInBytes {
+		rt.log.Warn("Ingester: data is too large", "size", size(data), "maxSize", rt.maxMemorySizeInBytes)
+		rt.drop(data, ErrBatchIsTooLarge)
+		callback(ErrBatchIsTooLarge)
+		return
+	}
 
-func (rt *retryPolicy) addToQueue(data []byte, callback RetryPolicyCallback) {
+	// removes first elements from queue until there is enough space to add new data chunk,
+	// the size check and the append are done under the same lock as releaseQueue removes the sent data
+	var evicted []*queueElement
+	rt.mux.Lock()
+	for rt.currentMemorySize+size(data) >= rt.maxMemorySizeInBytes && len(rt.queue) > 0 {
+		first := rt.queue[0]
+		rt.queue = rt.queue[1:]
+		rt.currentMemorySize -= size(first.data)
+		evicted = append(evicted, first)
+	}
 	rt.queue = append(rt.queue, &queueElement{
 		data:     data,
 		callback: callback,
 	})
 	rt.currentMemorySize += size(data)
+	rt.mux.Unlock()
+
+	for _, first := range evicted {
+		// notify about data will never be sent
+		rt.drop(first.data, ErrQueueIsFull)
+		first.callback(ErrQueueIsFull)
+	}
+}
+
+// drop reports the data which will never be sent
+func (rt *retryPolicy) drop(data []byte, err error) {
+	if rt.onDrop != nil {
+		rt.onDrop(data, err)
+	}
+}
+
+// wakeUp notifies the retry loop about the new data in the queue
+func (rt *retryPolicy) wakeUp() {
+	select {
+	case rt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// removes the element from the head of the queue, returns false if it's not there anymore
+// (it was dropped by putToQueue while being sent)
+func (rt *retryPolicy) remove(element *queueElement) bool {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	if len(rt.queue) == 0 || rt.queue[0] != element {
+		return false
+	}
+	rt.queue = rt.queue[1:]
+	rt.currentMemorySize -= size(element.data)
+	return true
+}
+
+// returns the first element of the queue, nil if the queue is empty
+func (rt *retryPolicy) head() *queueElement {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	if len(rt.queue) == 0 {
+		return nil
+	}
+	return rt.queue[0]
+}
+
+// last error is cleared by the successful request
+func (rt *retryPolicy) setLastError(err error) {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	rt.lastError = err
+	if err != nil {
+		rt.lastErrorAt = time.Now()
+	}
+}
+
+func (rt *retryPolicy) getLastError() error {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	return rt.lastError
+}
+
+// status fills backlog and last error fields
+func (rt *retryPolicy) status(s *Status) {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	s.Backlog = len(rt.queue)
+	if rt.spool != nil {
+		s.Backlog += rt.spool.Len()
+	}
+	s.LastError = rt.lastError
+	s.LastErrorAt = rt.lastErrorAt
 }
 
 func size(data []byte) int64 {
 	return int64(24 + len(data))
 }
 
-func (rt *retryPolicy) releaseWait(ingestionURL string, callback httpRequestType) {
+// releaseWait sends the queued data in order, returns the error of the first failed request
+func (rt *retryPolicy) releaseWait(ingestionURL string, callback httpRequestType) error {
+	// only one goroutine sends the queued data, otherwise the same data could be sent twice
+	rt.mux.Lock()
+	if rt.releasing {
+		rt.mux.Unlock()
+		return nil
+	}
+	rt.releasing = true
+	rt.mux.Unlock()
+	defer func() {
+		rt.mux.Lock()
+		rt.releasing = false
+		rt.mux.Unlock()
+	}()
+
+	if err := rt.releaseQueue(ingestionURL, callback); err != nil {
+		return err
+	}
+	if rt.spool != nil {
+		return rt.releaseSpool(ingestionURL, callback)
+	}
+	return nil
+}
+
+func (rt *retryPolicy) releaseQueue(ingestionURL string, callback httpRequestType) error {
 	for {
-		// quit if queue is empty
-		if len(rt.queue) == 0 {
-			return
+		// take first element, quit if queue is empty
+		first := rt.head()
+		if first == nil {
+			return nil
 		}
-		// take first element
-		first := rt.queue[0]
 		// try to send it
 		err := callback(first.data, ingestionURL)
-		if err != nil {
+		rt.setLastError(err)
+		if err != nil && !isPermanent(err) {
 			// can't release anything
+			return err
+		}
+		// sent or rejected. Removes fist element unless it has been dropped already,
+		// its callback is called by putToQueue then
+		if !rt.remove(first) {
+			continue
+		}
+		if err != nil {
+			rt.log.Warn("Ingester: queued data is rejected by the server, dropping it", "url", ingestionURL, "error", err)
+			rt.drop(first.data, err)
+		}
+		// notify about the result
+		first.callback(err)
+	}
+}
+
+// sends the spooled data, stops on the first transient error
+func (rt *retryPolicy) releaseSpool(ingestionURL string, callback httpRequestType) error {
+	for {
+		data, pos := rt.spool.peek()
+		if data == nil {
+			return nil
+		}
+		err := callback(data, ingestionURL)
+		rt.setLastError(err)
+		if err != nil && !isPermanent(err) {
+			return err
+		}
+		if err != nil {
+			rt.log.Warn("Ingester: spooled data is rejected by the server, dropping it", "url", ingestionURL, "error", err)
+			rt.drop(data, err)
+		}
+		rt.spool.pop(pos)
+	}
+}
+
+// retryLoop sends the queued data with exponential backoff until ctx is done
+func (rt *retryPolicy) retryLoop(ctx context.Context, ingestionURL string, callback httpRequestType) {
+	attempt := 0
+	for {
+		// wait for the data to retry
+		for rt.backlog() == 0 {
+			attempt = 0
+			select {
+			case <-ctx.Done():
+				return
+			case <-rt.wake:
+			}
+		}
+
+		attempt++
+		delay := rt.backoff(attempt, rt.getLastError())
+		rt.log.Debug("Ingester: retrying queued data", "url", ingestionURL, "attempt", attempt, "delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
 			return
+		case <-timer.C:
 		}
-		// success. Removes fist element
-		first = rt.shift()
-		// notify about success
-		first.callback(nil)
+
+		if err := rt.releaseWait(ingestionURL, callback); err == nil {
+			attempt = 0
+		}
+	}
+}
+
+// backoff returns exponential delay with jitter for the attempt(starting from 1) in range [delay/2, delay].
+// Retry-After provided by the server is used if it's longer
+func (rt *retryPolicy) backoff(attempt int, err error) time.Duration {
+	delay := rt.maxDelay
+	if attempt < 32 && rt.minDelay<<uint(attempt-1) < rt.maxDelay {
+		delay = rt.minDelay << uint(attempt-1)
+	}
+	if delay > 1 {
+		delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > delay {
+		delay = statusErr.RetryAfter
+	}
+	return delay
+}
+
+// flush sends the queued data until the queue is empty, returns the first error or ctx error
+func (rt *retryPolicy) flush(ctx context.Context, ingestionURL string, callback httpRequestType) error {
+	for rt.backlog() > 0 {
+		if err := rt.releaseWait(ingestionURL, callback); err != nil {
+			return err
+		}
+		if rt.backlog() == 0 {
+			return nil
+		}
+		// the queue is being released by another goroutine
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
+func (rt *retryPolicy) backlog() int {
+	rt.mux.Lock()
+	n := len(rt.queue)
+	rt.mux.Unlock()
+	if rt.spool != nil {
+		n += rt.spool.Len()
 	}
+	return n
 }
 
 // SetMaxSize set maximum seize for the buffer
@@ -1,8 +1,11 @@
 package ingester
 
 import (
+	"context"
 	"errors"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sync"
 	"testing"
 	"time"
 )
@@ -93,6 +96,44 @@ func TestQueueIsFullReplaceFirstElement(t *testing.T) {
 	assert.Equal(t, policy.queue[0].data, []byte("tes"))
 }
 
+func TestQueueIsFullWhileReleasing(t *testing.T) {
+	policy := newRetryPolicy()
+	first := []byte("first")
+	policy.SetMaxSize(size(first) + 1)
+
+	var mux sync.Mutex
+	results := map[string][]error{}
+	record := func(name string) RetryPolicyCallback {
+		return func(err error) {
+			mux.Lock()
+			results[name] = append(results[name], err)
+			mux.Unlock()
+		}
+	}
+	fail := func(data []byte, ingestionURL string) error {
+		return errors.New("some connection problem")
+	}
+
+	_ = policy.ingest(&retryPolicyRequest{data: first, httpRequest: fail, callback: record("first")})
+	require.Len(t, policy.queue, 1)
+
+	// the first element is dropped by the new data while it is being sent
+	err := policy.releaseWait("", func(data []byte, ingestionURL string) error {
+		if string(data) == "first" {
+			_ = policy.ingest(&retryPolicyRequest{data: []byte("other"), httpRequest: fail, callback: record("other")})
+			return nil
+		}
+		return errors.New("some connection problem")
+	})
+	assert.Error(t, err)
+
+	assert.Equal(t, []error{ErrQueueIsFull}, results["first"])
+	assert.Empty(t, results["other"])
+	require.Len(t, policy.queue, 1)
+	assert.Equal(t, []byte("other"), policy.queue[0].data)
+	assert.Equal(t, size([]byte("other")), policy.currentMemorySize)
+}
+
 func TestIngestionIsBiggerThanAMaxSize(t *testing.T) {
 	policy := newRetryPolicy()
 	big := []byte("verybigingestion")
@@ -228,3 +269,134 @@ func TestRetryPolicy_ingest(t *testing.T) {
 	assert.Equal(t, 5, counter)
 
 }
+
+func TestRetryPolicy_backoff(t *testing.T) {
+	policy := newRetryPolicy()
+	policy.minDelay = time.Second
+	policy.maxDelay = 10 * time.Second
+
+	for attempt, max := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second} {
+		for i := 0; i < 100; i++ {
+			delay := policy.backoff(attempt+1, nil)
+			assert.True(t, delay >= max/2 && delay <= max, "attempt %d: %v", attempt+1, delay)
+		}
+	}
+	assert.True(t, policy.backoff(100, nil) <= 10*time.Second)
+
+	// Retry-After is honored if it's longer
+	assert.Equal(t, time.Minute, policy.backoff(1, &StatusError{StatusCode: 503, RetryAfter: time.Minute}))
+	assert.True(t, policy.backoff(1, &StatusError{StatusCode: 503, RetryAfter: time.Millisecond}) >= 500*time.Millisecond)
+}
+
+func TestRetryPolicy_drop(t *testing.T) {
+	t.Run("rejected data is dropped without retries", func(t *testing.T) {
+		policy := newRetryPolicy()
+		var dropped []string
+		var dropErr error
+		policy.onDrop = func(data []byte, err error) {
+			dropped = append(dropped, string(data))
+			dropErr = err
+		}
+
+		calls := 0
+		var callbackErr error
+		policy.ingest(&retryPolicyRequest{
+			data: []byte("first"),
+			httpRequest: func(data []byte, ingestionURL string) error {
+				calls++
+				return &StatusError{StatusCode: 400, Status: "400 Bad Request"}
+			},
+			callback: func(err error) { callbackErr = err },
+		})
+
+		assert.Equal(t, 1, calls)
+		assert.Empty(t, policy.queue)
+		assert.Equal(t, []string{"first"}, dropped)
+		assert.Equal(t, dropErr, callbackErr)
+		assert.True(t, isPermanent(dropErr))
+	})
+
+	t.Run("transient errors are retried", func(t *testing.T) {
+		policy := newRetryPolicy()
+		policy.onDrop = func(data []byte, err error) {
+			assert.Fail(t, "must not be dropped")
+		}
+		for _, status := range []int{408, 429, 500, 503} {
+			policy.ingest(&retryPolicyRequest{
+				data: []byte("data"),
+				httpRequest: func(data []byte, ingestionURL string) error {
+					return &StatusError{StatusCode: status}
+				},
+				callback: func(err error) {},
+			})
+		}
+		assert.Len(t, policy.queue, 4)
+	})
+
+	t.Run("the oldest data is dropped when the queue is full", func(t *testing.T) {
+		policy := newRetryPolicy()
+		policy.SetMaxSize(size([]byte("first")) + 1)
+		var dropped []string
+		policy.onDrop = func(data []byte, err error) {
+			assert.Equal(t, ErrQueueIsFull, err)
+			dropped = append(dropped, string(data))
+		}
+
+		var callbackErr error
+		policy.putToQueue([]byte("first"), func(err error) { callbackErr = err })
+		policy.putToQueue([]byte("fifth"), func(err error) {})
+
+		assert.Equal(t, []string{"first"}, dropped)
+		assert.Equal(t, ErrQueueIsFull, callbackErr)
+		assert.Equal(t, []byte("fifth"), policy.queue[0].data)
+	})
+}
+
+func TestRetryPolicy_retryLoop(t *testing.T) {
+	policy := newRetryPolicy()
+	policy.minDelay = 10 * time.Millisecond
+	policy.maxDelay = 50 * time.Millisecond
+
+	var mux sync.Mutex
+	var sent []string
+	calls := 0
+	httpRequest := func(data []byte, ingestionURL string) error {
+		mux.Lock()
+		defer mux.Unlock()
+		calls++
+		// the server is down for the first 3 requests
+		if calls <= 3 {
+			return errors.New("some connection problem")
+		}
+		sent = append(sent, string(data))
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		policy.retryLoop(ctx, "", httpRequest)
+		close(done)
+	}()
+
+	policy.ingest(&retryPolicyRequest{
+		data:        []byte("first"),
+		httpRequest: httpRequest,
+		callback:    func(err error) {},
+	})
+
+	// the data is sent without new ingest calls
+	assert.Eventually(t, func() bool {
+		mux.Lock()
+		defer mux.Unlock()
+		return len(sent) == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Zero(t, policy.backlog())
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "retry loop is not stopped")
+	}
+}
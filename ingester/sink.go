@@ -0,0 +1,338 @@
+package ingester
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/json"
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultSinkBatchSize     = 100
+	defaultSinkFlushInterval = 10 * time.Second
+	defaultSinkBufferSize    = 10000
+)
+
+// SinkRecord is an exposure or an event delivered to EventSink, only one of the fields is set
+type SinkRecord struct {
+	Exposure *core.Exposure `json:"exposure,omitempty"`
+	Event    *core.Event    `json:"event,omitempty"`
+}
+
+// EventSink receives the exposures and the tracked events in batches, see Ingester.AddSink.
+// Write is never called concurrently for the same sink, the records must not be modified
+type EventSink interface {
+	Write(records []*SinkRecord) error
+}
+
+// SinkOptions configures batching and backpressure of EventSink, zero values mean defaults
+type SinkOptions struct {
+	BatchSize     int           // max number of records passed to Write, 100 by default
+	FlushInterval time.Duration // max time a record waits for the batch, 10 seconds by default
+	BufferSize    int           // max number of records waiting for Write, new records are dropped if the buffer is full
+}
+
+func (o SinkOptions) withDefaults() SinkOptions {
+	if o.BatchSize <= 0 {
+		o.BatchSize = defaultSinkBatchSize
+	}
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = defaultSinkFlushInterval
+	}
+	if o.BufferSize <= 0 {
+		o.BufferSize = defaultSinkBufferSize
+	}
+	return o
+}
+
+// sinkWorker batches the records of the sink in its own goroutine,
+// so a slow sink never blocks flag calls nor other sinks
+type sinkWorker struct {
+	sink    EventSink
+	opts    SinkOptions
+	log     log.Logger
+	records chan *SinkRecord
+	flushes chan chan<- error
+	dropped int64 // atomic
+
+	mux  sync.Mutex
+	quit chan struct{} // nil if the worker is not running
+	done chan struct{} // closed when the last started worker returns
+}
+
+func newSinkWorker(sink EventSink, opts SinkOptions, logger log.Logger) *sinkWorker {
+	opts = opts.withDefaults()
+	return &sinkWorker{
+		sink:    sink,
+		opts:    opts,
+		log:     logger,
+		records: make(chan *SinkRecord, opts.BufferSize),
+		flushes: make(chan chan<- error),
+	}
+}
+
+// push never blocks, the record is dropped if the buffer is full
+func (w *sinkWorker) push(record *SinkRecord) {
+	select {
+	case w.records <- record:
+	default:
+		if atomic.AddInt64(&w.dropped, 1) == 1 {
+			w.log.Warn("Ingester: sink buffer is full, records are dropped", "bufferSize", w.opts.BufferSize)
+		}
+	}
+}
+
+// start starts the worker. If the previous worker was stopped by timeout and still writes its records,
+// the new one waits for it, so Write is never called concurrently
+func (w *sinkWorker) start() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.quit != nil {
+		return
+	}
+	prev := w.done
+	w.quit = make(chan struct{})
+	w.done = make(chan struct{})
+	go func(quit, done chan struct{}) {
+		if prev != nil {
+			<-prev
+		}
+		w.run(quit, done)
+	}(w.quit, w.done)
+}
+
+// stop writes the buffered records and stops the worker, returns true if timeout is reached.
+// done is kept until the next start, the worker may still be writing after the timeout
+func (w *sinkWorker) stop(timeout time.Duration) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.quit == nil {
+		return false
+	}
+	close(w.quit)
+	w.quit = nil
+
+	select {
+	case <-w.done:
+		return false
+	case <-time.After(timeout):
+		return true
+	}
+}
+
+func (w *sinkWorker) run(quit, done chan struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(w.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*SinkRecord, 0, w.opts.BatchSize)
+	for {
+		select {
+		case record := <-w.records:
+			batch = append(batch, record)
+			if len(batch) >= w.opts.BatchSize {
+				batch, _ = w.write(batch)
+			}
+		case <-ticker.C:
+			batch, _ = w.write(batch)
+		case result := <-w.flushes:
+			var err error
+			batch, err = w.drain(batch)
+			result <- err
+		case <-quit:
+			_, _ = w.drain(batch)
+			return
+		}
+	}
+}
+
+// drain writes the batch and the buffered records, returns the first error
+func (w *sinkWorker) drain(batch []*SinkRecord) ([]*SinkRecord, error) {
+	var firstErr error
+	for {
+		select {
+		case record := <-w.records:
+			batch = append(batch, record)
+			if len(batch) < w.opts.BatchSize {
+				continue
+			}
+		default:
+			batch, err := w.write(batch)
+			if firstErr == nil {
+				firstErr = err
+			}
+			return batch, firstErr
+		}
+		var err error
+		if batch, err = w.write(batch); firstErr == nil {
+			firstErr = err
+		}
+	}
+}
+
+// write passes the batch to the sink, returns the empty batch to reuse
+func (w *sinkWorker) write(batch []*SinkRecord) ([]*SinkRecord, error) {
+	if len(batch) == 0 {
+		return batch, nil
+	}
+	err := w.sink.Write(batch)
+	if err != nil {
+		atomic.AddInt64(&w.dropped, int64(len(batch)))
+		w.log.Warn("Ingester: sink failed to write records, dropping them", "records", len(batch), "error", err)
+	}
+	return make([]*SinkRecord, 0, w.opts.BatchSize), err
+}
+
+// flush writes the buffered records, returns the first error or ctx error
+func (w *sinkWorker) flush(ctx context.Context) error {
+	w.mux.Lock()
+	done := w.done
+	w.mux.Unlock()
+	if done == nil {
+		return nil
+	}
+
+	result := make(chan error, 1)
+	select {
+	case w.flushes <- result:
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (w *sinkWorker) droppedCount() int {
+	return int(atomic.LoadInt64(&w.dropped))
+}
+
+// WriterSink writes the records as JSON lines to io.Writer
+type WriterSink struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+// NewWriterSink returns the sink which writes the records as JSON lines to w
+func NewWriterSink(w io.Writer) *WriterSink {
+	return &WriterSink{w: w}
+}
+
+// Write writes the records, one JSON object per line
+func (s *WriterSink) Write(records []*SinkRecord) error {
+	buf, err := jsonLines(records)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, err = s.w.Write(buf)
+	return err
+}
+
+// FileSink appends the records as JSON lines to the file
+type FileSink struct {
+	mux  sync.Mutex
+	path string
+}
+
+// NewFileSink returns the sink which appends the records as JSON lines to the file,
+// the file is created if it doesn't exist
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+// Write appends the records to the file, one JSON object per line
+func (s *FileSink) Write(records []*SinkRecord) error {
+	buf, err := jsonLines(records)
+	if err != nil {
+		return err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "cannot open sink file")
+	}
+	if _, err := f.Write(buf); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "cannot write sink file")
+	}
+	return f.Close()
+}
+
+// WebhookSink posts the records as JSON array to the URL
+type WebhookSink struct {
+	url    string
+	client *http.Client
+	header http.Header
+}
+
+// NewWebhookSink returns the sink which posts the records as JSON array to the url.
+// client nil means a client with DefaultTimeout, header is added to every request
+func NewWebhookSink(url string, client *http.Client, header http.Header) *WebhookSink {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	return &WebhookSink{url: url, client: client, header: header}
+}
+
+// Write posts the records, non 2xx response is returned as *StatusError
+func (s *WebhookSink) Write(records []*SinkRecord) error {
+	buf, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	for key, values := range s.header {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return nil
+}
+
+func jsonLines(records []*SinkRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,294 @@
+package ingester
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/json"
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingSink records the batches, blocks Write while block is not closed
+type recordingSink struct {
+	mux     sync.Mutex
+	batches [][]*SinkRecord
+	block   chan struct{}
+	err     error
+}
+
+func (s *recordingSink) Write(records []*SinkRecord) error {
+	if s.block != nil {
+		<-s.block
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.batches = append(s.batches, records)
+	return s.err
+}
+
+func (s *recordingSink) batchSizes() []int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var res []int
+	for _, batch := range s.batches {
+		res = append(res, len(batch))
+	}
+	return res
+}
+
+func eventRecord(name string) *SinkRecord {
+	return &SinkRecord{Event: &core.Event{Name: name, Entity: &core.Entity{ID: "1"}}}
+}
+
+func TestSinkWorker(t *testing.T) {
+	t.Run("records are written in batches of BatchSize", func(t *testing.T) {
+		sink := &recordingSink{}
+		w := newSinkWorker(sink, SinkOptions{BatchSize: 2, FlushInterval: time.Hour}, log.Default())
+		w.start()
+		for i := 0; i < 5; i++ {
+			w.push(eventRecord("event"))
+		}
+		assert.Eventually(t, func() bool {
+			return len(sink.batchSizes()) == 2
+		}, time.Second, 5*time.Millisecond)
+
+		// the rest is written on stop
+		assert.False(t, w.stop(time.Second))
+		assert.Equal(t, []int{2, 2, 1}, sink.batchSizes())
+	})
+
+	t.Run("not full batch is written after FlushInterval", func(t *testing.T) {
+		sink := &recordingSink{}
+		w := newSinkWorker(sink, SinkOptions{BatchSize: 100, FlushInterval: 20 * time.Millisecond}, log.Default())
+		w.start()
+		defer w.stop(time.Second)
+
+		w.push(eventRecord("event"))
+		assert.Eventually(t, func() bool {
+			return len(sink.batchSizes()) == 1
+		}, time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("records are dropped if the buffer of the slow sink is full", func(t *testing.T) {
+		sink := &recordingSink{block: make(chan struct{})}
+		w := newSinkWorker(sink, SinkOptions{BatchSize: 1, FlushInterval: time.Hour, BufferSize: 2}, log.Default())
+		w.start()
+
+		// the first record is being written, 2 records are buffered, the rest is dropped
+		w.push(eventRecord("event"))
+		assert.Eventually(t, func() bool {
+			return len(w.records) == 0
+		}, time.Second, 5*time.Millisecond)
+		for i := 0; i < 5; i++ {
+			w.push(eventRecord("event"))
+		}
+		assert.Equal(t, 3, w.droppedCount())
+
+		close(sink.block)
+		assert.False(t, w.stop(time.Second))
+		assert.Equal(t, []int{1, 1, 1}, sink.batchSizes())
+	})
+
+	t.Run("failed batch is dropped", func(t *testing.T) {
+		sink := &recordingSink{err: errors.New("warehouse is down")}
+		w := newSinkWorker(sink, SinkOptions{BatchSize: 2}, log.Default())
+		w.start()
+		w.push(eventRecord("event"))
+		w.push(eventRecord("event"))
+		w.push(eventRecord("event"))
+		assert.False(t, w.stop(time.Second))
+		assert.Equal(t, 3, w.droppedCount())
+	})
+
+	t.Run("flush writes the buffered records and returns the error", func(t *testing.T) {
+		sink := &recordingSink{}
+		w := newSinkWorker(sink, SinkOptions{BatchSize: 2, FlushInterval: time.Hour}, log.Default())
+		assert.NoError(t, w.flush(context.Background()))
+
+		w.start()
+		defer w.stop(time.Second)
+		for i := 0; i < 3; i++ {
+			w.push(eventRecord("event"))
+		}
+		assert.NoError(t, w.flush(context.Background()))
+		assert.Equal(t, []int{2, 1}, sink.batchSizes())
+
+		sink.err = errors.New("warehouse is down")
+		w.push(eventRecord("event"))
+		assert.EqualError(t, w.flush(context.Background()), "warehouse is down")
+	})
+
+	t.Run("stop returns true if the sink is too slow", func(t *testing.T) {
+		sink := &recordingSink{block: make(chan struct{})}
+		defer close(sink.block)
+		w := newSinkWorker(sink, SinkOptions{}, log.Default())
+		w.start()
+		w.push(eventRecord("event"))
+		assert.True(t, w.stop(10*time.Millisecond))
+	})
+}
+
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	sink := NewWriterSink(&buf)
+	assert.NoError(t, sink.Write([]*SinkRecord{
+		eventRecord("first"),
+		{Exposure: &core.Exposure{Codename: "flag", Variation: "on", MethodCalled: "isEnabled"}},
+	}))
+
+	scanner := bufio.NewScanner(&buf)
+	var records []*SinkRecord
+	for scanner.Scan() {
+		var record *SinkRecord
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	if assert.Len(t, records, 2) {
+		assert.Equal(t, "first", records[0].Event.Name)
+		assert.Nil(t, records[0].Exposure)
+		assert.Equal(t, "flag", records[1].Exposure.Codename)
+		assert.Nil(t, records[1].Event)
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flagger-sink")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.jsonl")
+	sink := NewFileSink(path)
+	assert.NoError(t, sink.Write([]*SinkRecord{eventRecord("first")}))
+	assert.NoError(t, sink.Write([]*SinkRecord{eventRecord("second"), eventRecord("third")}))
+
+	buf, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := bytes.Split(bytes.TrimSpace(buf), []byte("\n"))
+	if assert.Len(t, lines, 3) {
+		var record *SinkRecord
+		assert.NoError(t, json.Unmarshal(lines[2], &record))
+		assert.Equal(t, "third", record.Event.Name)
+	}
+
+	assert.Error(t, NewFileSink(filepath.Join(dir, "missing", "events.jsonl")).Write([]*SinkRecord{eventRecord("first")}))
+}
+
+func TestWebhookSink(t *testing.T) {
+	t.Run("records are posted as JSON array with the headers", func(t *testing.T) {
+		var records []*SinkRecord
+		var token string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token = r.Header.Get("X-Token")
+			body, err := ioutil.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.NoError(t, json.Unmarshal(body, &records))
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer server.Close()
+
+		sink := NewWebhookSink(server.URL, server.Client(), http.Header{"X-Token": []string{"secret"}})
+		assert.NoError(t, sink.Write([]*SinkRecord{eventRecord("first"), eventRecord("second")}))
+		assert.Equal(t, "secret", token)
+		if assert.Len(t, records, 2) {
+			assert.Equal(t, "second", records[1].Event.Name)
+		}
+	})
+
+	t.Run("non 2xx status is an error", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer server.Close()
+
+		err := NewWebhookSink(server.URL, server.Client(), nil).Write([]*SinkRecord{eventRecord("first")})
+		statusErr, ok := err.(*StatusError)
+		assert.True(t, ok)
+		assert.Equal(t, http.StatusBadGateway, statusErr.StatusCode)
+	})
+}
+
+func TestIngester_sinks(t *testing.T) {
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0, nil)
+	airshipCalls := 0
+	ingester.strategy.httpRequest = func(data []byte, ingestionURL string) error {
+		airshipCalls++
+		return nil
+	}
+	first, second := &recordingSink{}, &recordingSink{}
+	ingester.AddSink(first, SinkOptions{})
+	ingester.AddSink(second, SinkOptions{})
+	ingester.SetAirshipIngestion(false)
+	ingester.Activate("", &core.SDKConfig{SDKIngestionInterval: 1000, SDKIngestionMaxItems: 500})
+
+	entity := &core.Entity{ID: "1"}
+	ingester.PublishExposure(&core.Exposure{Codename: "flag", Variation: "on", Entity: entity}, true)
+	ingester.Track(&core.Event{Name: "purchase", Entity: entity})
+	ingester.Publish(entity)
+	ingester.SendEmptyIngestion()
+	assert.False(t, ingester.Shutdown(time.Second))
+
+	assert.Zero(t, airshipCalls)
+	for _, sink := range []*recordingSink{first, second} {
+		if assert.Len(t, sink.batches, 1) && assert.Len(t, sink.batches[0], 2) {
+			assert.Equal(t, "flag", sink.batches[0][0].Exposure.Codename)
+			assert.Equal(t, 1.0, sink.batches[0][0].Exposure.SamplingWeight)
+			assert.Equal(t, "purchase", sink.batches[0][1].Event.Name)
+		}
+	}
+	assert.Zero(t, ingester.Status().SinkDropped)
+}
+
+// slowSink sleeps in Write and counts the concurrent calls
+type slowSink struct {
+	delay      time.Duration
+	writing    int32
+	concurrent int32
+	written    int32
+}
+
+func (s *slowSink) Write(records []*SinkRecord) error {
+	if atomic.AddInt32(&s.writing, 1) > 1 {
+		atomic.AddInt32(&s.concurrent, 1)
+	}
+	time.Sleep(s.delay)
+	atomic.AddInt32(&s.written, int32(len(records)))
+	atomic.AddInt32(&s.writing, -1)
+	return nil
+}
+
+func TestIngester_sinksRestartAfterTimeout(t *testing.T) {
+	ingester := NewIngester(&core.SDKInfo{Name: "golang", Version: "3.0.0"}, 0, nil)
+	sink := &slowSink{delay: 20 * time.Millisecond}
+	ingester.AddSink(sink, SinkOptions{BatchSize: 1, FlushInterval: time.Hour})
+	ingester.SetAirshipIngestion(false)
+	config := &core.SDKConfig{SDKIngestionInterval: 1000, SDKIngestionMaxItems: 500}
+	ingester.Activate("", config)
+
+	entity := &core.Entity{ID: "1"}
+	for i := 0; i < 10; i++ {
+		ingester.Track(&core.Event{Name: "purchase", Entity: entity})
+	}
+	// the sink is still writing the buffered records when it is started again
+	assert.True(t, ingester.Shutdown(time.Millisecond))
+	ingester.Activate("", config)
+	for i := 0; i < 10; i++ {
+		ingester.Track(&core.Event{Name: "purchase", Entity: entity})
+	}
+	assert.False(t, ingester.Shutdown(time.Second))
+
+	assert.Zero(t, atomic.LoadInt32(&sink.concurrent))
+	assert.Equal(t, int32(20), atomic.LoadInt32(&sink.written))
+}
@@ -0,0 +1,403 @@
+package ingester
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultSpoolMaxSize is the max size of the spool used when no size is provided
+	DefaultSpoolMaxSize = 200 << 20 // 200 MB
+
+	defaultSegmentSize = 4 << 20 // 4 MB
+	segmentExt         = ".seg"
+	cursorFile         = "cursor"
+
+	// record is the header followed by the data
+	// header is big endian uint32 length of the data and uint32 crc32(IEEE) checksum of the data
+	recordHeaderSize = 8
+)
+
+// Spool is a durable FIFO queue of ingestion batches stored on disk.
+// Batches are appended to segment files under the directory, a segment file is removed once all its batches are sent.
+// Batches that are not sent are replayed by the next Ingester which uses the same directory, e.g. after a restart.
+//
+// Spool is thread safe, but the directory must not be shared by several processes or Spool instances
+type Spool struct {
+	dir         string
+	maxSize     int64
+	segmentSize int64
+	log         log.Logger
+
+	mux      sync.Mutex
+	segments []*segment // from the oldest to the newest, batches are appended to the last one
+	size     int64      // total size of all segments
+	offset   int64      // read offset in the first segment
+}
+
+type segment struct {
+	id      uint64
+	size    int64
+	records int // number of batches which are not sent yet
+}
+
+func (s *segment) name() string {
+	return fmt.Sprintf("%020d%s", s.id, segmentExt)
+}
+
+// OpenSpool opens the spool in the dir, the dir is created if it doesn't exist.
+// Corrupted or partially written batches found in the existing segments are dropped.
+// maxSize limits the total size of the segments, the oldest batches are dropped when the limit is reached,
+// non-positive maxSize means DefaultSpoolMaxSize
+func OpenSpool(dir string, maxSize int64, logger log.Logger) (*Spool, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultSpoolMaxSize
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+	segmentSize := int64(defaultSegmentSize)
+	if maxSize/8 < segmentSize {
+		segmentSize = maxSize / 8
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "cannot create spool directory")
+	}
+
+	s := &Spool{
+		dir:         dir,
+		maxSize:     maxSize,
+		segmentSize: segmentSize,
+		log:         logger,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Len returns the number of batches in the spool
+func (s *Spool) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	n := 0
+	for _, seg := range s.segments {
+		n += seg.records
+	}
+	return n
+}
+
+// load scans existing segments, truncates corrupted tails and restores the read offset
+func (s *Spool) load() error {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return errors.Wrap(err, "cannot read spool directory")
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, &segment{id: id})
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i].id < s.segments[j].id
+	})
+
+	cursorID, cursorOffset := s.readCursor()
+
+	segments := s.segments[:0]
+	for _, seg := range s.segments {
+		if seg.id < cursorID {
+			// segment was sent, but not removed
+			_ = os.Remove(s.path(seg))
+			continue
+		}
+		offset := int64(0)
+		if seg.id == cursorID {
+			offset = cursorOffset
+		}
+		if err := s.scan(seg, offset); err != nil {
+			return err
+		}
+		if seg.id == cursorID {
+			s.offset = offset
+		}
+		segments = append(segments, seg)
+		s.size += seg.size
+	}
+	s.segments = segments
+	return nil
+}
+
+// scan counts the records after the offset and truncates the segment after the last valid record
+func (s *Spool) scan(seg *segment, offset int64) error {
+	buf, err := ioutil.ReadFile(s.path(seg))
+	if err != nil {
+		return errors.Wrap(err, "cannot read spool segment")
+	}
+	if offset > int64(len(buf)) {
+		offset = int64(len(buf))
+	}
+
+	valid := int64(0)
+	for valid < int64(len(buf)) {
+		n, err := readRecord(buf[valid:], nil)
+		if err != nil {
+			s.log.Warn("Ingester: spool segment is corrupted, dropping the rest of it", "segment", seg.name(), "offset", valid, "error", err)
+			if err := os.Truncate(s.path(seg), valid); err != nil {
+				return errors.Wrap(err, "cannot truncate spool segment")
+			}
+			break
+		}
+		if valid >= offset {
+			seg.records++
+		}
+		valid += n
+	}
+	seg.size = valid
+	return nil
+}
+
+// push appends the batch to the last segment, the oldest segments are dropped if the size limit is reached.
+// returns the dropped batches
+func (s *Spool) push(data []byte) (dropped [][]byte, _ error) {
+	recordSize := int64(recordHeaderSize + len(data))
+	if recordSize > s.maxSize {
+		return nil, errors.Errorf("batch of %d bytes exceeds the spool size", len(data))
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	last := s.last()
+	if last == nil || (last.size > 0 && last.size+recordSize > s.segmentSize) {
+		id := uint64(1)
+		if last != nil {
+			id = last.id + 1
+		}
+		last = &segment{id: id}
+		s.segments = append(s.segments, last)
+	}
+
+	// drop the oldest segments but the last one
+	for s.size+recordSize > s.maxSize && len(s.segments) > 1 {
+		dropped = append(dropped, s.readFirst()...)
+		s.removeFirst()
+	}
+
+	f, err := os.OpenFile(s.path(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return dropped, errors.Wrap(err, "cannot open spool segment")
+	}
+	defer func() { _ = f.Close() }()
+
+	record := make([]byte, recordSize)
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(data))
+	copy(record[recordHeaderSize:], data)
+
+	if _, err := f.Write(record); err != nil {
+		// the partially written record is dropped by the next OpenSpool
+		return dropped, errors.Wrap(err, "cannot write spool segment")
+	}
+	if err := f.Sync(); err != nil {
+		return dropped, errors.Wrap(err, "cannot sync spool segment")
+	}
+
+	last.size += recordSize
+	last.records++
+	s.size += recordSize
+	return dropped, nil
+}
+
+// spoolPosition identifies the batch returned by peek
+type spoolPosition struct {
+	segment uint64
+	offset  int64
+	size    int64
+}
+
+// peek returns the oldest batch and its position, nil if the spool is empty.
+// A corrupted segment is dropped and the next one is read
+func (s *Spool) peek() ([]byte, spoolPosition) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for len(s.segments) > 0 {
+		first := s.segments[0]
+		if first.records == 0 {
+			if len(s.segments) == 1 {
+				return nil, spoolPosition{}
+			}
+			s.removeFirst()
+			continue
+		}
+
+		data, err := s.readAt(first, s.offset)
+		if err != nil {
+			s.log.Warn("Ingester: cannot read spool segment, dropping it", "segment", first.name(), "batches", first.records, "error", err)
+			s.removeFirst()
+			continue
+		}
+		return data, spoolPosition{segment: first.id, offset: s.offset, size: int64(recordHeaderSize + len(data))}
+	}
+	return nil, spoolPosition{}
+}
+
+// pop removes the batch returned by peek. Nothing is removed if the batch is not the oldest one anymore,
+// e.g. push has dropped its segment meanwhile
+func (s *Spool) pop(pos spoolPosition) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(s.segments) == 0 {
+		return
+	}
+	first := s.segments[0]
+	if first.id != pos.segment || s.offset != pos.offset || first.records == 0 {
+		return
+	}
+
+	first.records--
+	s.offset += pos.size
+	if first.records == 0 {
+		s.removeFirst()
+		return
+	}
+	s.writeCursor(first.id, s.offset)
+}
+
+func (s *Spool) readAt(seg *segment, offset int64) ([]byte, error) {
+	f, err := os.Open(s.path(seg))
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	header := make([]byte, recordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return nil, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[0:4]))
+	if length > seg.size-offset-recordHeaderSize {
+		return nil, errors.Errorf("bad record length %d", length)
+	}
+
+	record := make([]byte, recordHeaderSize+length)
+	if _, err := f.ReadAt(record, offset); err != nil {
+		return nil, err
+	}
+	var data []byte
+	if _, err := readRecord(record, &data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// readFirst returns not sent batches of the first segment
+func (s *Spool) readFirst() [][]byte {
+	first := s.segments[0]
+	if first.records == 0 {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(s.path(first))
+	if err != nil {
+		return nil
+	}
+
+	var res [][]byte
+	for offset := s.offset; offset < int64(len(buf)); {
+		var data []byte
+		n, err := readRecord(buf[offset:], &data)
+		if err != nil {
+			break
+		}
+		res = append(res, data)
+		offset += n
+	}
+	return res
+}
+
+// removeFirst removes the first segment and moves the cursor to the next one
+func (s *Spool) removeFirst() {
+	first := s.segments[0]
+	_ = os.Remove(s.path(first))
+	s.size -= first.size
+	s.segments = s.segments[1:]
+	s.offset = 0
+	if len(s.segments) > 0 {
+		s.writeCursor(s.segments[0].id, 0)
+	} else {
+		_ = os.Remove(filepath.Join(s.dir, cursorFile))
+	}
+}
+
+func (s *Spool) last() *segment {
+	if len(s.segments) == 0 {
+		return nil
+	}
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) path(seg *segment) string {
+	return filepath.Join(s.dir, seg.name())
+}
+
+// the cursor is the id of the first segment and the read offset in it
+func (s *Spool) writeCursor(id uint64, offset int64) {
+	cursor := fmt.Sprintf("%d %d", id, offset)
+	if err := ioutil.WriteFile(filepath.Join(s.dir, cursorFile), []byte(cursor), 0600); err != nil {
+		s.log.Warn("Ingester: cannot write spool cursor", "error", err)
+	}
+}
+
+func (s *Spool) readCursor() (id uint64, offset int64) {
+	buf, err := ioutil.ReadFile(filepath.Join(s.dir, cursorFile))
+	if err != nil {
+		return 0, 0
+	}
+	if _, err := fmt.Fscan(bytes.NewReader(buf), &id, &offset); err != nil || offset < 0 {
+		s.log.Warn("Ingester: spool cursor is corrupted, replaying from the beginning", "error", err)
+		return 0, 0
+	}
+	return id, offset
+}
+
+// readRecord validates the record at the beginning of buf and returns its size.
+// data is set to the record data if it's not nil
+func readRecord(buf []byte, data *[]byte) (int64, error) {
+	if len(buf) < recordHeaderSize {
+		return 0, io.ErrUnexpectedEOF
+	}
+	length := int64(binary.BigEndian.Uint32(buf[0:4]))
+	if length > int64(len(buf)-recordHeaderSize) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	payload := buf[recordHeaderSize : recordHeaderSize+length]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(buf[4:8]) {
+		return 0, errors.New("checksum mismatch")
+	}
+	if data != nil {
+		*data = payload
+	}
+	return recordHeaderSize + length, nil
+}
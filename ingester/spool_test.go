@@ -0,0 +1,272 @@
+package ingester
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "flagger-spool")
+	assert.NoError(t, err)
+	return dir
+}
+
+func mustOpenSpool(t *testing.T, dir string, maxSize int64) *Spool {
+	spool, err := OpenSpool(dir, maxSize, log.Default())
+	assert.NoError(t, err)
+	return spool
+}
+
+func drain(spool *Spool) []string {
+	var res []string
+	for {
+		data, pos := spool.peek()
+		if data == nil {
+			return res
+		}
+		res = append(res, string(data))
+		spool.pop(pos)
+	}
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.NoError(t, err)
+	return files
+}
+
+func TestSpool(t *testing.T) {
+	t.Run("batches are read in order across segments, sent segments are removed", func(t *testing.T) {
+		dir := tempSpoolDir(t)
+		defer os.RemoveAll(dir)
+
+		// a batch record is 15 bytes, a segment of 30 bytes holds 2 batches
+		spool := mustOpenSpool(t, dir, 240)
+		for i := 0; i < 6; i++ {
+			dropped, err := spool.push([]byte(fmt.Sprintf("batch-%d", i)))
+			assert.NoError(t, err)
+			assert.Empty(t, dropped)
+		}
+		assert.Equal(t, 6, spool.Len())
+		assert.Len(t, segmentFiles(t, dir), 3)
+
+		assert.Equal(t, []string{"batch-0", "batch-1", "batch-2", "batch-3", "batch-4", "batch-5"}, drain(spool))
+		assert.Zero(t, spool.Len())
+		assert.Empty(t, segmentFiles(t, dir))
+	})
+
+	t.Run("not sent batches are replayed after reopening", func(t *testing.T) {
+		dir := tempSpoolDir(t)
+		defer os.RemoveAll(dir)
+
+		spool := mustOpenSpool(t, dir, 400)
+		for i := 0; i < 5; i++ {
+			_, err := spool.push([]byte(fmt.Sprintf("batch-%d", i)))
+			assert.NoError(t, err)
+		}
+		// batch-0, batch-1 and batch-2 are sent
+		for i := 0; i < 3; i++ {
+			data, pos := spool.peek()
+			assert.NotNil(t, data)
+			spool.pop(pos)
+		}
+
+		reopened := mustOpenSpool(t, dir, 400)
+		assert.Equal(t, 2, reopened.Len())
+		assert.Equal(t, []string{"batch-3", "batch-4"}, drain(reopened))
+
+		// new batches continue after the replayed ones
+		_, err := reopened.push([]byte("batch-5"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"batch-5"}, drain(mustOpenSpool(t, dir, 400)))
+	})
+
+	t.Run("the oldest segments are dropped when the size limit is reached", func(t *testing.T) {
+		dir := tempSpoolDir(t)
+		defer os.RemoveAll(dir)
+
+		// a batch record is 15 bytes, a segment of 16 bytes holds 1 batch, the spool holds 8 batches
+		spool := mustOpenSpool(t, dir, 128)
+		var dropped []string
+		for i := 0; i < 10; i++ {
+			res, err := spool.push([]byte(fmt.Sprintf("batch-%d", i)))
+			assert.NoError(t, err)
+			for _, data := range res {
+				dropped = append(dropped, string(data))
+			}
+		}
+		assert.Equal(t, []string{"batch-0", "batch-1"}, dropped)
+		assert.Equal(t, 8, spool.Len())
+		data, _ := spool.peek()
+		assert.Equal(t, "batch-2", string(data))
+
+		_, err := spool.push(make([]byte, 128))
+		assert.Error(t, err)
+	})
+
+	t.Run("batch dropped while it is sent doesn't pop the next one", func(t *testing.T) {
+		dir := tempSpoolDir(t)
+		defer os.RemoveAll(dir)
+
+		// a segment holds 1 batch, the spool holds 8 batches
+		spool := mustOpenSpool(t, dir, 128)
+		for i := 0; i < 8; i++ {
+			_, err := spool.push([]byte(fmt.Sprintf("batch-%d", i)))
+			assert.NoError(t, err)
+		}
+		data, pos := spool.peek()
+		assert.Equal(t, "batch-0", string(data))
+
+		// batch-0 is dropped by push while it is sent
+		dropped, err := spool.push([]byte("batch-8"))
+		assert.NoError(t, err)
+		assert.Equal(t, [][]byte{[]byte("batch-0")}, dropped)
+
+		spool.pop(pos)
+		assert.Equal(t, []string{"batch-1", "batch-2", "batch-3", "batch-4", "batch-5", "batch-6", "batch-7", "batch-8"}, drain(spool))
+	})
+
+	t.Run("corrupted and partially written batches are dropped", func(t *testing.T) {
+		dir := tempSpoolDir(t)
+		defer os.RemoveAll(dir)
+
+		spool := mustOpenSpool(t, dir, 240)
+		for i := 0; i < 4; i++ {
+			_, err := spool.push([]byte(fmt.Sprintf("batch-%d", i)))
+			assert.NoError(t, err)
+		}
+		files := segmentFiles(t, dir)
+		assert.Len(t, files, 2)
+
+		// flip a byte of batch-1 data
+		buf, err := ioutil.ReadFile(files[0])
+		assert.NoError(t, err)
+		buf[len(buf)-1] ^= 0xff
+		assert.NoError(t, ioutil.WriteFile(files[0], buf, 0600))
+
+		// partially written batch at the end of the last segment
+		f, err := os.OpenFile(files[1], os.O_WRONLY|os.O_APPEND, 0600)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte{0, 0, 0, 100, 1, 2})
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+
+		reopened := mustOpenSpool(t, dir, 240)
+		assert.Equal(t, 3, reopened.Len())
+		assert.Equal(t, []string{"batch-0", "batch-2", "batch-3"}, drain(reopened))
+	})
+
+	t.Run("corrupted cursor replays from the beginning", func(t *testing.T) {
+		dir := tempSpoolDir(t)
+		defer os.RemoveAll(dir)
+
+		spool := mustOpenSpool(t, dir, 400)
+		_, err := spool.push([]byte("batch-0"))
+		assert.NoError(t, err)
+		assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, cursorFile), []byte("garbage"), 0600))
+
+		assert.Equal(t, []string{"batch-0"}, drain(mustOpenSpool(t, dir, 400)))
+	})
+}
+
+func TestRetryPolicy_spool(t *testing.T) {
+	t.Run("failed data is spooled and sent by the next successful request", func(t *testing.T) {
+		dir := tempSpoolDir(t)
+		defer os.RemoveAll(dir)
+
+		policy := newRetryPolicy()
+		policy.spool = mustOpenSpool(t, dir, 0)
+
+		var sent []string
+		fail := true
+		httpRequest := func(data []byte, ingestionURL string) error {
+			if fail {
+				return errors.New("some connection problem")
+			}
+			sent = append(sent, string(data))
+			return nil
+		}
+
+		called := 0
+		for _, data := range []string{"first", "second"} {
+			policy.ingest(&retryPolicyRequest{
+				data:        []byte(data),
+				httpRequest: httpRequest,
+				callback:    func(err error) { called++ },
+			})
+		}
+		// spooled data doesn't hold the callback
+		assert.Equal(t, 2, called)
+		assert.Empty(t, policy.queue)
+		assert.Equal(t, 2, policy.spool.Len())
+
+		fail = false
+		policy.ingest(&retryPolicyRequest{
+			data:        []byte("third"),
+			httpRequest: httpRequest,
+			callback:    func(err error) {},
+		})
+		assert.Equal(t, []string{"third", "first", "second"}, sent)
+		assert.Zero(t, policy.spool.Len())
+	})
+
+	t.Run("ingester is killed mid-flush, the rest is sent after restart", func(t *testing.T) {
+		dir := tempSpoolDir(t)
+		defer os.RemoveAll(dir)
+
+		// the first process spools 5 batches
+		gs := newGroupStrategy(nil, func(data []byte, ingestionURL string) error {
+			return errors.New("some connection problem")
+		}, 0)
+		gs.setSpool(mustOpenSpool(t, dir, 0))
+		for i := 0; i < 5; i++ {
+			gs.retryPolicy.putToQueue([]byte(fmt.Sprintf("batch-%d", i)), func(err error) {})
+		}
+
+		// the flush is killed while batch-2 is being sent
+		inFlight := make(chan struct{})
+		go gs.retryPolicy.releaseWait(defaultURL, func(data []byte, ingestionURL string) error {
+			if string(data) == "batch-2" {
+				close(inFlight)
+				select {} // the process is killed, the request never returns
+			}
+			return nil
+		})
+		<-inFlight
+
+		// the process crashes while writing the next batch
+		files := segmentFiles(t, dir)
+		f, err := os.OpenFile(files[len(files)-1], os.O_WRONLY|os.O_APPEND, 0600)
+		assert.NoError(t, err)
+		_, err = f.Write([]byte{0, 0, 0, 42, 0xde, 0xad})
+		assert.NoError(t, err)
+		assert.NoError(t, f.Close())
+
+		// the next process replays not sent batches on Activate
+		var mux sync.Mutex
+		var sent []string
+		restarted := newGroupStrategy(nil, func(data []byte, ingestionURL string) error {
+			mux.Lock()
+			sent = append(sent, string(data))
+			mux.Unlock()
+			return nil
+		}, 0)
+		restarted.setSpool(mustOpenSpool(t, dir, 0))
+		restarted.Activate(defaultURL, nil)
+		assert.False(t, restarted.ShutdownWithTimeout(time.Second))
+
+		mux.Lock()
+		defer mux.Unlock()
+		assert.Equal(t, []string{"batch-2", "batch-3", "batch-4"}, sent)
+		assert.Zero(t, restarted.retryPolicy.spool.Len())
+	})
+}
@@ -3,7 +3,9 @@ package ingester
 import (
 	"context"
 	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/log"
 	"sync"
+	"time"
 )
 
 var defaultSDKConfig = &core.SDKConfig{
@@ -13,9 +15,13 @@ var defaultSDKConfig = &core.SDKConfig{
 
 // An Ingester is a mechanism to summarize and send data to server with retry policy
 type Ingester struct {
-	entity   *core.Entity
-	strategy *groupStrategy
-	mux      sync.RWMutex
+	entity    *core.Entity
+	strategy  *groupStrategy
+	sampler   *exposureSampler
+	sinks     []*sinkWorker // readonly after Activate
+	noAirship bool          // data is delivered to the sinks only
+	log       log.Logger
+	mux       sync.RWMutex
 }
 
 type groupStrategy struct {
@@ -32,21 +38,58 @@ type groupStrategy struct {
 	httpRequest httpRequestType // readonly
 	sdkInfo     *core.SDKInfo   // readonly
 	retryPolicy *retryPolicy    // readonly
+	log         log.Logger
 
 	sdkConfig *core.SDKConfig
 	url       string
+	aggregate bool // exposures are sent as AggregatedExposures
 
-	// ingestion data
+	// published data waits in the buffer for the worker, see OverflowPolicy
+	buffer       chan *IngestionDataRequest
+	overflow     OverflowPolicy
+	blockTimeout time.Duration
+	flushes      chan chan<- error // Flush requests, the worker sends the result of the ingestion
+	workerDone   chan struct{}     // closed when the worker exits
+	pending      int64             // atomic, published data which is not ingested yet
+	dropped      int64             // atomic, data dropped because the buffer is full
+	inflight     int64             // atomic, the first attempts of the ingestion requests in progress
+
+	// ingestion data, owned by the worker
 	callCount                     int
 	exposuresCount                int
 	firstExposuresIngestThreshold int
 	accumulator                   []*IngestionDataRequest
 }
 
+// OverflowPolicy defines what Publish does when the ingestion buffer is full
+type OverflowPolicy int
+
+const (
+	// OverflowDropNewest drops the published data
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the oldest data in the buffer to make room for the published one
+	OverflowDropOldest
+	// OverflowBlock blocks Publish until there is room in the buffer or the timeout is reached,
+	// the published data is dropped on timeout
+	OverflowBlock
+)
+
 type retryPolicy struct {
+	log                  log.Logger
 	maxMemorySizeInBytes int64
 	queue                []*queueElement
 	currentMemorySize    int64
+	spool                *Spool // optional, failed data is put to the spool instead of the queue
+	onDrop               DropHandler
+	minDelay             time.Duration // backoff of the first retry
+	maxDelay             time.Duration
+	wake                 chan struct{} // notifies retryLoop about the failed data
+
+	// guards queue modifications and the fields below, used by status
+	mux         sync.Mutex
+	lastError   error
+	lastErrorAt time.Time
+	releasing   bool // releaseWait is in progress
 }
 
 type queueElement struct {
@@ -63,6 +106,21 @@ type retryPolicyRequest struct {
 	callback     RetryPolicyCallback // callback
 }
 
+// Status represent the state of the ingester
+type Status struct {
+	Pending     int       // data requests waiting for the next ingestion
+	Backlog     int       // ingestion batches waiting to be retried
+	LastError   error     // the last ingestion error, nil if the last request succeeded
+	LastErrorAt time.Time // time of the last ingestion error
+	SinkDropped int       // records dropped by the event sinks
+	Dropped     int       // data requests dropped because the ingestion buffer is full, see OverflowPolicy
+}
+
+// DropHandler is called with the ingestion data which will never be sent and the reason:
+// the server rejected it(*StatusError with 4xx status), ErrQueueIsFull, ErrSpoolIsFull or ErrBatchIsTooLarge.
+// The handler must not block
+type DropHandler func(data []byte, err error)
+
 // RetryPolicyCallback is called when retry policy finishes the processing of the ingestion data httpRequest
 // There are 2 possible scenarios:
 // 1) ingestion is successfully sent to the server
@@ -77,4 +135,24 @@ type IngestionDataRequest struct {
 	Events        []*core.Event    `json:"events"`    // user generated event
 	SDKInfo       *core.SDKInfo    `json:"sdkInfo"`   // Dictionary holding info about the Flagger
 	DetectedFlags []string         `json:"detectedFlags"`
+
+	// AggregatedExposures replaces Exposures in the aggregation mode, see Ingester.SetExposureAggregation
+	AggregatedExposures []*ExposureCount `json:"aggregatedExposures,omitempty"`
+}
+
+// ExposureCount is the number of exposures with the same codename, variation, hashkey, methodCalled,
+// entity type and holdout membership within the ingestion interval
+type ExposureCount struct {
+	Codename     string `json:"codename"`
+	Variation    string `json:"variation"`
+	HashKey      string `json:"hashkey,omitempty"`
+	MethodCalled string `json:"methodCalled"`
+	EntityType   string `json:"entityType"`
+	Holdout      bool   `json:"holdout,omitempty"`
+
+	Count         int       `json:"count"`
+	WeightedCount float64   `json:"weightedCount"` // sum of the sampling weights
+	EntityIDs     []string  `json:"entityIds"`     // distinct IDs of the exposed entities
+	From          time.Time `json:"from"`          // timestamp of the first exposure
+	To            time.Time `json:"to"`            // timestamp of the last exposure
 }
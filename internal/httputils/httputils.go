@@ -53,3 +53,18 @@ func MustURL(u string) string {
 	}
 	return u
 }
+
+// HeaderTransport adds Header to every request before passing it to the RoundTripper
+type HeaderTransport struct {
+	RoundTripper http.RoundTripper
+	Header       http.Header
+}
+
+// RoundTrip implements http.RoundTripper, the original request is not modified
+func (t *HeaderTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	for k, v := range t.Header {
+		r.Header[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+	return t.RoundTripper.RoundTrip(r)
+}
@@ -89,3 +89,23 @@ func TestMustURL(t *testing.T) {
 		assert.Fail(t, "Must not be reached")
 	})
 }
+
+func TestHeaderTransport(t *testing.T) {
+	defer gock.OffAll()
+	gock.New(utils.FlagsURL).
+		Get(utils.FlagsPath+utils.APIKey).
+		MatchHeader("X-Custom", "value").
+		MatchHeader("Content-Type", "application/json").
+		Reply(200).
+		JSON(map[string]string{"hashKey": "key"})
+
+	rt := &httputils.HeaderTransport{
+		RoundTripper: http.DefaultTransport,
+		Header:       http.Header{"x-custom": []string{"value"}},
+	}
+
+	var configuration *core.Configuration
+	err := httputils.GetConfiguration(rt, utils.FlagsURL+utils.FlagsPath+utils.APIKey, 1, &configuration)
+	assert.NoError(t, err)
+	assert.Equal(t, "key", configuration.HashKey)
+}
@@ -111,13 +111,13 @@ func (broker *Broker) listen(ctx context.Context) {
 			broker.clients[s] = true
 
 			s <- broker.messageOnJoin
-			log.Debugf("SERVER: Client added. %d registered clients", len(broker.clients))
+			log.Debug("SERVER: Client added", "clients", len(broker.clients))
 		case s := <-broker.closingClients:
 
 			// A client has dettached and we want to
 			// stop sending them messages.
 			delete(broker.clients, s)
-			log.Debugf("SERVER: Removed client. %d registered clients", len(broker.clients))
+			log.Debug("SERVER: Removed client", "clients", len(broker.clients))
 		case event := <-broker.Notifier:
 
 			// We got a new event from the outside!
@@ -126,7 +126,7 @@ func (broker *Broker) listen(ctx context.Context) {
 				clientMessageChan <- event
 			}
 		case <-ctx.Done():
-			log.Debugf("SERVER: ctx.Done()")
+			log.Debug("SERVER: ctx.Done()")
 			return
 		}
 	}
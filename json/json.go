@@ -13,3 +13,6 @@ func Marshal(v interface{}) ([]byte, error) {
 func Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
+
+// Number represents a JSON number literal, see encoding/json.Number
+type Number = json.Number
@@ -4,24 +4,40 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-var log = logrus.New()
+// Logger represent structured logger used by Flagger.
+// keysAndValues is a list of alternating keys and values, e.g. "codename", "feature-x", "status", 200
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+var (
+	std           = logrus.New()
+	defaultLogger = NewLogrusLogger(std)
+)
+
+// Default returns logrus based logger which is used when no Logger is provided
+func Default() Logger {
+	return defaultLogger
+}
 
-// Debugf thread safe write debug message
-func Debugf(fmt string, args ...interface{}) {
-	log.Debugf(fmt, args...)
+// Debug thread safe write debug message to the default logger
+func Debug(msg string, keysAndValues ...interface{}) {
+	defaultLogger.Debug(msg, keysAndValues...)
 }
 
-// Warnf thread safe write warning message
-func Warnf(fmt string, args ...interface{}) {
-	log.Warnf(fmt, args...)
+// Warn thread safe write warning message to the default logger
+func Warn(msg string, keysAndValues ...interface{}) {
+	defaultLogger.Warn(msg, keysAndValues...)
 }
 
-// Errorf thread safe write error message
-func Errorf(fmt string, args ...interface{}) {
-	log.Errorf(fmt, args...)
+// Error thread safe write error message to the default logger
+func Error(msg string, keysAndValues ...interface{}) {
+	defaultLogger.Error(msg, keysAndValues...)
 }
 
-// SetLevel set logging level for flagger
+// SetLevel set logging level for the default logger
 func SetLevel(level logrus.Level) {
-	log.SetLevel(level)
+	std.SetLevel(level)
 }
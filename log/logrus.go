@@ -0,0 +1,52 @@
+package log
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NewLogrusLogger adapts logrus.Logger to the Logger interface
+func NewLogrusLogger(l *logrus.Logger) Logger {
+	return &logrusLogger{log: l}
+}
+
+type logrusLogger struct {
+	log *logrus.Logger
+}
+
+func (l *logrusLogger) Debug(msg string, keysAndValues ...interface{}) {
+	if l.log.IsLevelEnabled(logrus.DebugLevel) {
+		l.log.WithFields(toFields(keysAndValues)).Debug(msg)
+	}
+}
+
+func (l *logrusLogger) Warn(msg string, keysAndValues ...interface{}) {
+	if l.log.IsLevelEnabled(logrus.WarnLevel) {
+		l.log.WithFields(toFields(keysAndValues)).Warn(msg)
+	}
+}
+
+func (l *logrusLogger) Error(msg string, keysAndValues ...interface{}) {
+	if l.log.IsLevelEnabled(logrus.ErrorLevel) {
+		l.log.WithFields(toFields(keysAndValues)).Error(msg)
+	}
+}
+
+// converts alternating keys and values into logrus.Fields
+// non-string key is formatted with %v, a dangling key gets "!MISSING" value
+func toFields(keysAndValues []interface{}) logrus.Fields {
+	fields := make(logrus.Fields, len(keysAndValues)/2)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key, ok := keysAndValues[i].(string)
+		if !ok {
+			key = fmt.Sprintf("%v", keysAndValues[i])
+		}
+		if i+1 < len(keysAndValues) {
+			fields[key] = keysAndValues[i+1]
+		} else {
+			fields[key] = "!MISSING"
+		}
+	}
+	return fields
+}
@@ -0,0 +1,46 @@
+package log
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogrusLogger(t *testing.T) {
+	t.Run("key values are written as fields", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := logrus.New()
+		l.SetOutput(&buf)
+		l.SetFormatter(&logrus.JSONFormatter{})
+
+		NewLogrusLogger(l).Warn("message", "codename", "test", "status", 500)
+
+		assert.Contains(t, buf.String(), `"codename":"test"`)
+		assert.Contains(t, buf.String(), `"status":500`)
+		assert.Contains(t, buf.String(), `"msg":"message"`)
+		assert.Contains(t, buf.String(), `"level":"warning"`)
+	})
+
+	t.Run("level is respected", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := logrus.New()
+		l.SetOutput(&buf)
+		l.SetLevel(logrus.ErrorLevel)
+
+		logger := NewLogrusLogger(l)
+		logger.Debug("debug")
+		logger.Warn("warn")
+		assert.Empty(t, buf.String())
+
+		logger.Error("error")
+		assert.Contains(t, buf.String(), "error")
+	})
+}
+
+func Test_toFields(t *testing.T) {
+	assert.Equal(t, logrus.Fields{}, toFields(nil))
+	assert.Equal(t, logrus.Fields{"url": "http://test"}, toFields([]interface{}{"url", "http://test"}))
+	assert.Equal(t, logrus.Fields{"1": 2, "key": "!MISSING"}, toFields([]interface{}{1, 2, "key"}))
+}
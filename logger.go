@@ -0,0 +1,121 @@
+package flagger
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/airdeploy/flagger-go/v3/log"
+)
+
+// instanceLogger is the logger shared by all components of a Flagger instance.
+// It allows SetLogger to replace the logger of already running components
+// and redacts the API key from messages and values.
+type instanceLogger struct {
+	logger atomic.Value // holds loggerBox
+	apiKey atomic.Value // holds string
+}
+
+// atomic.Value requires values of the same concrete type
+type loggerBox struct {
+	log.Logger
+}
+
+func newInstanceLogger(logger log.Logger) *instanceLogger {
+	l := &instanceLogger{}
+	l.set(logger)
+	l.setAPIKey("")
+	return l
+}
+
+func (l *instanceLogger) set(logger log.Logger) {
+	l.logger.Store(loggerBox{logger})
+}
+
+func (l *instanceLogger) get() log.Logger {
+	return l.logger.Load().(loggerBox).Logger
+}
+
+// setAPIKey sets the key to be redacted
+func (l *instanceLogger) setAPIKey(apiKey string) {
+	l.apiKey.Store(apiKey)
+}
+
+func (l *instanceLogger) Debug(msg string, keysAndValues ...interface{}) {
+	msg, keysAndValues = l.redact(msg, keysAndValues)
+	l.get().Debug(msg, keysAndValues...)
+}
+
+func (l *instanceLogger) Warn(msg string, keysAndValues ...interface{}) {
+	msg, keysAndValues = l.redact(msg, keysAndValues)
+	l.get().Warn(msg, keysAndValues...)
+}
+
+func (l *instanceLogger) Error(msg string, keysAndValues ...interface{}) {
+	msg, keysAndValues = l.redact(msg, keysAndValues)
+	l.get().Error(msg, keysAndValues...)
+}
+
+// redact replaces the API key in the message, strings, errors and fmt.Stringer values.
+// keysAndValues slice is copied only when something is replaced
+func (l *instanceLogger) redact(msg string, keysAndValues []interface{}) (string, []interface{}) {
+	apiKey := l.apiKey.Load().(string)
+	if apiKey == "" {
+		return msg, keysAndValues
+	}
+	replace := func(s string) string {
+		return strings.Replace(s, apiKey, redactAPIKey(apiKey), -1)
+	}
+
+	msg = replace(msg)
+	var res []interface{}
+	for i, v := range keysAndValues {
+		var s string
+		switch vv := v.(type) {
+		case string:
+			s = vv
+		case error:
+			s = vv.Error()
+		case fmt.Stringer:
+			s = vv.String()
+		default:
+			continue
+		}
+		if !strings.Contains(s, apiKey) {
+			continue
+		}
+		if res == nil {
+			res = append([]interface{}(nil), keysAndValues...)
+		}
+		if _, ok := v.(error); ok {
+			res[i] = errors.New(replace(s))
+		} else {
+			res[i] = replace(s)
+		}
+	}
+	if res == nil {
+		return msg, keysAndValues
+	}
+	return msg, res
+}
+
+// redactError returns the error with the API key redacted from its message
+func (l *instanceLogger) redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	apiKey := l.apiKey.Load().(string)
+	if apiKey == "" || !strings.Contains(err.Error(), apiKey) {
+		return err
+	}
+	return errors.New(strings.Replace(err.Error(), apiKey, redactAPIKey(apiKey), -1))
+}
+
+// redactAPIKey masks all but the last 4 characters of the key
+func redactAPIKey(apiKey string) string {
+	if len(apiKey) <= 8 {
+		return strings.Repeat("*", len(apiKey))
+	}
+	return strings.Repeat("*", len(apiKey)-4) + apiKey[len(apiKey)-4:]
+}
@@ -0,0 +1,49 @@
+package flagger
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_redactAPIKey(t *testing.T) {
+	assert.Equal(t, "", redactAPIKey(""))
+	assert.Equal(t, "********", redactAPIKey("12345678"))
+	assert.Equal(t, "******iKey", redactAPIKey("testApiKey"))
+}
+
+func Test_instanceLogger_redact(t *testing.T) {
+	l := newInstanceLogger(nil)
+
+	t.Run("nothing is redacted without API key", func(t *testing.T) {
+		kv := []interface{}{"url", "https://flags.airdeploy.io/v3/config/testApiKey"}
+		msg, res := l.redact("testApiKey", kv)
+		assert.Equal(t, "testApiKey", msg)
+		assert.Equal(t, kv, res)
+	})
+
+	l.setAPIKey("testApiKey")
+
+	t.Run("message, strings, errors and stringers are redacted", func(t *testing.T) {
+		u, _ := url.Parse("https://flags.airdeploy.io/v3/config/testApiKey")
+		kv := []interface{}{
+			"url", "https://flags.airdeploy.io/v3/config/testApiKey",
+			"error", errors.New("cannot get /v3/config/testApiKey"),
+			"stringer", u,
+			"status", 200,
+		}
+		msg, res := l.redact("key is testApiKey", kv)
+		assert.Equal(t, "key is ******iKey", msg)
+		assert.Equal(t, []interface{}{
+			"url", "https://flags.airdeploy.io/v3/config/******iKey",
+			"error", errors.New("cannot get /v3/config/******iKey"),
+			"stringer", "https://flags.airdeploy.io/v3/config/******iKey",
+			"status", 200,
+		}, res)
+
+		// provided values are not mutated
+		assert.Equal(t, "https://flags.airdeploy.io/v3/config/testApiKey", kv[1])
+	})
+}
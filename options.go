@@ -0,0 +1,315 @@
+package flagger
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/ingester"
+	"github.com/airdeploy/flagger-go/v3/internal/httputils"
+	"github.com/airdeploy/flagger-go/v3/log"
+	"github.com/airdeploy/flagger-go/v3/sse"
+	"github.com/sirupsen/logrus"
+)
+
+const defaultIngestionTimeout = 30 * time.Second
+
+// Option configures Flagger instance, see NewFlagger
+type Option func(o *options)
+
+// options are per instance settings, nothing is shared between Flagger instances
+type options struct {
+	httpClient      *http.Client      // used for ingestion
+	roundTripper    http.RoundTripper // shared by config fetch, SSE and ingestion
+	headers         http.Header       // added to every outbound request
+	logger          log.Logger
+	logrus          *logrus.Logger // the instance default logger, InitArgs.LogLevel sets its level
+	sdkInfo         *core.SDKInfo
+	sourceURL       string
+	backupSourceURL string
+	sseURL          string
+	ingestionURL    string
+	maxConfigAge    time.Duration // zero means no limit
+	stalePolicy     StaleConfigPolicy
+	spoolDir        string // empty means the failed ingestion data is kept in memory
+	spoolMaxSize    int64
+	dropHandler     ingester.DropHandler
+	exposureRate    float64       // zero means every exposure is ingested
+	exposureWindow  time.Duration // zero means no deduplication
+	aggregate       bool          // exposures are uploaded as counts
+	sinks           []sinkOption
+	noAirship       bool // data is delivered to the sinks only
+	bufferSize      int  // zero means ingester.DefaultBufferSize
+	overflow        ingester.OverflowPolicy
+	blockTimeout    time.Duration
+	eventSchemas    map[string]*core.EventSchema // by event name
+	assignments     core.AssignmentStore         // nil means no sticky assignments
+	clock           func() time.Time             // nil means time.Now
+	timezone        *time.Location               // nil means UTC
+}
+
+type sinkOption struct {
+	sink ingester.EventSink
+	opts ingester.SinkOptions
+}
+
+func newOptions(opts ...Option) *options {
+	std := logrus.New()
+	o := &options{
+		logger:          log.NewLogrusLogger(std),
+		logrus:          std,
+		sdkInfo:         &core.SDKInfo{Name: SDKName, Version: SDKVersion},
+		sourceURL:       defaultSourceURL,
+		backupSourceURL: defaultBackupSourceURL,
+		sseURL:          defaultSSEURL,
+		ingestionURL:    defaultIngestionURL,
+		stalePolicy:     StaleConfigKeep,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// transport returns the transport shared by config fetch, SSE and ingestion wrapped with the extra headers.
+// fallback is used if neither WithRoundTripper nor WithHTTPClient is provided
+func (o *options) transport(fallback http.RoundTripper) http.RoundTripper {
+	rt := fallback
+	switch {
+	case o.roundTripper != nil:
+		rt = o.roundTripper
+	case o.httpClient != nil && o.httpClient.Transport != nil:
+		rt = o.httpClient.Transport
+	case o.httpClient != nil:
+		rt = http.DefaultTransport
+	}
+	if len(o.headers) > 0 {
+		rt = &httputils.HeaderTransport{RoundTripper: rt, Header: o.headers}
+	}
+	return rt
+}
+
+// configRoundTripper returns the transport used to fetch the configuration
+func (o *options) configRoundTripper() http.RoundTripper {
+	return o.transport(http.DefaultTransport)
+}
+
+// sseRoundTripper returns the transport used by SSE
+func (o *options) sseRoundTripper() http.RoundTripper {
+	return o.transport(sse.NewTransport())
+}
+
+// ingestionClient returns http client used by the ingester
+func (o *options) ingestionClient() *http.Client {
+	client := &http.Client{Timeout: defaultIngestionTimeout}
+	if o.httpClient != nil {
+		c := *o.httpClient
+		client = &c
+	}
+	client.Transport = o.transport(http.DefaultTransport)
+	return client
+}
+
+// withHeaders returns a copy of options with additional headers
+func (o *options) withHeaders(header http.Header) *options {
+	res := *o
+	res.headers = http.Header{}
+	for k, v := range o.headers {
+		res.headers[k] = v
+	}
+	for k, v := range header {
+		res.headers[http.CanonicalHeaderKey(k)] = v
+	}
+	return &res
+}
+
+// WithHTTPClient sets the http client for the outbound traffic.
+// The client is used for ingestion and its Transport is used for the configuration fetch and SSE connection.
+// Client.Timeout is not applied to SSE because SSE is a long living connection.
+func WithHTTPClient(client *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = client
+	}
+}
+
+// WithRoundTripper sets the transport for the configuration fetch, SSE and ingestion.
+// Use it to configure a proxy, TLS client certificates, etc. It takes precedence over WithHTTPClient's Transport
+func WithRoundTripper(rt http.RoundTripper) Option {
+	return func(o *options) {
+		o.roundTripper = rt
+	}
+}
+
+// WithHeaders adds headers to every request sent to the configuration, SSE and ingestion servers
+func WithHeaders(header http.Header) Option {
+	return func(o *options) {
+		if o.headers == nil {
+			o.headers = http.Header{}
+		}
+		for k, v := range header {
+			for _, vv := range v {
+				o.headers.Add(k, vv)
+			}
+		}
+	}
+}
+
+// WithLogger sets the structured logger, see log.Logger
+func WithLogger(logger log.Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithSDKInfo overrides SDKInfo that is sent with ingestion data
+func WithSDKInfo(info *core.SDKInfo) Option {
+	return func(o *options) {
+		if info != nil {
+			o.sdkInfo = info.Copy()
+		}
+	}
+}
+
+// WithSourceURL sets default SourceURL which is used when neither InitArgs nor env variable provides it
+func WithSourceURL(URL string) Option {
+	return func(o *options) {
+		o.sourceURL = URL
+	}
+}
+
+// WithBackupSourceURL sets default BackupSourceURL which is used when neither InitArgs nor env variable provides it
+func WithBackupSourceURL(URL string) Option {
+	return func(o *options) {
+		o.backupSourceURL = URL
+	}
+}
+
+// WithSSEURL sets default SSEURL which is used when neither InitArgs nor env variable provides it
+func WithSSEURL(URL string) Option {
+	return func(o *options) {
+		o.sseURL = URL
+	}
+}
+
+// WithIngestionURL sets default IngestionURL which is used when neither InitArgs nor env variable provides it
+func WithIngestionURL(URL string) Option {
+	return func(o *options) {
+		o.ingestionURL = URL
+	}
+}
+
+// WithMaxConfigAge sets the max age of the configuration and the policy applied when the configuration exceeds it.
+// The configuration age is the time since it was fetched or last confirmed by the SSE connection, see HealthStatus.
+// Zero maxAge disables the check
+func WithMaxConfigAge(maxAge time.Duration, policy StaleConfigPolicy) Option {
+	return func(o *options) {
+		o.maxConfigAge = maxAge
+		o.stalePolicy = policy
+	}
+}
+
+// WithIngestionSpool keeps the ingestion data which is failed to be sent in segment files under the dir,
+// so the data survives process restarts and is sent by the next Init.
+// maxSize limits the size of the spool, the oldest data is dropped when the limit is reached, see ingester.OpenSpool.
+// The dir must not be shared by several Flagger instances
+func WithIngestionSpool(dir string, maxSize int64) Option {
+	return func(o *options) {
+		o.spoolDir = dir
+		o.spoolMaxSize = maxSize
+	}
+}
+
+// WithIngestionDropHandler sets the handler which is called with the ingestion data that will never be sent:
+// the data rejected by the server or dropped because the queue or the spool is full, see ingester.DropHandler
+func WithIngestionDropHandler(handler ingester.DropHandler) Option {
+	return func(o *options) {
+		o.dropHandler = handler
+	}
+}
+
+// WithExposureSampling reduces the exposure ingestion of hot flags:
+// the same (entity, flag, variation) exposure is ingested once within dedupWindow(zero disables the deduplication)
+// and the rest of exposures are sampled with the rate in range (0, 1].
+// Ingested exposures carry the sampling weight 1/rate. SDKConfig of the configuration overrides the values
+func WithExposureSampling(rate float64, dedupWindow time.Duration) Option {
+	return func(o *options) {
+		o.exposureRate = rate
+		o.exposureWindow = dedupWindow
+	}
+}
+
+// WithExposureAggregation uploads exposures rolled up into counts per
+// (codename, variation, hashkey, methodCalled, entity type, holdout) with distinct entity IDs
+// instead of one exposure per flag call
+func WithExposureAggregation() Option {
+	return func(o *options) {
+		o.aggregate = true
+	}
+}
+
+// WithEventSink adds the sink the exposures and the tracked events are delivered to besides Airship,
+// e.g. ingester.NewFileSink, ingester.NewWriterSink or ingester.NewWebhookSink.
+// Every sink batches the records in its own goroutine, the records are dropped if its buffer is full
+func WithEventSink(sink ingester.EventSink, opts ingester.SinkOptions) Option {
+	return func(o *options) {
+		o.sinks = append(o.sinks, sinkOption{sink: sink, opts: opts})
+	}
+}
+
+// WithoutAirshipIngestion disables sending the data to Airship ingestion endpoint, see WithEventSink
+func WithoutAirshipIngestion() Option {
+	return func(o *options) {
+		o.noAirship = true
+	}
+}
+
+// WithIngestionBuffer sets the size of the buffer the ingested data waits in for the ingestion worker
+// and the policy applied when the buffer is full: ingester.OverflowDropNewest(the default),
+// ingester.OverflowDropOldest or ingester.OverflowBlock which blocks the flag call up to blockTimeout
+func WithIngestionBuffer(size int, overflow ingester.OverflowPolicy, blockTimeout time.Duration) Option {
+	return func(o *options) {
+		o.bufferSize = size
+		o.overflow = overflow
+		o.blockTimeout = blockTimeout
+	}
+}
+
+// WithEventSchemas registers the schemas Track validates the events against,
+// the events are tracked anyway, the problems are logged as warnings.
+// The events without the registered schema are not validated
+func WithEventSchemas(schemas ...*core.EventSchema) Option {
+	return func(o *options) {
+		if o.eventSchemas == nil {
+			o.eventSchemas = make(map[string]*core.EventSchema, len(schemas))
+		}
+		for _, schema := range schemas {
+			o.eventSchemas[schema.Name] = schema
+		}
+	}
+}
+
+// WithAssignmentStore enables sticky assignments: the sampled entities keep the variation stored in the store
+// while it exists in the flag, so changing the probabilities doesn't reshuffle them.
+// See core.NewMemoryAssignmentStore and core.NewFileAssignmentStore
+func WithAssignmentStore(store core.AssignmentStore) Option {
+	return func(o *options) {
+		o.assignments = store
+	}
+}
+
+// WithClock sets the time source of the flag schedules(activeFrom/activeUntil of the flag)
+// and the virtual attributes("$now", "$weekday", "$hour"), e.g. to test the launches
+func WithClock(now func() time.Time) Option {
+	return func(o *options) {
+		o.clock = now
+	}
+}
+
+// WithTimezone sets the timezone of "$weekday" and "$hour" virtual attributes the filters can use, UTC by default
+func WithTimezone(location *time.Location) Option {
+	return func(o *options) {
+		o.timezone = location
+	}
+}
@@ -0,0 +1,520 @@
+package flagger_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3"
+	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/ingester"
+	"github.com/airdeploy/flagger-go/v3/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/h2non/gock.v1"
+)
+
+// countingTransport counts requests by host and delegates to the current http.DefaultTransport(gock)
+type countingTransport struct {
+	mux   sync.Mutex
+	hosts map[string]int
+}
+
+func (rt *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.mux.Lock()
+	if rt.hosts == nil {
+		rt.hosts = map[string]int{}
+	}
+	rt.hosts[req.URL.Host]++
+	rt.mux.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (rt *countingTransport) count(host string) int {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	return rt.hosts[host]
+}
+
+func host(rawURL string) string {
+	u, _ := url.Parse(rawURL)
+	return u.Host
+}
+
+// ingestionServer accepts ingestion and records the ingested entities and exposures
+type ingestionServer struct {
+	*httptest.Server
+	mux       sync.Mutex
+	entities  []string // IDs of the ingested entities
+	exposures []*core.Exposure
+}
+
+func newIngestionServer(t *testing.T) *ingestionServer {
+	s := &ingestionServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := utils.ParseIngestionBody(r.Body)
+		assert.NoError(t, err)
+		s.mux.Lock()
+		for _, entity := range data.Entities {
+			s.entities = append(s.entities, entity.ID)
+		}
+		s.exposures = append(s.exposures, data.Exposures...)
+		s.mux.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	return s
+}
+
+// initArgs returns the init args of the config server with the ingestion sent to s
+func (s *ingestionServer) initArgs(config *statusServer) *flagger.InitArgs {
+	args := config.initArgs()
+	args.IngestionURL = s.URL + "/ingest/"
+	return args
+}
+
+func (s *ingestionServer) ingestedEntities() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]string(nil), s.entities...)
+}
+
+func (s *ingestionServer) ingestedExposures() []*core.Exposure {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return append([]*core.Exposure(nil), s.exposures...)
+}
+
+func TestNewFlagger_Options(t *testing.T) {
+	var configuration *core.Configuration
+	utils.MustJSONFile(ingestionConfig, &configuration)
+
+	t.Run("http client transport is shared by config fetch, SSE and ingestion", func(t *testing.T) {
+		defer gock.OffAll()
+		gock.New(utils.FlagsURL).
+			Get(utils.FlagsPath + utils.APIKey).
+			Reply(http.StatusOK).
+			JSON(configuration)
+		catchIngestion(1)
+
+		rt := &countingTransport{}
+		f := flagger.NewFlagger(flagger.WithHTTPClient(&http.Client{Transport: rt}))
+		err := f.Init(&flagger.InitArgs{APIKey: utils.APIKey, SSEURL: utils.SseURL})
+		assert.NoError(t, err)
+
+		// wait for SSE to connect
+		time.Sleep(100 * time.Millisecond)
+		timeout := f.Shutdown(1 * time.Second)
+		assert.False(t, timeout)
+
+		assert.Equal(t, 1, rt.count(host(utils.FlagsURL)))
+		assert.Equal(t, 1, rt.count(host(utils.IngestionURL)))
+		assert.NotZero(t, rt.count(host(utils.SseURL)))
+	})
+
+	t.Run("instances don't share SDKInfo and default URLs", func(t *testing.T) {
+		defer gock.OffAll()
+		defer gock.Observe(nil)
+
+		gock.New("https://first.source.io").
+			Get("/config/" + utils.APIKey).
+			Reply(http.StatusOK).
+			JSON(configuration)
+		gock.New("https://second.source.io").
+			Get("/config/" + utils.APIKey).
+			Reply(http.StatusOK).
+			JSON(configuration)
+		gock.New("https://first.ingestion.io").
+			Post("/ingest/" + utils.APIKey).
+			Reply(http.StatusOK)
+		gock.New("https://second.ingestion.io").
+			Post("/ingest/" + utils.APIKey).
+			Reply(http.StatusOK)
+
+		var mux sync.Mutex
+		sdkNames := map[string]string{}
+		gock.Observe(func(request *http.Request, mock gock.Mock) {
+			if request.Method == http.MethodPost {
+				data, err := utils.ParseIngestionBody(request.Body)
+				assert.NoError(t, err)
+				mux.Lock()
+				sdkNames[request.URL.Host] = data.SDKInfo.Name
+				mux.Unlock()
+			}
+		})
+
+		first := flagger.NewFlagger(
+			flagger.WithSDKInfo(&core.SDKInfo{Name: "first", Version: "1.0.0"}),
+			flagger.WithSourceURL("https://first.source.io/config/"),
+			flagger.WithIngestionURL("https://first.ingestion.io/ingest/"),
+		)
+		second := flagger.NewFlagger(
+			flagger.WithSDKInfo(&core.SDKInfo{Name: "second", Version: "1.0.0"}),
+			flagger.WithSourceURL("https://second.source.io/config/"),
+			flagger.WithIngestionURL("https://second.ingestion.io/ingest/"),
+		)
+
+		assert.NoError(t, first.Init(&flagger.InitArgs{APIKey: utils.APIKey, SSEURL: utils.SseURL}))
+		assert.NoError(t, second.Init(&flagger.InitArgs{APIKey: utils.APIKey, SSEURL: utils.SseURL}))
+
+		assert.False(t, first.Shutdown(1*time.Second))
+		assert.False(t, second.Shutdown(1*time.Second))
+
+		mux.Lock()
+		defer mux.Unlock()
+		assert.Equal(t, map[string]string{
+			"first.ingestion.io":  "first",
+			"second.ingestion.io": "second",
+		}, sdkNames)
+	})
+}
+
+func TestNewFlagger_TLSAndHeaders(t *testing.T) {
+	configBuf, err := ioutil.ReadFile(ingestionConfig)
+	assert.NoError(t, err)
+
+	clientCert := mustClientCertificate()
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(clientCert.Leaf)
+
+	var mux sync.Mutex
+	headers := map[string]string{} // path -> X-Proxy-Authorization
+	sseConnected := make(chan struct{}, 1)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		headers[r.URL.Path] = r.Header.Get("X-Proxy-Authorization")
+		mux.Unlock()
+
+		switch r.URL.Path {
+		case "/config/" + utils.APIKey:
+			_, _ = w.Write(configBuf)
+		case "/ingest/" + utils.APIKey:
+			w.WriteHeader(http.StatusOK)
+		case "/sse/" + utils.APIKey:
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			sseConnected <- struct{}{}
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	server.TLS = &tls.Config{
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs:  clientCAs,
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{clientCert},
+		},
+	}
+
+	t.Run("handshake fails without client certificate", func(t *testing.T) {
+		f := flagger.NewFlagger(flagger.WithRoundTripper(&http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: rootCAs},
+		}))
+		err := f.Init(&flagger.InitArgs{
+			APIKey:          utils.APIKey,
+			SourceURL:       server.URL + "/config/",
+			BackupSourceURL: server.URL + "/config/",
+		})
+		assert.Error(t, err)
+		f.Shutdown(time.Second)
+	})
+
+	t.Run("client certificate and headers are used for config, SSE and ingestion", func(t *testing.T) {
+		f := flagger.NewFlagger(
+			flagger.WithRoundTripper(transport),
+			flagger.WithHeaders(http.Header{"X-Proxy-Authorization": []string{"secret"}}),
+		)
+		err := f.Init(&flagger.InitArgs{
+			APIKey:       utils.APIKey,
+			SourceURL:    server.URL + "/config/",
+			IngestionURL: server.URL + "/ingest/",
+			SSEURL:       server.URL + "/sse/",
+		})
+		assert.NoError(t, err)
+
+		select {
+		case <-sseConnected:
+		case <-time.After(time.Second):
+			assert.Fail(t, "SSE is not connected")
+		}
+		assert.False(t, f.Shutdown(time.Second))
+
+		mux.Lock()
+		defer mux.Unlock()
+		assert.Equal(t, map[string]string{
+			"/config/" + utils.APIKey: "secret",
+			"/ingest/" + utils.APIKey: "secret",
+			"/sse/" + utils.APIKey:    "secret",
+		}, headers)
+	})
+}
+
+func TestNewFlagger_AuthModeHeader(t *testing.T) {
+	configBuf, err := ioutil.ReadFile(ingestionConfig)
+	assert.NoError(t, err)
+
+	var mux sync.Mutex
+	headers := map[string]string{} // path -> Authorization
+	sseConnected := make(chan struct{}, 1)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		headers[r.URL.Path] = r.Header.Get("Authorization")
+		mux.Unlock()
+
+		switch r.URL.Path {
+		case "/config/":
+			_, _ = w.Write(configBuf)
+		case "/ingest/":
+			w.WriteHeader(http.StatusOK)
+		case "/sse/":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			sseConnected <- struct{}{}
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	f := flagger.NewFlagger()
+	err = f.Init(&flagger.InitArgs{
+		APIKey:       utils.APIKey,
+		SourceURL:    server.URL + "/config/",
+		IngestionURL: server.URL + "/ingest/",
+		SSEURL:       server.URL + "/sse/",
+		AuthMode:     flagger.AuthModeHeader,
+	})
+	assert.NoError(t, err)
+
+	select {
+	case <-sseConnected:
+	case <-time.After(time.Second):
+		assert.Fail(t, "SSE is not connected")
+	}
+	assert.False(t, f.Shutdown(time.Second))
+
+	mux.Lock()
+	defer mux.Unlock()
+	bearer := "Bearer " + utils.APIKey
+	assert.Equal(t, map[string]string{
+		"/config/": bearer,
+		"/ingest/": bearer,
+		"/sse/":    bearer,
+	}, headers)
+}
+
+func TestNewFlagger_IngestionSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "flagger-spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server := newStatusServer(t)
+	defer server.Close()
+	ingestion := newIngestionServer(t)
+	defer ingestion.Close()
+
+	// ingestion server is down, the data is spooled
+	first := flagger.NewFlagger(flagger.WithIngestionSpool(dir, 0))
+	args := server.initArgs()
+	args.IngestionURL = "http://127.0.0.1:1/ingest/"
+	assert.NoError(t, first.Init(args))
+	first.Publish(&core.Entity{ID: "spooled"})
+	assert.False(t, first.Shutdown(time.Second))
+	assert.Empty(t, ingestion.ingestedEntities())
+
+	// the next instance sends the spooled data on Init
+	second := flagger.NewFlagger(flagger.WithIngestionSpool(dir, 0))
+	assert.NoError(t, second.Init(ingestion.initArgs(server)))
+	assert.Eventually(t, func() bool {
+		return len(ingestion.ingestedEntities()) > 0
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, second.Shutdown(time.Second))
+	assert.Equal(t, []string{"spooled"}, ingestion.ingestedEntities())
+	assert.Zero(t, second.Status().IngestionBacklog)
+}
+
+func TestNewFlagger_IngestionDropHandler(t *testing.T) {
+	server := newStatusServer(t)
+	defer server.Close()
+	rejecting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer rejecting.Close()
+
+	var mux sync.Mutex
+	var dropped []error
+	f := flagger.NewFlagger(flagger.WithIngestionDropHandler(func(data []byte, err error) {
+		mux.Lock()
+		dropped = append(dropped, err)
+		mux.Unlock()
+	}))
+	args := server.initArgs()
+	args.IngestionURL = rejecting.URL + "/ingest/"
+	assert.NoError(t, f.Init(args))
+	assert.False(t, f.Shutdown(time.Second))
+
+	mux.Lock()
+	defer mux.Unlock()
+	// the first ingestion is rejected and never retried
+	assert.Len(t, dropped, 1)
+	statusErr, ok := dropped[0].(*ingester.StatusError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusBadRequest, statusErr.StatusCode)
+	assert.Zero(t, f.Status().IngestionBacklog)
+}
+
+func TestNewFlagger_ExposureSampling(t *testing.T) {
+	server := newStatusServer(t)
+	defer server.Close()
+	ingestion := newIngestionServer(t)
+	defer ingestion.Close()
+
+	f := flagger.NewFlagger(flagger.WithExposureSampling(1, time.Minute))
+	assert.NoError(t, f.Init(ingestion.initArgs(server)))
+
+	entity := enabledEntity()
+	for i := 0; i < 10; i++ {
+		assert.True(t, f.IsEnabled("new-signup-flow", entity))
+	}
+	assert.False(t, f.Shutdown(time.Second))
+
+	exposures := ingestion.ingestedExposures()
+	if assert.Len(t, exposures, 1) {
+		assert.Equal(t, "new-signup-flow", exposures[0].Codename)
+		assert.Equal(t, 1.0, exposures[0].SamplingWeight)
+	}
+}
+
+func TestNewFlagger_EventSink(t *testing.T) {
+	server := newStatusServer(t)
+	defer server.Close()
+	ingestion := newIngestionServer(t)
+	defer ingestion.Close()
+
+	var buf bytes.Buffer
+	f := flagger.NewFlagger(
+		flagger.WithEventSink(ingester.NewWriterSink(&buf), ingester.SinkOptions{}),
+		flagger.WithoutAirshipIngestion(),
+	)
+	assert.NoError(t, f.Init(ingestion.initArgs(server)))
+
+	entity := enabledEntity()
+	assert.True(t, f.IsEnabled("new-signup-flow", entity))
+	f.Track(&core.Event{Name: "purchase", Entity: entity})
+	assert.False(t, f.Shutdown(time.Second))
+
+	// Airship ingestion is disabled
+	assert.Empty(t, ingestion.ingestedEntities())
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if assert.Len(t, lines, 2) {
+		assert.Contains(t, lines[0], `"codename":"new-signup-flow"`)
+		assert.Contains(t, lines[1], `"name":"purchase"`)
+	}
+}
+
+// mustClientCertificate generates self-signed client certificate
+func mustClientCertificate() tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("cannot generate key: %+v", err))
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "flagger-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(fmt.Sprintf("cannot create certificate: %+v", err))
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(fmt.Sprintf("cannot parse certificate: %+v", err))
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestNewFlagger_EventSchemas(t *testing.T) {
+	gock.OffAll() // the server is real
+	server := newStatusServer(t)
+	defer server.Close()
+	ingestion := newIngestionServer(t)
+	defer ingestion.Close()
+
+	logger := &recordingLogger{}
+	f := flagger.NewFlagger(
+		flagger.WithLogger(logger),
+		flagger.WithEventSchemas(&core.EventSchema{
+			Name:       "purchase",
+			Properties: map[string]core.PropertyType{"plan": core.PropertyTypeString},
+		}),
+	)
+	assert.NoError(t, f.Init(ingestion.initArgs(server)))
+
+	f.Track(&core.Event{Name: "purchase", EventProperties: core.Attributes{"plan": "Bronze"}, Entity: enabledEntity()})
+	f.Track(&core.Event{Name: "signup", EventProperties: core.Attributes{"referrer": "google"}, Entity: enabledEntity()})
+	f.Track(&core.Event{Name: "purchase", EventProperties: core.Attributes{"Referrer": "google"}, Entity: enabledEntity()})
+	assert.False(t, f.Shutdown(time.Second))
+
+	// the events are tracked anyway
+	assert.Len(t, ingestion.ingestedEntities(), 3)
+
+	var warnings []string
+	for _, e := range logger.messages("warn") {
+		if strings.HasPrefix(e.msg, "Event does not match the schema") {
+			warnings = append(warnings, e.msg)
+		}
+	}
+	assert.Equal(t, []string{`Event does not match the schema: unknown property "referrer"`}, warnings)
+}
+
+func TestNewFlagger_AssignmentStore(t *testing.T) {
+	gock.OffAll() // the server is real
+	server := newStatusServer(t)
+	defer server.Close()
+
+	store := core.NewMemoryAssignmentStore()
+	f := flagger.NewFlagger(flagger.WithAssignmentStore(store))
+	assert.NoError(t, f.Init(server.initArgs()))
+	defer f.Shutdown(time.Second)
+
+	entity := enabledEntity()
+	variation := f.GetVariation("new-signup-flow", entity)
+	stored, ok, err := store.Get(core.AssignmentKey{Codename: "new-signup-flow", EntityID: entity.ID, EntityType: "User"})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, variation, stored)
+}
@@ -27,21 +27,18 @@ var _ interface {
 // CallBack represent callback that process new Flagger configuration
 type CallBack func(v *core.Configuration)
 
-// NewClient return the new instance SSE.Client
-func NewClient(cb CallBack) *Client {
+// NewClient return the new instance SSE.Client.
+// rt is used to connect to the server, nil means the transport returned by NewTransport
+func NewClient(cb CallBack, rt http.RoundTripper) *Client {
+	if rt == nil {
+		rt = NewTransport()
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	return &Client{
-		changeURL: make(chan string, 32),
-		rt: &http.Transport{
-			Proxy: http.ProxyFromEnvironment,
-			DialContext: (&net.Dialer{
-				Timeout:   30 * time.Second,
-				KeepAlive: -1, // disable keep-alive timeout
-			}).DialContext,
-			TLSHandshakeTimeout:   10 * time.Second,
-			ExpectContinueTimeout: 1 * time.Second,
-		},
+		changeURL:         make(chan string, 32),
+		rt:                rt,
 		cb:                cb,
+		log:               log.Default(),
 		reconnectInterval: 30 * time.Second,
 		keepaliveTimeout:  30 * time.Second,
 		ctx:               ctx,
@@ -50,10 +47,17 @@ func NewClient(cb CallBack) *Client {
 	}
 }
 
-func newClientWithRT(cb CallBack, rt http.RoundTripper) *Client {
-	client := NewClient(cb)
-	client.rt = rt
-	return client
+// NewTransport returns a new transport suitable for the long living SSE connection
+func NewTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: -1, // disable keep-alive timeout
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
 }
 
 // Client represent SSE client
@@ -61,21 +65,55 @@ type Client struct {
 	changeURL chan string
 	rt        http.RoundTripper
 	cb        CallBack
+	log       log.Logger
 	one       sync.Once
 	ctx       context.Context
 	cancel    context.CancelFunc
 
+	stateMux sync.RWMutex
+	state    State
+
 	reconnectInterval time.Duration
 	keepaliveTimeout  time.Duration
 	addDelayBefore    time.Duration
 }
 
+// State represent the connection state of the client
+type State struct {
+	Connected     bool
+	LastMessageAt time.Time // zero if no message has been received
+}
+
+// State returns the current connection state
+func (c *Client) State() State {
+	c.stateMux.RLock()
+	defer c.stateMux.RUnlock()
+	return c.state
+}
+
+func (c *Client) setConnected(connected bool) {
+	c.stateMux.Lock()
+	c.state.Connected = connected
+	c.stateMux.Unlock()
+}
+
+func (c *Client) setLastMessageAt(t time.Time) {
+	c.stateMux.Lock()
+	c.state.LastMessageAt = t
+	c.stateMux.Unlock()
+}
+
 // SetURL using to changing subscribing url
 func (c *Client) SetURL(URL string) {
 	c.changeURL <- URL
 	c.one.Do(func() { go c.infiniteLoop() })
 }
 
+// SetLogger sets the logger used by the client. Must be called before SetURL
+func (c *Client) SetLogger(logger log.Logger) {
+	c.log = logger
+}
+
 // Shutdown - closes sse connection to free up the resources
 func (c *Client) Shutdown() {
 	c.cancel()
@@ -131,21 +169,22 @@ func (c *Client) infiniteLoop() {
 				select {
 				case message, ok := <-dataChannel: // (1) consumer
 					if !ok {
-						log.Debugf("SSE: connection is closed")
+						c.log.Debug("SSE: connection is closed", "url", URL)
 						return // messagesReader goroutine was returned
 					}
 
 					keepAliveTimer.Reset(c.keepaliveTimeout)
-					processMessage(message, c.cb)
+					c.setLastMessageAt(time.Now())
+					processMessage(message, c.cb, c.log)
 
 				case <-keepAliveTimer.C:
-					log.Debugf("SSE: keepAlive timeout has expired, timeout: %s", c.keepaliveTimeout)
+					c.log.Debug("SSE: keepAlive timeout has expired", "url", URL, "timeout", c.keepaliveTimeout)
 					return
 
 				case u := <-c.changeURL:
 					URL = u
 					isURLHasChanged = true
-					log.Debugf("SSE: URL has changed to %s", URL)
+					c.log.Debug("SSE: URL has changed", "url", URL)
 					return
 				case <-c.ctx.Done():
 					return
@@ -153,7 +192,7 @@ func (c *Client) infiniteLoop() {
 			}
 		})
 
-		log.Debugf("SSE: not accepting new messages")
+		c.log.Debug("SSE: not accepting new messages", "url", URL)
 
 		if /* NOT */ !isURLHasChanged {
 			reconnectWithDelay := time.Since(connectedAt) < c.addDelayBefore
@@ -166,21 +205,21 @@ func (c *Client) infiniteLoop() {
 				interval = 0
 			}
 
-			log.Debugf("SSE: Waiting %s to reconnect", time.Duration.Round(interval, time.Millisecond))
+			c.log.Debug("SSE: waiting to reconnect", "url", URL, "interval", time.Duration.Round(interval, time.Millisecond))
 			// server URL can be changed during reconnection timeout, so:
 			timer := time.NewTimer(interval)
 			select {
 			case u := <-c.changeURL:
 				timer.Stop()
 				URL = u
-				log.Debugf("SSE: URL has changed during reconnection phase to %s", URL)
+				c.log.Debug("SSE: URL has changed during reconnection phase", "url", URL)
 
 			case <-timer.C:
 				timer.Stop()
-				log.Debugf("SSE: reconnect interval has passed, reconnecting to %+v", URL)
+				c.log.Debug("SSE: reconnect interval has passed, reconnecting", "url", URL)
 
 			case <-c.ctx.Done():
-				log.Debugf("SSE: shut down")
+				c.log.Debug("SSE: shut down")
 				return
 			}
 		}
@@ -190,7 +229,7 @@ func (c *Client) infiniteLoop() {
 func (c *Client) reconnect(URL string, onConnected func(r io.Reader)) {
 	req, err := http.NewRequest(http.MethodGet, URL, http.NoBody)
 	if err != nil {
-		log.Debugf("SSE: error when connecting to URL: %+v", URL)
+		c.log.Debug("SSE: cannot create request", "url", URL, "error", err)
 		return
 	}
 
@@ -198,22 +237,24 @@ func (c *Client) reconnect(URL string, onConnected func(r io.Reader)) {
 	req.Header.Set("accept-encoding", "gzip")
 	resp, err := c.rt.RoundTrip(req)
 	if err != nil {
-		log.Debugf("SSE: error %+v when connecting to URL: %+v", err.Error(), URL)
+		c.log.Debug("SSE: error when connecting", "url", URL, "error", err)
 		return
 	}
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK {
-		log.Debugf("SSE: connection failed, status: \"%s\", code: \"%d\"", resp.Status, resp.StatusCode)
+		c.log.Debug("SSE: connection failed", "url", URL, "status", resp.StatusCode)
 		return
 	}
 
-	log.Debugf("SSE: connected to %s", URL)
+	c.log.Debug("SSE: connected", "url", URL)
+	c.setConnected(true)
+	defer c.setConnected(false)
 	switch resp.Header.Get("content-encoding") {
 	case "gzip":
 		r, err := gzip.NewReader(resp.Body)
 		if err != nil {
-			log.Debugf("SSE: failed to read gzipped data, url: %+v", URL)
+			c.log.Debug("SSE: failed to read gzipped data", "url", URL, "error", err)
 			return
 		}
 		onConnected(r)
@@ -238,19 +279,19 @@ func messagesReader(r io.Reader, dataChannel chan<- [][]byte) {
 	}
 }
 
-func processMessage(message [][]byte, cb CallBack) {
+func processMessage(message [][]byte, cb CallBack, logger log.Logger) {
 	_, kind, data, err := parseMessage(message)
 	if err != nil {
-		log.Warnf("SSE: parse message error: %+v", err)
+		logger.Warn("SSE: parse message error", "error", err)
 		return
 	}
 
 	if kind == "flagConfigUpdate" {
-		log.Debugf("SSE: has received the message: %s", message)
+		logger.Debug("SSE: has received the message", "event", kind, "data", string(data))
 		var v *core.Configuration
 		err := json.Unmarshal(data, &v)
 		if err != nil {
-			log.Warnf("SSE: json parse error: %+v, data: %+v", err, string(data))
+			logger.Warn("SSE: json parse error", "error", err, "data", string(data))
 			return
 		}
 
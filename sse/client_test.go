@@ -6,12 +6,14 @@ import (
 	"compress/gzip"
 	"context"
 	"github.com/airdeploy/flagger-go/v3/internal"
+	flaggerlog "github.com/airdeploy/flagger-go/v3/log"
 	"github.com/google/uuid"
 	"gopkg.in/h2non/gock.v1"
 	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -77,7 +79,7 @@ func Test_processMessage(t *testing.T) {
 			[]byte(`data:{"hashKey":"F87CD00E55F6E5997676A8B771F1335D"}`),
 		}, func(v *core.Configuration) {
 			assert.Equal(t, &core.Configuration{HashKey: "F87CD00E55F6E5997676A8B771F1335D"}, v)
-		})
+		}, flaggerlog.Default())
 	})
 
 	t.Run("cb is not called", func(t *testing.T) {
@@ -88,13 +90,13 @@ func Test_processMessage(t *testing.T) {
 				[]byte(`data:`),
 			}, func(v *core.Configuration) {
 				assert.Fail(t, notCalledMessage)
-			})
+			}, flaggerlog.Default())
 		})
 
 		t.Run("because error occurred during parsing the message", func(t *testing.T) {
 			processMessage([][]byte{}, func(v *core.Configuration) {
 				assert.Fail(t, notCalledMessage)
-			})
+			}, flaggerlog.Default())
 		})
 		t.Run("because error occurred during parsing the config", func(t *testing.T) {
 			processMessage([][]byte{
@@ -103,7 +105,7 @@ func Test_processMessage(t *testing.T) {
 				[]byte(`data: not A json`),
 			}, func(v *core.Configuration) {
 				assert.Fail(t, notCalledMessage)
-			})
+			}, flaggerlog.Default())
 		})
 	})
 
@@ -165,7 +167,7 @@ func TestClient_reconnect(t *testing.T) {
 	t.Run("failed scenarios", func(t *testing.T) {
 		sseClient := NewClient(func(v *core.Configuration) {
 			assert.Fail(t, notCalledMessage)
-		})
+		}, nil)
 
 		t.Run("Error parsing URL", func(t *testing.T) {
 			sseClient.reconnect("http://invalidurl6934%^&*#$GR$I#F", func(r io.Reader) {
@@ -184,7 +186,7 @@ func TestClient_reconnect(t *testing.T) {
 				Get("/test").
 				Reply(http.StatusBadRequest)
 
-			sseClient = newClientWithRT(func(v *core.Configuration) {
+			sseClient = NewClient(func(v *core.Configuration) {
 				assert.Fail(t, notCalledMessage)
 			}, gock.DefaultTransport)
 			sseClient.reconnect("http://sse/test", func(r io.Reader) {
@@ -198,7 +200,7 @@ func TestClient_reconnect(t *testing.T) {
 				Reply(http.StatusOK).
 				AddHeader("content-encoding", "gzip")
 
-			sseClient = newClientWithRT(func(v *core.Configuration) {
+			sseClient = NewClient(func(v *core.Configuration) {
 				assert.Fail(t, notCalledMessage)
 			}, gock.DefaultTransport)
 			sseClient.reconnect("http://sse/test", func(r io.Reader) {
@@ -224,7 +226,7 @@ func TestClient_reconnect(t *testing.T) {
 			Reply(http.StatusOK).
 			Body(&compressed).
 			AddHeader("content-encoding", "gzip")
-		sseClient := newClientWithRT(func(v *core.Configuration) {
+		sseClient := NewClient(func(v *core.Configuration) {
 			assert.Fail(t, notCalledMessage)
 		}, gock.DefaultTransport)
 		sseClient.reconnect("http://sse/test", func(r io.Reader) {
@@ -255,7 +257,7 @@ func Test_SSE_Connection(t *testing.T) {
 
 		sseClient := NewClient(func(v *core.Configuration) {
 			count++
-		})
+		}, nil)
 		sseClient.SetURL(sseURL)
 		// wait to connect
 		time.Sleep(timeToConnect)
@@ -282,7 +284,7 @@ func Test_SSE_Connection(t *testing.T) {
 
 		sseClient := NewClient(func(v *core.Configuration) {
 			count++
-		})
+		}, nil)
 		sseClient.SetURL(sseURL)
 
 		sseServer.Notifier <- flaggerConfigMessage
@@ -308,7 +310,7 @@ func Test_SSE_Connection(t *testing.T) {
 
 		sseClient := NewClient(func(v *core.Configuration) {
 			count++
-		})
+		}, nil)
 		sseClient.reconnectInterval = 10 * time.Millisecond
 		sseClient.SetURL(sseURL)
 
@@ -328,7 +330,7 @@ func Test_SSE_Connection(t *testing.T) {
 			connect <- struct{}{}
 		})
 
-		sseClient := NewClient(func(_ *core.Configuration) {})
+		sseClient := NewClient(func(_ *core.Configuration) {}, nil)
 		defer func() {
 			sseClient.Shutdown()
 			sseServer.SetNewClientConnectHandler(nil)
@@ -360,7 +362,7 @@ func Test_SSE_Connection(t *testing.T) {
 		sseServer.SetNewClientConnectHandler(func() {
 			count++
 		})
-		sseClient := NewClient(func(v *core.Configuration) {})
+		sseClient := NewClient(func(v *core.Configuration) {}, nil)
 
 		times := 3
 
@@ -385,7 +387,7 @@ func Test_SSE_Connection(t *testing.T) {
 		onJoin := make(chan struct{})
 		sseClient := NewClient(func(_ *core.Configuration) {
 			onJoin <- struct{}{}
-		})
+		}, nil)
 
 		keepAliveTimeout := 200 * time.Millisecond
 		sseClient.keepaliveTimeout = keepAliveTimeout
@@ -408,7 +410,7 @@ func Test_SSE_Connection(t *testing.T) {
 	})
 
 	t.Run("shutdown is called during reconnection interval", func(t *testing.T) {
-		sseClient := NewClient(func(_ *core.Configuration) {})
+		sseClient := NewClient(func(_ *core.Configuration) {}, nil)
 
 		keepAliveTimeout := 200 * time.Millisecond
 		sseClient.keepaliveTimeout = keepAliveTimeout
@@ -425,7 +427,7 @@ func Test_SSE_Connection(t *testing.T) {
 		onJoin := make(chan struct{})
 		sseClient := NewClient(func(_ *core.Configuration) {
 			onJoin <- struct{}{}
-		})
+		}, nil)
 
 		keepAliveTimeout := 200 * time.Millisecond
 
@@ -452,7 +454,7 @@ func Test_SSE_Connection(t *testing.T) {
 		onJoin := make(chan struct{})
 		sseClient := NewClient(func(_ *core.Configuration) {
 			onJoin <- struct{}{}
-		})
+		}, nil)
 
 		keepaliveTimeout := 200 * time.Millisecond
 		sseClient.addDelayBefore = 100 * time.Millisecond
@@ -487,3 +489,42 @@ func getConfigMessage() []byte {
 	flaggerConfigMessage = append(flaggerConfigMessage, []byte("\n\n")...)
 	return flaggerConfigMessage
 }
+
+func Test_Client_State(t *testing.T) {
+	t.Run("state reflects connection and last message", func(t *testing.T) {
+		disconnect := make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write(getConfigMessage())
+			w.(http.Flusher).Flush()
+			select {
+			case <-disconnect:
+			case <-r.Context().Done():
+			}
+		}))
+		defer server.Close()
+
+		received := make(chan struct{}, 1)
+		sseClient := NewClient(func(v *core.Configuration) {
+			received <- struct{}{}
+		}, nil)
+		sseClient.reconnectInterval = time.Hour
+		defer sseClient.Shutdown()
+
+		assert.Equal(t, State{}, sseClient.State())
+
+		sseClient.SetURL(server.URL)
+		<-received
+
+		state := sseClient.State()
+		assert.True(t, state.Connected)
+		assert.WithinDuration(t, time.Now(), state.LastMessageAt, time.Second)
+
+		close(disconnect)
+		assert.Eventually(t, func() bool {
+			return !sseClient.State().Connected
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, state.LastMessageAt, sseClient.State().LastMessageAt)
+	})
+}
@@ -0,0 +1,231 @@
+package flagger
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/json"
+	"github.com/airdeploy/flagger-go/v3/sse"
+)
+
+// ConfigSource represent the origin of the current configuration
+type ConfigSource string
+
+const (
+	// ConfigSourceURL - the configuration is fetched from SourceURL
+	ConfigSourceURL ConfigSource = "source"
+
+	// ConfigSourceBackupURL - the configuration is fetched from BackupSourceURL
+	ConfigSourceBackupURL ConfigSource = "backup"
+
+	// ConfigSourceSSE - the configuration is received via SSE
+	ConfigSourceSSE ConfigSource = "sse"
+)
+
+// StaleConfigPolicy defines what Flagger does when the configuration is older than the max age, see WithMaxConfigAge
+type StaleConfigPolicy string
+
+const (
+	// StaleConfigKeep keeps evaluating flags with the stale configuration, Flagger only reports it
+	StaleConfigKeep StaleConfigPolicy = "keep"
+
+	// StaleConfigDefaults resolves all flags with the default variation until the configuration is fresh
+	StaleConfigDefaults StaleConfigPolicy = "defaults"
+
+	// StaleConfigRefetch re-fetches the configuration from SourceURL/BackupSourceURL
+	StaleConfigRefetch StaleConfigPolicy = "refetch"
+)
+
+// HealthStatus represent the health of Flagger instance
+type HealthStatus struct {
+	Initialized bool `json:"initialized"`
+
+	ConfigSource    ConfigSource `json:"configSource,omitempty"`
+	ConfigUpdatedAt time.Time    `json:"configUpdatedAt"`
+	// ConfigAge is the time since the configuration was fetched or last confirmed by the SSE connection.
+	// It is zero while SSE is connected
+	ConfigAge     time.Duration `json:"-"`
+	ConfigIsStale bool          `json:"configIsStale"` // ConfigAge exceeds the max age, see WithMaxConfigAge
+
+	SSEConnected     bool      `json:"sseConnected"`
+	SSELastMessageAt time.Time `json:"sseLastMessageAt"`
+
+	IngestionPending     int       `json:"ingestionPending"` // data requests waiting for the next ingestion
+	IngestionBacklog     int       `json:"ingestionBacklog"` // ingestion batches waiting to be retried
+	LastIngestionError   error     `json:"-"`
+	LastIngestionErrorAt time.Time `json:"lastIngestionErrorAt"`
+	IngestionDropped     int       `json:"ingestionDropped"` // data dropped because the ingestion buffer is full
+	SinkDropped          int       `json:"sinkDropped"`      // records dropped by the event sinks, see WithEventSink
+}
+
+// Healthy returns true if Flagger is initialized and the configuration is not stale
+func (s HealthStatus) Healthy() bool {
+	return s.Initialized && !s.ConfigIsStale
+}
+
+type configState struct {
+	mux       sync.RWMutex
+	source    ConfigSource
+	updatedAt time.Time
+}
+
+func (c *configState) set(source ConfigSource) {
+	c.mux.Lock()
+	c.source = source
+	c.updatedAt = time.Now()
+	c.mux.Unlock()
+}
+
+func (c *configState) reset() {
+	c.mux.Lock()
+	c.source = ""
+	c.updatedAt = time.Time{}
+	c.mux.Unlock()
+}
+
+func (c *configState) get() (ConfigSource, time.Time) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	return c.source, c.updatedAt
+}
+
+// Status reports initialization state, configuration source and age, SSE connection state and ingestion backlog
+func (flagger *Flagger) Status() HealthStatus {
+	flagger.mux.RLock()
+	defer flagger.mux.RUnlock()
+	return flagger.status()
+}
+
+// not thread safe
+func (flagger *Flagger) status() HealthStatus {
+	s := HealthStatus{Initialized: flagger.enabled}
+	s.ConfigSource, s.ConfigUpdatedAt = flagger.config.get()
+
+	if flagger.sse != nil {
+		state := flagger.sse.State()
+		s.SSEConnected = state.Connected
+		s.SSELastMessageAt = state.LastMessageAt
+	}
+	s.ConfigAge = configAge(s.Initialized, s.ConfigUpdatedAt, s.SSEConnected, s.SSELastMessageAt)
+
+	if flagger.ingester != nil {
+		is := flagger.ingester.Status()
+		s.IngestionPending = is.Pending
+		s.IngestionBacklog = is.Backlog
+		s.LastIngestionError = flagger.log.redactError(is.LastError)
+		s.LastIngestionErrorAt = is.LastErrorAt
+		s.IngestionDropped = is.Dropped
+		s.SinkDropped = is.SinkDropped
+	}
+
+	maxAge := flagger.opts.maxConfigAge
+	s.ConfigIsStale = maxAge > 0 && s.ConfigAge > maxAge
+	return s
+}
+
+// configAge is the time since the configuration was fetched or confirmed by SSE, zero while SSE is connected
+func configAge(initialized bool, updatedAt time.Time, sseConnected bool, sseLastMessageAt time.Time) time.Duration {
+	if !initialized || updatedAt.IsZero() || sseConnected {
+		return 0
+	}
+	if sseLastMessageAt.After(updatedAt) {
+		updatedAt = sseLastMessageAt
+	}
+	return time.Since(updatedAt)
+}
+
+// useDefaultsForStaleConfig returns true if flags must resolve with the default variation, see StaleConfigDefaults
+// not thread safe
+func (flagger *Flagger) useDefaultsForStaleConfig() bool {
+	maxAge := flagger.opts.maxConfigAge
+	if flagger.opts.stalePolicy != StaleConfigDefaults || maxAge <= 0 {
+		return false
+	}
+	_, updatedAt := flagger.config.get()
+	var state sse.State
+	if flagger.sse != nil {
+		state = flagger.sse.State()
+	}
+	return configAge(flagger.enabled, updatedAt, state.Connected, state.LastMessageAt) > maxAge
+}
+
+// watchConfigAge reports the stale configuration and re-fetches it if StaleConfigRefetch policy is used
+func (flagger *Flagger) watchConfigAge(ctx context.Context, refetch func(ctx context.Context) error) {
+	logger := flagger.logger()
+	maxAge := flagger.opts.maxConfigAge
+	policy := flagger.opts.stalePolicy
+
+	interval := maxAge / 2
+	if interval <= 0 {
+		interval = maxAge
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	wasStale := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s := flagger.Status()
+		if s.ConfigIsStale && !wasStale {
+			logger.Warn("Configuration is stale", "configAge", s.ConfigAge, "maxConfigAge", maxAge, "policy", policy)
+		}
+		wasStale = s.ConfigIsStale
+
+		if s.ConfigIsStale && policy == StaleConfigRefetch {
+			if err := refetch(ctx); err != nil {
+				logger.Warn("Unable to re-fetch the stale configuration", "error", err)
+			}
+		}
+	}
+}
+
+// HealthHandler returns http.Handler which responds with HealthStatus as JSON.
+// The response status is 503 Service Unavailable if Flagger is not healthy, see HealthStatus.Healthy
+func (flagger *Flagger) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := flagger.Status()
+
+		res := struct {
+			HealthStatus
+			Healthy            bool   `json:"healthy"`
+			ConfigAge          string `json:"configAge"`
+			LastIngestionError string `json:"lastIngestionError,omitempty"`
+		}{
+			HealthStatus: s,
+			Healthy:      s.Healthy(),
+			ConfigAge:    s.ConfigAge.String(),
+		}
+		if s.LastIngestionError != nil {
+			res.LastIngestionError = s.LastIngestionError.Error()
+		}
+
+		bytes, err := json.Marshal(res)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !s.Healthy() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_, _ = w.Write(bytes)
+	})
+}
+
+func staleConfigResult(entity *core.Entity) *core.FlagResult {
+	return &core.FlagResult{
+		Entity:    entity,
+		Variation: core.DefaultVariation(),
+		Payload:   core.DefaultVariation().Payload,
+		Reason:    core.ConfigIsStale,
+	}
+}
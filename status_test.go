@@ -0,0 +1,231 @@
+package flagger_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/airdeploy/flagger-go/v3"
+	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+// statusServer serves the configuration, accepts ingestion and
+// keeps SSE connection open or responds with 503 if sse is false
+type statusServer struct {
+	*httptest.Server
+	mux         sync.Mutex
+	configCount int
+	sse         bool
+}
+
+func newStatusServer(t *testing.T) *statusServer {
+	configBuf, err := ioutil.ReadFile(ingestionConfig)
+	assert.NoError(t, err)
+
+	s := &statusServer{sse: true}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mux.Lock()
+		sse := s.sse
+		s.mux.Unlock()
+
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/config/"):
+			s.mux.Lock()
+			s.configCount++
+			s.mux.Unlock()
+			_, _ = w.Write(configBuf)
+		case strings.HasPrefix(r.URL.Path, "/ingest/"):
+			w.WriteHeader(http.StatusOK)
+		case strings.HasPrefix(r.URL.Path, "/sse/") && sse:
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-r.Context().Done()
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	return s
+}
+
+func (s *statusServer) initArgs() *flagger.InitArgs {
+	return &flagger.InitArgs{
+		APIKey:       utils.APIKey,
+		SourceURL:    s.URL + "/config/",
+		IngestionURL: s.URL + "/ingest/",
+		SSEURL:       s.URL + "/sse/",
+	}
+}
+
+func (s *statusServer) configRequests() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.configCount
+}
+
+// enabledEntity returns the entity "new-signup-flow" flag of ingestionConfig is enabled for
+func enabledEntity() *core.Entity {
+	return &core.Entity{
+		ID: "1",
+		Attributes: core.Attributes{
+			"country":  "France",
+			"bday":     "2016-03-16T05:44:23.000Z",
+			"age":      42,
+			"booleans": false,
+		},
+	}
+}
+
+func TestFlagger_Status(t *testing.T) {
+	t.Run("not initialized", func(t *testing.T) {
+		f := flagger.NewFlagger()
+		assert.Equal(t, flagger.HealthStatus{}, f.Status())
+		assert.False(t, f.Status().Healthy())
+	})
+
+	t.Run("initialized, SSE is connected", func(t *testing.T) {
+		server := newStatusServer(t)
+		defer server.Close()
+
+		f := flagger.NewFlagger()
+		assert.NoError(t, f.Init(server.initArgs()))
+		defer f.Shutdown(time.Second)
+
+		assert.Eventually(t, func() bool {
+			return f.Status().SSEConnected
+		}, time.Second, 10*time.Millisecond)
+
+		status := f.Status()
+		assert.True(t, status.Initialized)
+		assert.True(t, status.Healthy())
+		assert.Equal(t, flagger.ConfigSourceURL, status.ConfigSource)
+		assert.WithinDuration(t, time.Now(), status.ConfigUpdatedAt, time.Second)
+		assert.Zero(t, status.ConfigAge)
+		assert.False(t, status.ConfigIsStale)
+		assert.NoError(t, status.LastIngestionError)
+	})
+
+	t.Run("last ingestion error is reported with redacted API key", func(t *testing.T) {
+		server := newStatusServer(t)
+		defer server.Close()
+		args := server.initArgs()
+		args.IngestionURL = "http://127.0.0.1:1/ingest/"
+
+		f := flagger.NewFlagger()
+		assert.NoError(t, f.Init(args))
+		defer f.Shutdown(time.Second)
+
+		assert.Eventually(t, func() bool {
+			return f.Status().LastIngestionError != nil
+		}, 5*time.Second, 10*time.Millisecond)
+
+		status := f.Status()
+		assert.Equal(t, 1, status.IngestionBacklog)
+		assert.NotContains(t, status.LastIngestionError.Error(), utils.APIKey)
+		assert.Contains(t, status.LastIngestionError.Error(), "******iKey")
+	})
+
+	t.Run("stale configuration is kept", func(t *testing.T) {
+		server := newStatusServer(t)
+		defer server.Close()
+		server.sse = false
+
+		logger := &recordingLogger{}
+		f := flagger.NewFlagger(
+			flagger.WithLogger(logger),
+			flagger.WithMaxConfigAge(50*time.Millisecond, flagger.StaleConfigKeep),
+		)
+		assert.NoError(t, f.Init(server.initArgs()))
+		defer f.Shutdown(time.Second)
+
+		time.Sleep(150 * time.Millisecond)
+
+		status := f.Status()
+		assert.True(t, status.ConfigIsStale)
+		assert.True(t, status.ConfigAge > 50*time.Millisecond)
+		assert.False(t, status.Healthy())
+		assert.True(t, f.IsEnabled("new-signup-flow", enabledEntity()))
+
+		var stale []logEntry
+		for _, e := range logger.messages("warn") {
+			if e.msg == "Configuration is stale" {
+				stale = append(stale, e)
+			}
+		}
+		assert.Len(t, stale, 1)
+	})
+
+	t.Run("stale configuration resolves flags with defaults", func(t *testing.T) {
+		server := newStatusServer(t)
+		defer server.Close()
+		server.sse = false
+
+		f := flagger.NewFlagger(flagger.WithMaxConfigAge(50*time.Millisecond, flagger.StaleConfigDefaults))
+		assert.NoError(t, f.Init(server.initArgs()))
+		defer f.Shutdown(time.Second)
+
+		entity := enabledEntity()
+		assert.True(t, f.IsEnabled("new-signup-flow", entity))
+
+		time.Sleep(100 * time.Millisecond)
+		assert.False(t, f.IsEnabled("new-signup-flow", entity))
+		assert.Equal(t, "off", f.GetVariation("new-signup-flow", entity))
+	})
+
+	t.Run("stale configuration is re-fetched", func(t *testing.T) {
+		server := newStatusServer(t)
+		defer server.Close()
+		server.sse = false
+
+		f := flagger.NewFlagger(flagger.WithMaxConfigAge(50*time.Millisecond, flagger.StaleConfigRefetch))
+		assert.NoError(t, f.Init(server.initArgs()))
+		defer f.Shutdown(time.Second)
+
+		assert.Eventually(t, func() bool {
+			return server.configRequests() > 1
+		}, time.Second, 10*time.Millisecond)
+		assert.True(t, f.Status().ConfigAge < time.Second)
+	})
+}
+
+func TestFlagger_HealthHandler(t *testing.T) {
+	t.Run("not initialized", func(t *testing.T) {
+		f := flagger.NewFlagger()
+
+		w := httptest.NewRecorder()
+		f.HealthHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		var res map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, false, res["healthy"])
+		assert.Equal(t, false, res["initialized"])
+	})
+
+	t.Run("initialized", func(t *testing.T) {
+		server := newStatusServer(t)
+		defer server.Close()
+
+		f := flagger.NewFlagger()
+		assert.NoError(t, f.Init(server.initArgs()))
+		defer f.Shutdown(time.Second)
+
+		w := httptest.NewRecorder()
+		f.HealthHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var res map[string]interface{}
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+		assert.Equal(t, true, res["healthy"])
+		assert.Equal(t, "source", res["configSource"])
+		assert.Contains(t, res, "configAge")
+	})
+}
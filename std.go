@@ -1,7 +1,10 @@
 package flagger
 
 import (
+	"context"
 	"github.com/airdeploy/flagger-go/v3/core"
+	"github.com/airdeploy/flagger-go/v3/log"
+	"net/http"
 	"time"
 )
 
@@ -12,6 +15,26 @@ func Init(args *InitArgs) error {
 	return stdFlagger.Init(args)
 }
 
+// SetLogger sets the structured logger for the default Flagger instance
+func SetLogger(logger log.Logger) {
+	stdFlagger.SetLogger(logger)
+}
+
+// Status reports the health of the default Flagger instance, see Flagger.Status
+func Status() HealthStatus {
+	return stdFlagger.Status()
+}
+
+// HealthHandler returns http.Handler which reports the health of the default Flagger instance, see Flagger.HealthHandler
+func HealthHandler() http.Handler {
+	return stdFlagger.HealthHandler()
+}
+
+// Flush sends the ingestion data of the default Flagger instance immediately, see Flagger.Flush
+func Flush(ctx context.Context) error {
+	return stdFlagger.Flush(ctx)
+}
+
 // Publish represent function for publishing Entity into Ingestion URL
 func Publish(entity *core.Entity) {
 	stdFlagger.Publish(entity)
@@ -23,6 +46,11 @@ func Track(event *core.Event) {
 	stdFlagger.Track(event)
 }
 
+// Alias links the previous entity to the current one, see Flagger.Alias
+func Alias(previous, current *core.Entity) {
+	stdFlagger.Alias(previous, current)
+}
+
 // SetEntity represent function to storing Entity(default like), that will be use instead if any method have no entity
 func SetEntity(entity *core.Entity) {
 	stdFlagger.SetEntity(entity)